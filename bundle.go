@@ -0,0 +1,487 @@
+package plugins
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/modules/logger"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Bundle 插件包 (zip / tar / tar.gz), 包含 plugin.yaml, 脚本与资源文件
+	Bundle struct {
+		File     string
+		Manifest *BundleManifest
+		FS       fs.FS
+	}
+
+	// memFS 只读的内存文件系统, 承载解包后的 bundle 内容
+	memFS struct {
+		files map[string][]byte
+		mtime time.Time
+	}
+
+	memFile struct {
+		name string
+		data *bytes.Reader
+		size int64
+		mode fs.FileMode
+		fsys *memFS
+	}
+
+	memFileInfo struct {
+		name  string
+		size  int64
+		mode  fs.FileMode
+		mtime time.Time
+	}
+)
+
+const (
+	// Version 宿主版本, 用于校验 bundle 的 host_version
+	Version = "0.3.0"
+
+	BundleZip   = "zip"
+	BundleTar   = "tar"
+	BundleTarGz = "tar.gz"
+)
+
+var (
+	ErrBundleIncompatible = errors.New("bundle incompatible with host")
+	ErrBundleTooLarge     = errors.New("bundle too large")
+
+	// MaxBundleFileSize 包内单个文件解压后的最大字节数, MaxBundleSize 插件包及解压后全部文件的最大字节数
+	MaxBundleFileSize int64 = 16 << 20
+	MaxBundleSize     int64 = 64 << 20
+)
+
+// OpenBundle 读取插件包, 格式根据文件头自动识别
+func OpenBundle(file string) (*Bundle, error) {
+	var info, err = os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MaxBundleSize {
+		return nil, fmt.Errorf("bundle %s: %w: %d bytes", file, ErrBundleTooLarge, info.Size())
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var files map[string][]byte
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		files, err = readZip(data)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		var reader *gzip.Reader
+		if reader, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			files, err = readTar(reader)
+		}
+	default:
+		files, err = readTar(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bundle %s: %w", file, err)
+	}
+	var raw, ok = files[BundleManifestFile]
+	if !ok {
+		return nil, fmt.Errorf("bundle %s: missing %s", file, BundleManifestFile)
+	}
+	manifest, err := ParseBundleManifest(raw)
+	if err != nil {
+		return nil, fmt.Errorf("bundle %s: %w", file, err)
+	}
+	var fsys = &memFS{files: files, mtime: time.Now()}
+	if _, err = fs.Stat(fsys, manifest.Entrypoint); err != nil {
+		return nil, fmt.Errorf("bundle %s: entrypoint %s: %w", file, manifest.Entrypoint, err)
+	}
+	return &Bundle{File: file, Manifest: manifest, FS: fsys}, nil
+}
+
+// Check 校验宿主版本与已注册的模块, modules 为插件的 Modules()
+func (bundle *Bundle) Check(modules []string) error {
+	if min := bundle.Manifest.HostVersion; min != "" {
+		var constraint = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(min), ">="))
+		if compareVersion(Version, constraint) < 0 {
+			return fmt.Errorf("%w: %s requires host %s, current %s", ErrBundleIncompatible, bundle.Manifest.Name, min, Version)
+		}
+	}
+	var (
+		missing   []string
+		available = make(map[string]bool)
+	)
+	for _, name := range modules {
+		available[name] = true
+	}
+	for _, name := range bundle.Manifest.Modules {
+		if !available[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s requires modules %s", ErrBundleIncompatible, bundle.Manifest.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Options 以 bundle 作为脚本根目录的插件配置
+func (bundle *Bundle) Options(options ...PluginOptions) PluginOptions {
+	var opts = *NewDefaultOptions()
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	opts.ScriptRoot = bundle.FS
+	// 清单中的 logger 配置不覆盖调用方提供的配置
+	if bundle.Manifest.Logger != nil {
+		if _, ok := opts.ModuleOptions[logger.Name]; !ok {
+			var modules = map[string]interface{}{logger.Name: bundle.Manifest.Logger}
+			for k, v := range opts.ModuleOptions {
+				modules[k] = v
+			}
+			opts.ModuleOptions = modules
+		}
+	}
+	return opts
+}
+
+// LoadBundle 打开插件包, 校验兼容性后执行入口脚本
+func LoadBundle(file string, options ...PluginOptions) (*luaPluginImpl, error) {
+	var bundle, err = OpenBundle(file)
+	if err != nil {
+		return nil, err
+	}
+	var plugin = NewLua(bundle.Options(options...)).SetLoader(CreateExtendsLoader)
+	plugin.Boot()
+	if err = bundle.Check(plugin.Modules()); err != nil {
+		plugin.Close()
+		return nil, err
+	}
+	if err = plugin.DoFile(bundle.Manifest.Entrypoint); err != nil {
+		plugin.Close()
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// PackBundle 将目录 dir 打包写入 w, format 为 zip, tar 或 tar.gz
+func PackBundle(dir string, w io.Writer, format string) error {
+	var raw, err = ioutil.ReadFile(filepath.Join(dir, BundleManifestFile))
+	if err != nil {
+		return err
+	}
+	if _, err = ParseBundleManifest(raw); err != nil {
+		return err
+	}
+	var files []string
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	switch format {
+	case BundleZip:
+		return writeZip(dir, files, w)
+	case BundleTar:
+		return writeTar(dir, files, w)
+	case BundleTarGz, "tgz":
+		var gz = gzip.NewWriter(w)
+		if err = writeTar(dir, files, gz); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	return fmt.Errorf("unsupported bundle format %s", format)
+}
+
+// UnpackBundle 将插件包解压到目录 dir
+func UnpackBundle(file, dir string) error {
+	var bundle, err = OpenBundle(file)
+	if err != nil {
+		return err
+	}
+	var files = bundle.FS.(*memFS).files
+	for name, data := range files {
+		var target = filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BundleFormat 根据文件扩展名推断格式
+func BundleFormat(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".tar.gz"), strings.HasSuffix(file, ".tgz"):
+		return BundleTarGz
+	case strings.HasSuffix(file, ".tar"):
+		return BundleTar
+	case strings.HasSuffix(file, ".zip"):
+		return BundleZip
+	}
+	return ""
+}
+
+func readZip(data []byte) (map[string][]byte, error) {
+	var reader, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		files = make(map[string][]byte)
+		total int64
+	)
+	for _, item := range reader.File {
+		if item.FileInfo().IsDir() {
+			continue
+		}
+		var name, err = bundlePath(item.Name)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := item.Open()
+		if err != nil {
+			return nil, err
+		}
+		files[name], err = readLimited(fd, name, &total)
+		_ = fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func readTar(r io.Reader) (map[string][]byte, error) {
+	var (
+		reader = tar.NewReader(r)
+		files  = make(map[string][]byte)
+		total  int64
+	)
+	for {
+		var header, err = reader.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := bundlePath(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if files[name], err = readLimited(reader, name, &total); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLimited 读取包内文件, 超出 MaxBundleFileSize 或累计超出 MaxBundleSize 时返回 ErrBundleTooLarge
+func readLimited(r io.Reader, name string, total *int64) ([]byte, error) {
+	var limit = MaxBundleFileSize
+	if remain := MaxBundleSize - *total; remain < limit {
+		limit = remain
+	}
+	var data, err = ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: %s exceeds %d bytes", ErrBundleTooLarge, name, limit)
+	}
+	*total += int64(len(data))
+	return data, nil
+}
+
+func writeZip(dir string, files []string, w io.Writer) error {
+	var writer = zip.NewWriter(w)
+	for _, file := range files {
+		var name, err = filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		fd, err := writer.Create(filepath.ToSlash(name))
+		if err != nil {
+			return err
+		}
+		if _, err = fd.Write(data); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func writeTar(dir string, files []string, w io.Writer) error {
+	var writer = tar.NewWriter(w)
+	for _, file := range files {
+		var name, err = filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var header = &tar.Header{
+			Name:     filepath.ToSlash(name),
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err = writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = writer.Write(data); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// bundlePath 规范化包内路径, 拒绝绝对路径与 ../ 穿越
+func bundlePath(name string) (string, error) {
+	var clean = path.Clean(strings.TrimPrefix(strings.ReplaceAll(name, "\\", "/"), "./"))
+	if !fs.ValidPath(clean) || clean == "." {
+		return "", fmt.Errorf("invalid path %q in bundle", name)
+	}
+	return clean, nil
+}
+
+// compareVersion 比较 x.y.z 形式的版本号
+func compareVersion(a, b string) int {
+	var (
+		as = strings.Split(strings.TrimPrefix(a, "v"), ".")
+		bs = strings.Split(strings.TrimPrefix(b, "v"), ".")
+	)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if data, ok := m.files[name]; ok {
+		return &memFile{name: path.Base(name), data: bytes.NewReader(data), size: int64(len(data)), fsys: m}, nil
+	}
+	if m.isDir(name) {
+		return &memFile{name: path.Base(name), data: bytes.NewReader(nil), mode: fs.ModeDir | 0755, fsys: m}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	if data, ok := m.files[name]; ok {
+		return append([]byte(nil), data...), nil
+	}
+	return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !m.isDir(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var (
+		prefix  = name + "/"
+		seen    = make(map[string]bool)
+		entries []fs.DirEntry
+	)
+	if name == "." {
+		prefix = ""
+	}
+	for file, data := range m.files {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		var (
+			rest  = strings.TrimPrefix(file, prefix)
+			child = strings.SplitN(rest, "/", 2)[0]
+		)
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		var info = &memFileInfo{name: child, size: int64(len(data)), mtime: m.mtime}
+		if strings.Contains(rest, "/") {
+			info.size, info.mode = 0, fs.ModeDir|0755
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *memFS) isDir(name string) bool {
+	if name == "." {
+		return true
+	}
+	for file := range m.files {
+		if strings.HasPrefix(file, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return &memFileInfo{name: f.name, size: f.size, mode: f.mode, mtime: f.fsys.mtime}, nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	return f.data.Read(p)
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.mtime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
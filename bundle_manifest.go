@@ -0,0 +1,199 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/weblfe/plugin_lua/modules/logger"
+	"strconv"
+	"strings"
+)
+
+type (
+	// BundleManifest bundle 根目录下的 plugin.yaml
+	BundleManifest struct {
+		Name        string
+		Version     string
+		Entrypoint  string
+		Modules     []string
+		HostVersion string
+		// Logger logger 段, 作为插件 logger 模块的默认配置
+		Logger *logger.Options
+		// Extras 其他顶层配置 (含 logger 的原始配置), 值为 string, []string 或 map[string]string
+		Extras map[string]interface{}
+	}
+)
+
+const (
+	BundleManifestFile = "plugin.yaml"
+	DefaultEntrypoint  = "main.lua"
+)
+
+// ParseBundleManifest 解析 plugin.yaml, 支持 yaml 的常用子集:
+// 标量 "key: value", 列表 "key: [a, b]" 或 "- item", 以及一层嵌套的 "key:\n  sub: value"
+func ParseBundleManifest(data []byte) (*BundleManifest, error) {
+	var values, err = parseYamlSubset(data)
+	if err != nil {
+		return nil, err
+	}
+	var manifest = &BundleManifest{Extras: make(map[string]interface{})}
+	for key, value := range values {
+		switch key {
+		case "name":
+			manifest.Name, err = yamlString(key, value)
+		case "version":
+			manifest.Version, err = yamlString(key, value)
+		case "entrypoint":
+			manifest.Entrypoint, err = yamlString(key, value)
+		case "host_version":
+			manifest.HostVersion, err = yamlString(key, value)
+		case "logger":
+			manifest.Extras[key] = value
+			if section, ok := value.(map[string]string); ok {
+				manifest.Logger, err = logger.ParseOptions(section)
+			} else if value != nil {
+				err = fmt.Errorf("plugin.yaml: logger must be a map")
+			}
+			if err != nil {
+				err = fmt.Errorf("plugin.yaml: %w", err)
+			}
+		case "modules":
+			var ok bool
+			if manifest.Modules, ok = value.([]string); !ok {
+				err = fmt.Errorf("plugin.yaml: modules must be a list")
+			}
+		default:
+			manifest.Extras[key] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Name == "" {
+		return nil, fmt.Errorf("plugin.yaml: name is required")
+	}
+	if manifest.Entrypoint == "" {
+		manifest.Entrypoint = DefaultEntrypoint
+	}
+	return manifest, nil
+}
+
+// Section 获取嵌套配置, 如 logger
+func (manifest *BundleManifest) Section(key string) map[string]string {
+	if m, ok := manifest.Extras[key].(map[string]string); ok {
+		return m
+	}
+	return nil
+}
+
+func yamlString(key string, value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("plugin.yaml: %s must be a string", key)
+}
+
+func parseYamlSubset(data []byte) (map[string]interface{}, error) {
+	var (
+		values  = make(map[string]interface{})
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+		current string
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		var raw = stripYamlComment(scanner.Text())
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		var (
+			text     = strings.TrimSpace(raw)
+			indented = raw[0] == ' ' || raw[0] == '\t'
+		)
+		if indented {
+			if current == "" {
+				return nil, fmt.Errorf("plugin.yaml:%d: unexpected indentation", line)
+			}
+			if strings.HasPrefix(text, "- ") || text == "-" {
+				var list, _ = values[current].([]string)
+				if _, ok := values[current].(map[string]string); ok {
+					return nil, fmt.Errorf("plugin.yaml:%d: mixed list and map in %s", line, current)
+				}
+				values[current] = append(list, yamlScalar(strings.TrimPrefix(text, "-")))
+				continue
+			}
+			var k, v, ok = splitYamlPair(text)
+			if !ok {
+				return nil, fmt.Errorf("plugin.yaml:%d: invalid line %q", line, text)
+			}
+			var m, isMap = values[current].(map[string]string)
+			if !isMap {
+				if _, isList := values[current].([]string); isList {
+					return nil, fmt.Errorf("plugin.yaml:%d: mixed list and map in %s", line, current)
+				}
+				m = make(map[string]string)
+				values[current] = m
+			}
+			m[k] = yamlScalar(v)
+			continue
+		}
+		var k, v, ok = splitYamlPair(text)
+		if !ok {
+			return nil, fmt.Errorf("plugin.yaml:%d: invalid line %q", line, text)
+		}
+		current = k
+		switch {
+		case v == "":
+			values[k] = nil
+		case strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]"):
+			var list = []string{}
+			for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"), ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, yamlScalar(item))
+				}
+			}
+			values[k] = list
+		default:
+			values[k] = yamlScalar(v)
+		}
+	}
+	return values, scanner.Err()
+}
+
+func splitYamlPair(text string) (string, string, bool) {
+	var i = strings.Index(text, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+}
+
+func yamlScalar(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		if v[0] == '"' {
+			if s, err := strconv.Unquote(v); err == nil {
+				return s
+			}
+		}
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+func stripYamlComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t\r")
+}
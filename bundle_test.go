@@ -0,0 +1,152 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/weblfe/plugin_lua/modules/logger"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundle(t *testing.T) {
+	var dir = t.TempDir()
+	writeFile(t, filepath.Join(dir, "src", BundleManifestFile), `
+# demo bundle
+name: demo
+version: 1.0.0
+entrypoint: main.lua
+host_version: ">=0.1.0"
+modules: [host]
+logger:
+  level: debug
+`)
+	writeFile(t, filepath.Join(dir, "src", "main.lua"), `
+local util = require("lib.util")
+host.export("double", util.double)
+`)
+	writeFile(t, filepath.Join(dir, "src", "lib", "util.lua"), `return {double = function(n) return n * 2 end}`)
+
+	for _, format := range []string{BundleZip, BundleTar, BundleTarGz} {
+		var (
+			buf  = bytes.NewBuffer(nil)
+			file = filepath.Join(dir, "demo."+format)
+		)
+		if err := PackBundle(filepath.Join(dir, "src"), buf, format); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var bundle, err = OpenBundle(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bundle.Manifest.Name != "demo" || bundle.Manifest.Section("logger")["level"] != "debug" {
+			t.Errorf("%s: unexpected manifest %+v", format, bundle.Manifest)
+		}
+		if opts := bundle.Options(); opts.ModuleOptions[logger.Name] != bundle.Manifest.Logger || bundle.Manifest.Logger.Level != "debug" {
+			t.Errorf("%s: manifest logger options not applied", format)
+		}
+		var host = NewPluginHost()
+		if err = host.Load("demo", file); err != nil {
+			t.Fatal(err)
+		}
+		var results []interface{}
+		if results, err = host.Call(context.Background(), "demo", "double", 21); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0] != float64(42) {
+			t.Errorf("%s: unexpected results %v", format, results)
+		}
+		_ = host.Shutdown(context.Background())
+	}
+
+	var out = filepath.Join(dir, "out")
+	if err := UnpackBundle(filepath.Join(dir, "demo.zip"), out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(out, "lib", "util.lua")); err != nil {
+		t.Error(err)
+	}
+
+	// 不兼容的宿主版本与缺失的模块
+	// print 是全局函数而非已注册的模块
+	for _, manifest := range []string{"name: demo\nhost_version: \">=99.0.0\"\n", "name: demo\nmodules: [missing]\n", "name: demo\nmodules: [print]\n"} {
+		writeFile(t, filepath.Join(dir, "src", BundleManifestFile), manifest)
+		var file = filepath.Join(dir, "bad.zip")
+		var buf = bytes.NewBuffer(nil)
+		if err := PackBundle(filepath.Join(dir, "src"), buf, BundleZip); err != nil {
+			t.Fatal(err)
+		}
+		_ = ioutil.WriteFile(file, buf.Bytes(), 0644)
+		if _, err := LoadBundle(file); !errors.Is(err, ErrBundleIncompatible) {
+			t.Errorf("expect incompatible bundle, got %v", err)
+		}
+	}
+}
+
+func TestBundle_Reload(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		file = filepath.Join(dir, "demo.zip")
+		host = NewPluginHost()
+	)
+	defer func() {
+		_ = host.Shutdown(nil)
+	}()
+	var pack = func(level string) {
+		writeFile(t, filepath.Join(dir, "src", BundleManifestFile), "name: demo\nentrypoint: main.lua\nlogger:\n  level: "+level+"\n")
+		writeFile(t, filepath.Join(dir, "src", "main.lua"), "-- demo")
+		var buf = bytes.NewBuffer(nil)
+		if err := PackBundle(filepath.Join(dir, "src"), buf, BundleZip); err != nil {
+			t.Fatal(err)
+		}
+		_ = ioutil.WriteFile(file, buf.Bytes(), 0644)
+	}
+	var level = func() string {
+		host.safe.RLock()
+		defer host.safe.RUnlock()
+		return host.plugins["demo"].plugin.Runtime().Option(logger.Name).(*logger.Options).Level
+	}
+	pack("debug")
+	if err := host.Load("demo", file, PluginOptions{CallTimeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if got := level(); got != "debug" {
+		t.Fatalf("unexpected level %q", got)
+	}
+	pack("warn")
+	if err := host.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := level(); got != "warn" {
+		t.Errorf("manifest logger change ignored on reload, level %q", got)
+	}
+}
+
+func TestBundle_TooLarge(t *testing.T) {
+	var dir = t.TempDir()
+	writeFile(t, filepath.Join(dir, "src", BundleManifestFile), "name: demo\n")
+	writeFile(t, filepath.Join(dir, "src", "main.lua"), "-- "+strings.Repeat("x", 4096))
+	defer func(size int64) {
+		MaxBundleFileSize = size
+	}(MaxBundleFileSize)
+	MaxBundleFileSize = 1024
+	for _, format := range []string{BundleZip, BundleTarGz} {
+		var (
+			buf  = bytes.NewBuffer(nil)
+			file = filepath.Join(dir, "demo."+format)
+		)
+		if err := PackBundle(filepath.Join(dir, "src"), buf, format); err != nil {
+			t.Fatal(err)
+		}
+		_ = ioutil.WriteFile(file, buf.Bytes(), 0644)
+		if _, err := OpenBundle(file); !errors.Is(err, ErrBundleTooLarge) {
+			t.Errorf("%s: expect ErrBundleTooLarge, got %v", format, err)
+		}
+	}
+}
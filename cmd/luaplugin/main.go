@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	plugins "github.com/weblfe/plugin_lua"
+	"os"
+)
+
+const usage = `usage:
+  luaplugin pack [-format zip|tar|tar.gz] <dir> <bundle>
+  luaplugin unpack <bundle> <dir>
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "pack":
+		err = pack(os.Args[2:])
+	case "unpack":
+		err = unpack(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "luaplugin:", err)
+		os.Exit(1)
+	}
+}
+
+// pack 打包目录, 未指定 -format 时根据输出文件扩展名推断
+func pack(args []string) error {
+	var (
+		flags  = flag.NewFlagSet("pack", flag.ExitOnError)
+		format = flags.String("format", "", "bundle format: zip, tar or tar.gz")
+	)
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("pack requires <dir> <bundle>")
+	}
+	var dir, file = flags.Arg(0), flags.Arg(1)
+	if *format == "" {
+		if *format = plugins.BundleFormat(file); *format == "" {
+			*format = plugins.BundleZip
+		}
+	}
+	var fd, err = os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err = plugins.PackBundle(dir, fd, *format); err != nil {
+		_ = fd.Close()
+		_ = os.Remove(file)
+		return err
+	}
+	return fd.Close()
+}
+
+func unpack(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("unpack requires <bundle> <dir>")
+	}
+	return plugins.UnpackBundle(args[0], args[1])
+}
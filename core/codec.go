@@ -0,0 +1,244 @@
+package core
+
+import (
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"reflect"
+	"sort"
+)
+
+type (
+	// Codec go 与 lua 值之间的转换规则
+	Codec struct {
+		// EmptyArray 空 table 转换为 []interface{} (默认 map[string]interface{})
+		EmptyArray bool
+		// Null lua 侧的 null 哨兵值, 与 go 的 nil 互相转换
+		Null lua.LValue
+		// Kind 非空时决定 table 转换为数组还是对象 (如 json.array/json.object 标记)
+		Kind func(t *lua.LTable) TableKind
+		// Mark 非空时在 slice/map 转换出的 table 上回调, 用于保留数组与对象的区分
+		Mark func(L *lua.LState, t *lua.LTable, kind TableKind)
+	}
+
+	// TableKind table 对应的 go 类型
+	TableKind int
+
+	// CodecError 转换失败的值及其路径
+	CodecError struct {
+		Path   string
+		Reason string
+	}
+)
+
+const (
+	TableAuto TableKind = iota
+	TableArray
+	TableObject
+)
+
+var (
+	DefaultCodec = &Codec{}
+)
+
+// ToGo 使用默认规则将 lua 值复制为 go 值
+func ToGo(v lua.LValue) (interface{}, error) {
+	return DefaultCodec.ToGo(v)
+}
+
+// ToLua 使用默认规则将 go 值复制为 lua 值
+func ToLua(L *lua.LState, v interface{}) lua.LValue {
+	return DefaultCodec.ToLua(L, v)
+}
+
+func (e *CodecError) Error() string {
+	if e.Path == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+}
+
+// ToGo table 为连续整数 key (1..n) 时转换为 []interface{}, 否则为 map[string]interface{}
+// function/thread/channel 不可复制, 环引用返回错误
+func (c *Codec) ToGo(v lua.LValue) (interface{}, error) {
+	return c.toGo("", v, make(map[*lua.LTable]bool))
+}
+
+func (c *Codec) toGo(path string, v lua.LValue, visiting map[*lua.LTable]bool) (interface{}, error) {
+	if c.Null != nil && v == c.Null {
+		return nil, nil
+	}
+	switch value := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(value), nil
+	case lua.LNumber:
+		return float64(value), nil
+	case lua.LString:
+		return string(value), nil
+	case *lua.LUserData:
+		return value.Value, nil
+	case *lua.LTable:
+		if visiting[value] {
+			return nil, &CodecError{Path: path, Reason: "cycle detected"}
+		}
+		visiting[value] = true
+		defer delete(visiting, value)
+		return c.tableToGo(path, value, visiting)
+	}
+	return nil, &CodecError{Path: path, Reason: fmt.Sprintf("unsupported type %s", v.Type().String())}
+}
+
+func (c *Codec) tableToGo(path string, t *lua.LTable, visiting map[*lua.LTable]bool) (interface{}, error) {
+	var (
+		size = IsArray(t)
+		kind = TableAuto
+	)
+	if c.Kind != nil {
+		kind = c.Kind(t)
+	}
+	if kind == TableArray && size < 0 {
+		return nil, &CodecError{Path: path, Reason: "table marked as array has non-sequence keys"}
+	}
+	if kind == TableArray || (kind == TableAuto && (size > 0 || (size == 0 && c.EmptyArray))) {
+		var arr = make([]interface{}, 0, size)
+		for i := 1; i <= size; i++ {
+			var item, err = c.toGo(JoinPath(path, lua.LNumber(i)), t.RawGetInt(i), visiting)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, nil
+	}
+	var (
+		err error
+		m   = make(map[string]interface{})
+	)
+	for _, key := range SortedKeys(t) {
+		var child = JoinPath(path, key)
+		switch key.Type() {
+		case lua.LTString, lua.LTNumber:
+		default:
+			return nil, &CodecError{Path: child, Reason: fmt.Sprintf("unsupported key type %s", key.Type().String())}
+		}
+		if m[key.String()], err = c.toGo(child, t.RawGet(key), visiting); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ToLua 基础类型, slice, 字符串 key 的 map 转换为对应 lua 值, 其他值包装为 userdata
+func (c *Codec) ToLua(L *lua.LState, v interface{}) lua.LValue {
+	switch value := v.(type) {
+	case nil:
+		if c.Null != nil {
+			return c.Null
+		}
+		return lua.LNil
+	case lua.LValue:
+		return value
+	case bool:
+		return lua.LBool(value)
+	case string:
+		return lua.LString(value)
+	case []byte:
+		return lua.LString(value)
+	case float64:
+		return lua.LNumber(value)
+	case int:
+		return lua.LNumber(value)
+	case int64:
+		return lua.LNumber(value)
+	case []interface{}:
+		var t = L.CreateTable(len(value), 0)
+		for _, item := range value {
+			t.Append(c.ToLua(L, item))
+		}
+		return c.mark(L, t, TableArray)
+	case map[string]interface{}:
+		var t = L.CreateTable(0, len(value))
+		for k, item := range value {
+			t.RawSetString(k, c.ToLua(L, item))
+		}
+		return c.mark(L, t, TableObject)
+	case fmt.Stringer:
+		return lua.LString(value.String())
+	}
+	return c.reflectToLua(L, reflect.ValueOf(v))
+}
+
+func (c *Codec) reflectToLua(L *lua.LState, rv reflect.Value) lua.LValue {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return lua.LNumber(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float())
+	case reflect.String:
+		return lua.LString(rv.String())
+	case reflect.Bool:
+		return lua.LBool(rv.Bool())
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return c.ToLua(L, nil)
+		}
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return c.ToLua(L, nil)
+		}
+		var t = L.CreateTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			t.Append(c.ToLua(L, rv.Index(i).Interface()))
+		}
+		return c.mark(L, t, TableArray)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		var (
+			t    = L.CreateTable(0, rv.Len())
+			keys = rv.MapKeys()
+		)
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, k := range keys {
+			t.RawSetString(k.String(), c.ToLua(L, rv.MapIndex(k).Interface()))
+		}
+		return c.mark(L, t, TableObject)
+	}
+	return &lua.LUserData{Value: rv.Interface(), Env: L.Env}
+}
+
+func (c *Codec) mark(L *lua.LState, t *lua.LTable, kind TableKind) *lua.LTable {
+	if c.Mark != nil {
+		c.Mark(L, t, kind)
+	}
+	return t
+}
+
+// IsArray table 为连续整数 key (1..n) 时返回 n, 空 table 返回 0, 否则返回 -1
+func IsArray(t *lua.LTable) int {
+	var (
+		count = 0
+		max   = 0
+		mixed = false
+	)
+	t.ForEach(func(key lua.LValue, _ lua.LValue) {
+		count++
+		if n, ok := key.(lua.LNumber); ok && float64(n) == float64(int(n)) && n >= 1 {
+			if int(n) > max {
+				max = int(n)
+			}
+			return
+		}
+		mixed = true
+	})
+	if mixed || max != count {
+		return -1
+	}
+	return count
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// OpenDeterministic 以运行时的时钟与随机数替换 os.time/os.clock/os.date/math.random/math.randomseed,
+// 并使 pairs 按 SortedKeys 顺序遍历
+func OpenDeterministic(L *lua.LState) {
+	var rt = GetRuntime(L)
+	rt.Deterministic = true
+	if os, ok := L.GetGlobal(lua.OsLibName).(*lua.LTable); ok {
+		var date = os.RawGetString("date")
+		os.RawSetString("time", L.NewFunction(osTime(rt, os.RawGetString("time"))))
+		os.RawSetString("clock", L.NewFunction(osClock(rt)))
+		if fn, ok := date.(*lua.LFunction); ok {
+			os.RawSetString("date", L.NewFunction(osDate(rt, fn)))
+		}
+	}
+	if math, ok := L.GetGlobal(lua.MathLibName).(*lua.LTable); ok {
+		math.RawSetString("random", L.NewFunction(mathRandom(rt)))
+		math.RawSetString("randomseed", L.NewFunction(mathRandomSeed(rt)))
+	}
+	L.SetGlobal("pairs", L.NewFunction(sortedPairs))
+}
+
+func osTime(rt *Runtime, original lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if L.GetTop() > 0 {
+			if fn, ok := original.(*lua.LFunction); ok {
+				L.Push(fn)
+				L.Push(L.Get(1))
+				L.Call(1, 1)
+				return 1
+			}
+		}
+		L.Push(lua.LNumber(rt.Now().Unix()))
+		return 1
+	}
+}
+
+func osClock(rt *Runtime) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Push(lua.LNumber(rt.Elapsed().Seconds()))
+		return 1
+	}
+}
+
+// os.date([format [, time]]) 未指定 time 时使用运行时时钟
+func osDate(rt *Runtime, original *lua.LFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		var format lua.LValue = lua.LString("%c")
+		if L.GetTop() >= 1 {
+			format = L.Get(1)
+		}
+		var now lua.LValue = lua.LNumber(rt.Now().Unix())
+		if L.GetTop() >= 2 {
+			now = L.Get(2)
+		}
+		L.Push(original)
+		L.Push(format)
+		L.Push(now)
+		L.Call(2, 1)
+		return 1
+	}
+}
+
+func mathRandom(rt *Runtime) lua.LGFunction {
+	return func(L *lua.LState) int {
+		switch L.GetTop() {
+		case 0:
+			L.Push(lua.LNumber(rt.Rand.Float64()))
+		case 1:
+			var n = L.CheckInt(1)
+			if n < 1 {
+				L.ArgError(1, "interval is empty")
+			}
+			L.Push(lua.LNumber(rt.Rand.Intn(n) + 1))
+		default:
+			var min, max = L.CheckInt(1), L.CheckInt(2)
+			if max < min {
+				L.ArgError(2, "interval is empty")
+			}
+			L.Push(lua.LNumber(rt.Rand.Intn(max-min+1) + min))
+		}
+		return 1
+	}
+}
+
+func mathRandomSeed(rt *Runtime) lua.LGFunction {
+	return func(L *lua.LState) int {
+		rt.Seed(L.CheckInt64(1))
+		return 0
+	}
+}
+
+// pairs 的确定性实现, 遍历开始时固定 key 顺序
+func sortedPairs(L *lua.LState) int {
+	var (
+		t     = L.CheckTable(1)
+		keys  = SortedKeys(t)
+		index = 0
+	)
+	var next = func(L *lua.LState) int {
+		for index < len(keys) {
+			var key = keys[index]
+			index++
+			if v := t.RawGet(key); v != lua.LNil {
+				L.Push(key)
+				L.Push(v)
+				return 2
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(L.NewFunction(next))
+	L.Push(t)
+	L.Push(lua.LNil)
+	return 3
+}
@@ -0,0 +1,387 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+type (
+	// ValueEncoder lua 值二进制编码器 (table,string,number,bool)
+	ValueEncoder struct {
+		buf     *bytes.Buffer
+		tables  map[*lua.LTable]uint64
+		invalid []string
+	}
+
+	// ValueDecoder lua 值二进制解码器
+	ValueDecoder struct {
+		reader *bufio.Reader
+		tables map[uint64]*lua.LTable
+		header bool
+	}
+
+	// UnsupportedValueError 不可序列化的值 (function,userdata,thread,channel)
+	UnsupportedValueError struct {
+		Paths []string
+	}
+)
+
+const (
+	ValueMagic   = "LPSN"
+	ValueVersion = byte(1)
+)
+
+const (
+	tagNil byte = iota
+	tagFalse
+	tagTrue
+	tagNumber
+	tagString
+	tagTable
+	tagRef
+	tagEnd = byte(0xff)
+)
+
+var (
+	ErrValueMagic    = errors.New("invalid value stream: bad magic")
+	ErrValueVersion  = errors.New("invalid value stream: unsupported version")
+	ErrValueTooLarge = errors.New("invalid value stream: string too large")
+
+	// MaxValueStringSize 解码时单个字符串的最大字节数, 防止损坏或恶意的快照申请过大的内存
+	MaxValueStringSize uint64 = 64 << 20
+)
+
+func NewValueEncoder() *ValueEncoder {
+	var enc = new(ValueEncoder)
+	return enc.init()
+}
+
+func NewValueDecoder(r io.Reader) *ValueDecoder {
+	var dec = new(ValueDecoder)
+	dec.reader = bufio.NewReader(r)
+	dec.tables = make(map[uint64]*lua.LTable)
+	return dec
+}
+
+// MarshalValue 编码单个 lua 值
+func MarshalValue(v lua.LValue) ([]byte, error) {
+	var enc = NewValueEncoder().Encode(v)
+	if err := enc.Err(); err != nil {
+		return nil, err
+	}
+	return enc.Bytes(), nil
+}
+
+// UnmarshalValue 在 L 中还原单个 lua 值
+func UnmarshalValue(L *lua.LState, data []byte) (lua.LValue, error) {
+	return NewValueDecoder(bytes.NewReader(data)).Decode(L)
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return fmt.Sprintf("unsupported value at: %s", strings.Join(e.Paths, ", "))
+}
+
+func (enc *ValueEncoder) init() *ValueEncoder {
+	enc.buf = bytes.NewBufferString(ValueMagic)
+	enc.buf.WriteByte(ValueVersion)
+	enc.tables = make(map[*lua.LTable]uint64)
+	return enc
+}
+
+// Encode 写入一个值, 共享引用与环引用以 table id 表示
+func (enc *ValueEncoder) Encode(v lua.LValue) *ValueEncoder {
+	enc.encode("", v)
+	return enc
+}
+
+func (enc *ValueEncoder) Err() error {
+	if len(enc.invalid) <= 0 {
+		return nil
+	}
+	return &UnsupportedValueError{Paths: enc.invalid}
+}
+
+func (enc *ValueEncoder) Bytes() []byte {
+	return enc.buf.Bytes()
+}
+
+func (enc *ValueEncoder) WriteTo(w io.Writer) (int64, error) {
+	if err := enc.Err(); err != nil {
+		return 0, err
+	}
+	var n, err = w.Write(enc.buf.Bytes())
+	return int64(n), err
+}
+
+func (enc *ValueEncoder) encode(path string, v lua.LValue) {
+	switch v.Type() {
+	case lua.LTNil:
+		enc.buf.WriteByte(tagNil)
+	case lua.LTBool:
+		if lua.LVAsBool(v) {
+			enc.buf.WriteByte(tagTrue)
+		} else {
+			enc.buf.WriteByte(tagFalse)
+		}
+	case lua.LTNumber:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(float64(v.(lua.LNumber))))
+		enc.buf.WriteByte(tagNumber)
+		enc.buf.Write(b[:])
+	case lua.LTString:
+		enc.buf.WriteByte(tagString)
+		enc.writeString(string(v.(lua.LString)))
+	case lua.LTTable:
+		enc.encodeTable(path, v.(*lua.LTable))
+	default:
+		enc.invalid = append(enc.invalid, enc.describe(path, v))
+		enc.buf.WriteByte(tagNil)
+	}
+}
+
+func (enc *ValueEncoder) encodeTable(path string, t *lua.LTable) {
+	if id, ok := enc.tables[t]; ok {
+		enc.buf.WriteByte(tagRef)
+		enc.writeUint(id)
+		return
+	}
+	var id = uint64(len(enc.tables) + 1)
+	enc.tables[t] = id
+	enc.buf.WriteByte(tagTable)
+	enc.writeUint(id)
+	// 按 key 排序, 保证相同状态产出相同字节
+	for _, key := range SortedKeys(t) {
+		var (
+			value = t.RawGet(key)
+			child = JoinPath(path, key)
+		)
+		if !IsSerializable(key) {
+			enc.invalid = append(enc.invalid, enc.describe(child, key)+" (key)")
+			continue
+		}
+		enc.encode(child, key)
+		enc.encode(child, value)
+	}
+	enc.buf.WriteByte(tagEnd)
+}
+
+func (enc *ValueEncoder) describe(path string, v lua.LValue) string {
+	if path == "" {
+		path = "<root>"
+	}
+	return fmt.Sprintf("%s <%s>", path, v.Type().String())
+}
+
+func (enc *ValueEncoder) writeUint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	enc.buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (enc *ValueEncoder) writeString(s string) {
+	enc.writeUint(uint64(len(s)))
+	enc.buf.WriteString(s)
+}
+
+// Decode 读取下一个值, 首次调用时校验 magic 与版本
+func (dec *ValueDecoder) Decode(L *lua.LState) (lua.LValue, error) {
+	if !dec.header {
+		if err := dec.readHeader(); err != nil {
+			return lua.LNil, err
+		}
+		dec.header = true
+	}
+	tag, err := dec.reader.ReadByte()
+	if err != nil {
+		return lua.LNil, err
+	}
+	return dec.decode(L, tag)
+}
+
+func (dec *ValueDecoder) readHeader() error {
+	var head = make([]byte, len(ValueMagic)+1)
+	if _, err := io.ReadFull(dec.reader, head); err != nil {
+		return err
+	}
+	if string(head[:len(ValueMagic)]) != ValueMagic {
+		return ErrValueMagic
+	}
+	if head[len(ValueMagic)] != ValueVersion {
+		return ErrValueVersion
+	}
+	return nil
+}
+
+func (dec *ValueDecoder) decode(L *lua.LState, tag byte) (lua.LValue, error) {
+	switch tag {
+	case tagNil:
+		return lua.LNil, nil
+	case tagFalse:
+		return lua.LFalse, nil
+	case tagTrue:
+		return lua.LTrue, nil
+	case tagNumber:
+		var b [8]byte
+		if _, err := io.ReadFull(dec.reader, b[:]); err != nil {
+			return lua.LNil, err
+		}
+		return lua.LNumber(math.Float64frombits(binary.BigEndian.Uint64(b[:]))), nil
+	case tagString:
+		var s, err = dec.readString()
+		if err != nil {
+			return lua.LNil, err
+		}
+		return lua.LString(s), nil
+	case tagRef:
+		var id, err = binary.ReadUvarint(dec.reader)
+		if err != nil {
+			return lua.LNil, err
+		}
+		if t, ok := dec.tables[id]; ok {
+			return t, nil
+		}
+		return lua.LNil, fmt.Errorf("invalid value stream: unknown table ref %d", id)
+	case tagTable:
+		return dec.decodeTable(L)
+	}
+	return lua.LNil, fmt.Errorf("invalid value stream: unknown tag %d", tag)
+}
+
+func (dec *ValueDecoder) decodeTable(L *lua.LState) (lua.LValue, error) {
+	var id, err = binary.ReadUvarint(dec.reader)
+	if err != nil {
+		return lua.LNil, err
+	}
+	var t = L.NewTable()
+	dec.tables[id] = t
+	for {
+		tag, err := dec.reader.ReadByte()
+		if err != nil {
+			return lua.LNil, err
+		}
+		if tag == tagEnd {
+			return t, nil
+		}
+		key, err := dec.decode(L, tag)
+		if err != nil {
+			return lua.LNil, err
+		}
+		if tag, err = dec.reader.ReadByte(); err != nil {
+			return lua.LNil, err
+		}
+		value, err := dec.decode(L, tag)
+		if err != nil {
+			return lua.LNil, err
+		}
+		if key != lua.LNil {
+			t.RawSet(key, value)
+		}
+	}
+}
+
+func (dec *ValueDecoder) readString() (string, error) {
+	var size, err = binary.ReadUvarint(dec.reader)
+	if err != nil {
+		return "", err
+	}
+	if size > MaxValueStringSize {
+		return "", fmt.Errorf("%w: %d bytes", ErrValueTooLarge, size)
+	}
+	// 按实际读取的数据增长, 声明的长度大于剩余数据时不会预先分配
+	var b strings.Builder
+	if _, err = io.CopyN(&b, dec.reader, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// IsSerializable 是否可被 ValueEncoder 编码
+func IsSerializable(v lua.LValue) bool {
+	switch v.Type() {
+	case lua.LTNil, lua.LTBool, lua.LTNumber, lua.LTString, lua.LTTable:
+		return true
+	}
+	return false
+}
+
+// JoinPath 生成 a.b[1] 形式的路径
+func JoinPath(path string, key lua.LValue) string {
+	switch k := key.(type) {
+	case lua.LString:
+		if isIdentifier(string(k)) {
+			if path == "" {
+				return string(k)
+			}
+			return path + "." + string(k)
+		}
+		return fmt.Sprintf("%s[%q]", path, string(k))
+	case lua.LNumber:
+		return fmt.Sprintf("%s[%s]", path, k.String())
+	}
+	return fmt.Sprintf("%s[<%s>]", path, key.Type().String())
+}
+
+// SortedKeys 稳定的 key 顺序: number < string < bool < 其他
+func SortedKeys(t *lua.LTable) []lua.LValue {
+	var keys []lua.LValue
+	t.ForEach(func(key lua.LValue, _ lua.LValue) {
+		keys = append(keys, key)
+	})
+	sort.SliceStable(keys, func(i, j int) bool {
+		return lessValue(keys[i], keys[j])
+	})
+	return keys
+}
+
+func lessValue(a, b lua.LValue) bool {
+	var ra, rb = typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	switch x := a.(type) {
+	case lua.LNumber:
+		return x < b.(lua.LNumber)
+	case lua.LString:
+		return x < b.(lua.LString)
+	case lua.LBool:
+		return !bool(x) && bool(b.(lua.LBool))
+	}
+	return a.String() < b.String()
+}
+
+func typeRank(v lua.LValue) int {
+	switch v.Type() {
+	case lua.LTNumber:
+		return 0
+	case lua.LTString:
+		return 1
+	case lua.LTBool:
+		return 2
+	}
+	return 3
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"context"
+	lua "github.com/yuin/gopher-lua"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type (
+	// Clock 可注入的时钟
+	Clock interface {
+		Now() time.Time
+	}
+
+	// ManualClock 手动推进的时钟, 用于测试与确定性执行
+	ManualClock struct {
+		safe sync.RWMutex
+		now  time.Time
+	}
+
+	systemClock struct{}
+
+	// Runtime 绑定在 lua.LState 上的插件运行时信息, 供各模块读取
+	Runtime struct {
+		Name          string
+		Deterministic bool
+		Clock         Clock
+		Rand          *rand.Rand
+		// Options 各模块的插件级配置, key 为模块名
+		Options map[string]interface{}
+		// Logger 宿主注入的日志输出 (*logrus.Logger, logger.Handler 或 logger.Sink), 由 logger 模块解析
+		Logger interface{}
+		// CallTimeout 宿主在该 vm 上发起的回调 (如定时器) 的超时, 0 使用各模块的默认值
+		CallTimeout time.Duration
+		// Prepare 为该插件派生的 vm (如 task) 安装与插件相同的配置, 如脚本加载器与签名校验
+		Prepare   func(L *lua.LState)
+		startedAt time.Time
+		owner     chan struct{}
+		safe      sync.Mutex
+		closed    bool
+		closers   []func()
+	}
+)
+
+const (
+	runtimeKey = "__plugin_runtime"
+)
+
+var (
+	SystemClock Clock = systemClock{}
+)
+
+func NewRuntime() *Runtime {
+	var rt = new(Runtime)
+	return rt.init()
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (rt *Runtime) init() *Runtime {
+	if rt.Clock == nil {
+		rt.Clock = SystemClock
+	}
+	if rt.Rand == nil {
+		rt.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	rt.startedAt = rt.Clock.Now()
+	rt.owner = make(chan struct{}, 1)
+	return rt
+}
+
+// Acquire 获取 vm 的执行权, lua.LState 不可并发执行
+func (rt *Runtime) Acquire(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case rt.owner <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryAcquire 不等待地获取 vm 的执行权, vm 忙碌时返回 false
+func (rt *Runtime) TryAcquire() bool {
+	select {
+	case rt.owner <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rt *Runtime) Release() {
+	select {
+	case <-rt.owner:
+	default:
+	}
+}
+
+// SetClock 替换时钟, 同时重置 os.clock 的起点
+func (rt *Runtime) SetClock(clock Clock) *Runtime {
+	if clock == nil {
+		return rt
+	}
+	rt.Clock = clock
+	rt.startedAt = clock.Now()
+	return rt
+}
+
+// Seed 重置随机数种子
+func (rt *Runtime) Seed(seed int64) *Runtime {
+	rt.Rand = rand.New(rand.NewSource(seed))
+	return rt
+}
+
+// OnClose 注册插件关闭时的回调 (如停止定时器), 已关闭时立即执行
+func (rt *Runtime) OnClose(fn func()) {
+	rt.safe.Lock()
+	if !rt.closed {
+		rt.closers = append(rt.closers, fn)
+		rt.safe.Unlock()
+		return
+	}
+	rt.safe.Unlock()
+	fn()
+}
+
+// Close 标记关闭并按注册的逆序执行回调, 重复调用无效
+func (rt *Runtime) Close() {
+	rt.safe.Lock()
+	if rt.closed {
+		rt.safe.Unlock()
+		return
+	}
+	rt.closed = true
+	var closers = rt.closers
+	rt.closers = nil
+	rt.safe.Unlock()
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
+	}
+}
+
+func (rt *Runtime) Closed() bool {
+	rt.safe.Lock()
+	defer rt.safe.Unlock()
+	return rt.closed
+}
+
+// Option 获取模块 name 的插件级配置
+func (rt *Runtime) Option(name string) interface{} {
+	if rt.Options == nil {
+		return nil
+	}
+	return rt.Options[name]
+}
+
+func (rt *Runtime) Now() time.Time {
+	return rt.Clock.Now()
+}
+
+// Elapsed 运行时启动后经过的时间 (os.clock)
+func (rt *Runtime) Elapsed() time.Duration {
+	return rt.Clock.Now().Sub(rt.startedAt)
+}
+
+// SetRuntime 将运行时绑定到 L (保存在 registry 中, 协程共享)
+func SetRuntime(L *lua.LState, rt *Runtime) {
+	if L == nil || rt == nil {
+		return
+	}
+	L.G.Registry.RawSetString(runtimeKey, &lua.LUserData{Value: rt})
+}
+
+// GetRuntime 获取 L 绑定的运行时, 未绑定时返回默认运行时并绑定
+func GetRuntime(L *lua.LState) *Runtime {
+	if L == nil {
+		return NewRuntime()
+	}
+	if u, ok := L.G.Registry.RawGetString(runtimeKey).(*lua.LUserData); ok {
+		if rt, ok := u.Value.(*Runtime); ok {
+			return rt
+		}
+	}
+	var rt = NewRuntime()
+	SetRuntime(L, rt)
+	return rt
+}
+
+// ForEach 遍历 table, 确定性模式下按 SortedKeys 顺序遍历
+func ForEach(L *lua.LState, t *lua.LTable, cb func(lua.LValue, lua.LValue)) {
+	if t == nil {
+		return
+	}
+	if !GetRuntime(L).Deterministic {
+		t.ForEach(cb)
+		return
+	}
+	for _, key := range SortedKeys(t) {
+		cb(key, t.RawGet(key))
+	}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.safe.RLock()
+	defer c.safe.RUnlock()
+	return c.now
+}
+
+func (c *ManualClock) Set(now time.Time) *ManualClock {
+	c.safe.Lock()
+	defer c.safe.Unlock()
+	c.now = now
+	return c
+}
+
+func (c *ManualClock) Add(d time.Duration) *ManualClock {
+	c.safe.Lock()
+	defer c.safe.Unlock()
+	c.now = c.now.Add(d)
+	return c
+}
@@ -0,0 +1,41 @@
+package plugins
+
+import (
+	"github.com/weblfe/plugin_lua/core"
+	"testing"
+	"time"
+)
+
+func TestPluginOptions_Deterministic(t *testing.T) {
+	var (
+		clock = core.NewManualClock(time.Unix(1600000000, 0))
+		code  = `
+			local keys = {}
+			for k in pairs({b = 1, a = 2, [3] = 3, c = 4, [1] = 5}) do
+				keys[#keys + 1] = tostring(k)
+			end
+			result = table.concat(keys, ",") .. "|" .. os.time() .. "|" .. math.random(1, 1000000)
+		`
+		results []string
+	)
+	for i := 0; i < 2; i++ {
+		var plugin = NewLua(PluginOptions{Deterministic: true, Clock: clock, Seed: 42})
+		if err := plugin.EvalExpr(code); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, plugin.GetLState().GetGlobal("result").String())
+	}
+	if results[0] != results[1] {
+		t.Errorf("results differ: %v", results)
+	}
+	var expect = "1,3,a,b,c|1600000000|"
+	if len(results[0]) <= len(expect) || results[0][:len(expect)] != expect {
+		t.Errorf("unexpected result: %s", results[0])
+	}
+	clock.Add(1500 * time.Millisecond)
+	var plugin = NewLua(PluginOptions{Deterministic: true, Clock: clock})
+	clock.Add(2 * time.Second)
+	if err := plugin.EvalExpr(`assert(os.clock() == 2, "clock")`); err != nil {
+		t.Error(err)
+	}
+}
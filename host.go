@@ -0,0 +1,595 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/metrics"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// PluginHost 管理多个具名插件, 插件之间通过 export/call 相互调用 (不共享 vm)
+	PluginHost struct {
+		safe    sync.RWMutex
+		timeout time.Duration
+		closed  bool
+		plugins map[string]*hostedPlugin
+		metrics *pluginMetrics
+	}
+
+	hostedPlugin struct {
+		calls    uint64
+		errors   uint64
+		reloads  uint64
+		name     string
+		file     string
+		options  *PluginOptions
+		plugin   *luaPluginImpl
+		exports  map[string]*lua.LFunction
+		inflight sync.WaitGroup
+		lastErr  atomic.Value
+	}
+
+	// PluginStatus 插件运行状态
+	PluginStatus struct {
+		Name      string
+		File      string
+		BootAt    time.Time
+		LastError string
+		Calls     uint64
+		Errors    uint64
+		Reloads   uint64
+	}
+
+	// HostManifest 插件清单 (json)
+	HostManifest struct {
+		Plugins []ManifestEntry `json:"plugins"`
+	}
+
+	// ManifestEntry 清单中的单个插件, file 为相对清单所在目录的路径
+	ManifestEntry struct {
+		Name            string `json:"name"`
+		File            string `json:"file"`
+		Deterministic   bool   `json:"deterministic"`
+		Seed            int64  `json:"seed"`
+		CallTimeout     string `json:"call_timeout"`
+		CallStackSize   int    `json:"call_stack_size"`
+		RegistrySize    int    `json:"registry_size"`
+		RegistryMaxSize int    `json:"registry_max_size"`
+	}
+
+	// CallError 跨插件调用失败
+	CallError struct {
+		Plugin string
+		Method string
+		Err    error
+	}
+
+	callChainKey struct{}
+)
+
+const (
+	HostModuleName     = "host"
+	HostEntryFile      = "main.lua"
+	DefaultCallTimeout = 30 * time.Second
+)
+
+var (
+	ErrPluginNotFound = errors.New("plugin not found")
+	ErrMethodNotFound = errors.New("method not exported")
+	ErrCallCycle      = errors.New("call cycle detected")
+	ErrHostClosed     = errors.New("plugin host closed")
+)
+
+func NewPluginHost() *PluginHost {
+	var host = new(PluginHost)
+	return host.init()
+}
+
+func (host *PluginHost) init() *PluginHost {
+	host.safe = sync.RWMutex{}
+	host.timeout = DefaultCallTimeout
+	host.plugins = make(map[string]*hostedPlugin)
+	host.metrics = newPluginMetrics(nil)
+	return host
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("call %s.%s: %s", e.Plugin, e.Method, e.Err.Error())
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// SetTimeout 设置默认调用超时, <= 0 不限制
+func (host *PluginHost) SetTimeout(timeout time.Duration) *PluginHost {
+	host.timeout = timeout
+	return host
+}
+
+// SetMetrics 设置内置指标 (调用次数, 错误次数, 延迟, 重载次数) 的注册表, 默认为 metrics.DefaultRegistry
+func (host *PluginHost) SetMetrics(reg *metrics.Registry) *PluginHost {
+	host.metrics = newPluginMetrics(reg)
+	return host
+}
+
+// Register 以 name 注册插件, 并向插件注入 host 模块
+func (host *PluginHost) Register(name string, plugin *luaPluginImpl) error {
+	if name == "" || plugin == nil || plugin.GetVM() == nil {
+		return errors.New("invalid plugin")
+	}
+	host.safe.Lock()
+	defer host.safe.Unlock()
+	if host.closed {
+		return ErrHostClosed
+	}
+	if _, ok := host.plugins[name]; ok {
+		return fmt.Errorf("plugin %s already registered", name)
+	}
+	host.plugins[name] = host.attach(name, "", plugin, plugin.options)
+	return nil
+}
+
+// Load 创建插件并执行入口脚本 file, options 为该插件独立的配置与限制
+func (host *PluginHost) Load(name, file string, options ...PluginOptions) error {
+	if name == "" || file == "" {
+		return errors.New("invalid plugin")
+	}
+	if _, ok := host.Get(name); ok {
+		return fmt.Errorf("plugin %s already registered", name)
+	}
+	var entry, err = host.create(name, file, options...)
+	if err != nil {
+		return err
+	}
+	host.safe.Lock()
+	defer host.safe.Unlock()
+	if host.closed {
+		entry.plugin.Close()
+		return ErrHostClosed
+	}
+	if _, ok := host.plugins[name]; ok {
+		entry.plugin.Close()
+		return fmt.Errorf("plugin %s already registered", name)
+	}
+	host.plugins[name] = entry
+	return nil
+}
+
+// LoadDir 加载目录: 每个 *.lua 文件, 以及包含 main.lua 的子目录各为一个插件
+func (host *PluginHost) LoadDir(dir string, options ...PluginOptions) error {
+	var items, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, item := range items {
+		var (
+			name = item.Name()
+			file = filepath.Join(dir, name)
+		)
+		if item.IsDir() {
+			file = filepath.Join(file, HostEntryFile)
+			if _, err = os.Stat(file); err != nil {
+				continue
+			}
+		} else if strings.HasSuffix(name, ".lua") {
+			name = strings.TrimSuffix(name, ".lua")
+		} else {
+			continue
+		}
+		if err = host.Load(name, file, options...); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// LoadManifest 按 json 清单加载插件
+func (host *PluginHost) LoadManifest(file string) error {
+	var data, err = ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var manifest HostManifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("manifest %s: %w", file, err)
+	}
+	var errs []string
+	for _, entry := range manifest.Plugins {
+		var opts, err = entry.Options()
+		if err == nil {
+			var script = entry.File
+			if !filepath.IsAbs(script) {
+				script = filepath.Join(filepath.Dir(file), script)
+			}
+			err = host.Load(entry.Name, script, *opts)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Get 获取已注册的插件
+func (host *PluginHost) Get(name string) (*luaPluginImpl, bool) {
+	host.safe.RLock()
+	defer host.safe.RUnlock()
+	if entry, ok := host.plugins[name]; ok {
+		return entry.plugin, true
+	}
+	return nil, false
+}
+
+// Unload 移除插件, 等待进行中的调用结束后关闭
+func (host *PluginHost) Unload(name string) error {
+	host.safe.Lock()
+	var entry, ok = host.plugins[name]
+	delete(host.plugins, name)
+	host.safe.Unlock()
+	if !ok {
+		return ErrPluginNotFound
+	}
+	entry.inflight.Wait()
+	entry.plugin.Close()
+	return nil
+}
+
+// ReloadAll 重新加载所有基于脚本文件的插件, 加载失败的插件保留旧实例; 调用, 错误与重载次数延续到新实例
+func (host *PluginHost) ReloadAll() error {
+	var errs []string
+	for _, entry := range host.entries() {
+		if entry.file == "" {
+			continue
+		}
+		var options []PluginOptions
+		if entry.options != nil {
+			options = append(options, *entry.options)
+		}
+		var fresh, err = host.create(entry.name, entry.file, options...)
+		if err != nil {
+			entry.fail(err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		fresh.reloads = atomic.LoadUint64(&entry.reloads) + 1
+		host.safe.Lock()
+		var swapped = !host.closed && host.plugins[entry.name] == entry
+		if swapped {
+			host.plugins[entry.name] = fresh
+		}
+		host.safe.Unlock()
+		// 加载期间插件已被卸载, 关闭或重载, 旧实例由对方关闭
+		if !swapped {
+			fresh.plugin.Close()
+			continue
+		}
+		host.metrics.reload(entry.name)
+		entry.inflight.Wait()
+		// 旧实例的调用均已结束, 其计数不再变化
+		atomic.AddUint64(&fresh.calls, atomic.LoadUint64(&entry.calls))
+		atomic.AddUint64(&fresh.errors, atomic.LoadUint64(&entry.errors))
+		entry.plugin.Close()
+	}
+	return joinErrors(errs)
+}
+
+// Shutdown 拒绝新的调用, 等待进行中的调用结束 (或 ctx 结束) 后关闭全部插件, ctx 为 nil 时一直等待
+func (host *PluginHost) Shutdown(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	host.safe.Lock()
+	host.closed = true
+	var entries = host.plugins
+	host.plugins = make(map[string]*hostedPlugin)
+	host.safe.Unlock()
+
+	var done = make(chan struct{})
+	go func() {
+		for _, entry := range entries {
+			entry.inflight.Wait()
+		}
+		close(done)
+	}()
+	var closeAll = func() {
+		for _, entry := range entries {
+			entry.plugin.Close()
+		}
+	}
+	select {
+	case <-done:
+		closeAll()
+		return nil
+	case <-ctx.Done():
+		// 超时后不再等待, 调用结束后在后台关闭
+		go func() {
+			<-done
+			closeAll()
+		}()
+		return ctx.Err()
+	}
+}
+
+// Status 获取插件状态
+func (host *PluginHost) Status(name string) (PluginStatus, bool) {
+	host.safe.RLock()
+	var entry, ok = host.plugins[name]
+	host.safe.RUnlock()
+	if !ok {
+		return PluginStatus{}, false
+	}
+	return entry.status(), true
+}
+
+// Statuses 全部插件状态, 按名称排序
+func (host *PluginHost) Statuses() []PluginStatus {
+	var list []PluginStatus
+	for _, entry := range host.entries() {
+		list = append(list, entry.status())
+	}
+	return list
+}
+
+// Call 调用插件 name 导出的 method, 参数与返回值经 core.Codec 复制
+func (host *PluginHost) Call(ctx context.Context, name, method string, args ...interface{}) ([]interface{}, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var chain = callChain(ctx)
+	for _, caller := range chain {
+		if caller == name {
+			return nil, &CallError{Plugin: name, Method: method, Err: fmt.Errorf("%w: %s", ErrCallCycle, strings.Join(append(chain, name), " -> "))}
+		}
+	}
+	var entry, fn, err = host.lookup(name, method)
+	if err != nil {
+		return nil, &CallError{Plugin: name, Method: method, Err: err}
+	}
+	defer entry.inflight.Done()
+	atomic.AddUint64(&entry.calls, 1)
+	// 目标插件的超时与调用方的 deadline 取较早者, 嵌套调用不继承调用方较长的超时
+	if timeout := entry.timeout(host.timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx = context.WithValue(ctx, callChainKey{}, append(chain, name))
+	var start = time.Now()
+	results, err := entry.plugin.call(ctx, method, fn, args...)
+	host.metrics.observe(name, start, err)
+	if err != nil {
+		entry.fail(err)
+		return nil, &CallError{Plugin: name, Method: method, Err: err}
+	}
+	return results, nil
+}
+
+// lookup 查找导出函数, 成功时登记一次进行中的调用
+func (host *PluginHost) lookup(name, method string) (*hostedPlugin, *lua.LFunction, error) {
+	host.safe.RLock()
+	defer host.safe.RUnlock()
+	if host.closed {
+		return nil, nil, ErrHostClosed
+	}
+	var entry, ok = host.plugins[name]
+	if !ok {
+		return nil, nil, ErrPluginNotFound
+	}
+	var fn = entry.exports[method]
+	if fn == nil {
+		return nil, nil, ErrMethodNotFound
+	}
+	entry.inflight.Add(1)
+	return entry, fn, nil
+}
+
+func (host *PluginHost) entries() []*hostedPlugin {
+	host.safe.RLock()
+	defer host.safe.RUnlock()
+	var list []*hostedPlugin
+	for _, entry := range host.plugins {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// create 创建并启动插件, file 为 zip/tar 插件包时以包内的 entrypoint 为入口
+func (host *PluginHost) create(name, file string, options ...PluginOptions) (*hostedPlugin, error) {
+	var (
+		bundle     *Bundle
+		entrypoint = file
+		// requested 调用方的配置, 重载时据此重新合并 bundle 清单, 使清单的修改生效
+		requested *PluginOptions
+	)
+	if len(options) > 0 {
+		requested = &options[0]
+	}
+	if BundleFormat(file) != "" {
+		var err error
+		if bundle, err = OpenBundle(file); err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		options = []PluginOptions{bundle.Options(options...)}
+		entrypoint = bundle.Manifest.Entrypoint
+	}
+	var plugin = NewLua(options...).SetLoader(CreateExtendsLoader)
+	plugin.Boot()
+	var entry = host.attach(name, file, plugin, requested)
+	if bundle != nil {
+		if err := bundle.Check(plugin.Modules()); err != nil {
+			plugin.Close()
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+	}
+	if err := plugin.DoFile(entrypoint); err != nil {
+		plugin.Close()
+		return nil, fmt.Errorf("plugin %s: %w", name, err)
+	}
+	return entry, nil
+}
+
+// attach 登记插件, options 为重载时使用的配置
+func (host *PluginHost) attach(name, file string, plugin *luaPluginImpl, options *PluginOptions) *hostedPlugin {
+	var entry = &hostedPlugin{
+		name:    name,
+		file:    file,
+		options: options,
+		plugin:  plugin,
+		exports: make(map[string]*lua.LFunction),
+	}
+	plugin.Runtime().Name = name
+	plugin.LoadLib(&core.LuaRegistryFunction{
+		LName:     HostModuleName,
+		LFunction: host.module(entry),
+	}, plugin.GetLState())
+	return entry
+}
+
+func (host *PluginHost) export(entry *hostedPlugin, method string, fn *lua.LFunction) {
+	host.safe.Lock()
+	defer host.safe.Unlock()
+	entry.exports[method] = fn
+}
+
+// host 模块: name(), export(method, fn), call(plugin, method, ...), callTimeout(ms, plugin, method, ...)
+func (host *PluginHost) module(entry *hostedPlugin) lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(HostModuleName, map[string]lua.LGFunction{
+			"name": func(L *lua.LState) int {
+				L.Push(lua.LString(entry.name))
+				return 1
+			},
+			"export": func(L *lua.LState) int {
+				var name, fn = L.CheckString(1), L.CheckFunction(2)
+				// Clone 出的 vm 重放脚本时不覆盖原插件的导出
+				if plugin := entry.plugin; plugin != nil && plugin.GetLState().G == L.G {
+					host.export(entry, name, fn)
+				}
+				return 0
+			},
+			"call": func(L *lua.LState) int {
+				return host.luaCall(L, entry.name, 0, 1)
+			},
+			"callTimeout": func(L *lua.LState) int {
+				var timeout = time.Duration(L.CheckNumber(1)) * time.Millisecond
+				return host.luaCall(L, entry.name, timeout, 2)
+			},
+		})
+		state.Push(mod)
+		return 1
+	}
+}
+
+func (host *PluginHost) luaCall(L *lua.LState, caller string, timeout time.Duration, offset int) int {
+	var (
+		target = L.CheckString(offset)
+		method = L.CheckString(offset + 1)
+		args   []interface{}
+		ctx    = L.Context()
+	)
+	for i := offset + 2; i <= L.GetTop(); i++ {
+		var v, err = core.ToGo(L.Get(i))
+		if err != nil {
+			L.ArgError(i, err.Error())
+		}
+		args = append(args, v)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if chain := callChain(ctx); len(chain) <= 0 || chain[len(chain)-1] != caller {
+		ctx = context.WithValue(ctx, callChainKey{}, append(chain, caller))
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var results, err = host.Call(ctx, target, method, args...)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	for _, v := range results {
+		L.Push(core.ToLua(L, v))
+	}
+	return len(results)
+}
+
+func (entry *hostedPlugin) timeout(or time.Duration) time.Duration {
+	if entry.options != nil && entry.options.CallTimeout > 0 {
+		return entry.options.CallTimeout
+	}
+	return or
+}
+
+func (entry *hostedPlugin) fail(err error) {
+	atomic.AddUint64(&entry.errors, 1)
+	entry.lastErr.Store(err.Error())
+}
+
+func (entry *hostedPlugin) status() PluginStatus {
+	var status = PluginStatus{
+		Name:    entry.name,
+		File:    entry.file,
+		BootAt:  entry.plugin.BootAt(),
+		Calls:   atomic.LoadUint64(&entry.calls),
+		Errors:  atomic.LoadUint64(&entry.errors),
+		Reloads: atomic.LoadUint64(&entry.reloads),
+	}
+	if v, ok := entry.lastErr.Load().(string); ok {
+		status.LastError = v
+	}
+	return status
+}
+
+// Options 清单项转换为插件配置
+func (entry ManifestEntry) Options() (*PluginOptions, error) {
+	if entry.Name == "" || entry.File == "" {
+		return nil, errors.New("manifest entry requires name and file")
+	}
+	var opts = NewDefaultOptions()
+	opts.Deterministic = entry.Deterministic
+	opts.Seed = entry.Seed
+	opts.CallStackSize = entry.CallStackSize
+	opts.RegistrySize = entry.RegistrySize
+	opts.RegistryMaxSize = entry.RegistryMaxSize
+	if entry.CallTimeout != "" {
+		var timeout, err = time.ParseDuration(entry.CallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: invalid call_timeout: %w", entry.Name, err)
+		}
+		opts.CallTimeout = timeout
+	}
+	return opts, nil
+}
+
+func callChain(ctx context.Context) []string {
+	if chain, ok := ctx.Value(callChainKey{}).([]string); ok {
+		return append([]string(nil), chain...)
+	}
+	return nil
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) <= 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
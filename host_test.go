@@ -0,0 +1,364 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/logger"
+	"github.com/weblfe/plugin_lua/modules/metrics"
+	"github.com/weblfe/plugin_lua/modules/shared"
+	"github.com/weblfe/plugin_lua/modules/timer"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPluginHost_Call(t *testing.T) {
+	var (
+		host          = NewPluginHost()
+		billing       = NewLua()
+		notifications = NewLua()
+	)
+	if err := host.Register("billing", billing); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Register("notifications", notifications); err != nil {
+		t.Fatal(err)
+	}
+	var code = `
+		local host = require("host")
+		host.export("charge", function(order)
+			if order.amount <= 0 then
+				error("invalid amount")
+			end
+			return {id = order.id, charged = order.amount * 100}, host.name()
+		end)
+		host.export("notify", function()
+			return host.call("notifications", "ping")
+		end)
+	`
+	if err := billing.EvalExpr(code); err != nil {
+		t.Fatal(err)
+	}
+	code = `
+		local host = require("host")
+		host.export("ping", function()
+			return host.call("billing", "notify")
+		end)
+		host.export("sleep", function()
+			while true do end
+		end)
+		function checkout()
+			local receipt, from = host.call("billing", "charge", {id = "o-1", amount = 2})
+			assert(receipt.charged == 200 and from == "billing")
+			local ok, err = pcall(host.call, "billing", "charge", {id = "o-2", amount = 0})
+			assert(not ok and string.find(err, "invalid amount"), err)
+		end
+	`
+	if err := notifications.EvalExpr(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifications.EvalExpr(`checkout()`); err != nil {
+		t.Error(err)
+	}
+
+	var results, err = host.Call(context.Background(), "billing", "charge", map[string]interface{}{"id": "o-3", "amount": 1.5})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("call failed: %v %v", results, err)
+	}
+	if receipt, ok := results[0].(map[string]interface{}); !ok || receipt["charged"] != float64(150) {
+		t.Errorf("unexpected receipt: %v", results[0])
+	}
+
+	// 环检测发生在最内层调用, 错误以字符串形式经 lua 逐层传播
+	if _, err = host.Call(context.Background(), "billing", "notify"); err == nil || !strings.Contains(err.Error(), ErrCallCycle.Error()) {
+		t.Errorf("expect cycle error, got %v", err)
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = host.Call(ctx, "notifications", "sleep"); err == nil {
+		t.Error("expect timeout error")
+	}
+	if _, err = host.Call(context.Background(), "billing", "missing"); !errors.Is(err, ErrMethodNotFound) {
+		t.Errorf("expect not found error, got %v", err)
+	}
+}
+
+func TestPluginHost_CallTimeout(t *testing.T) {
+	var (
+		host   = NewPluginHost().SetTimeout(50 * time.Millisecond)
+		plugin = NewLua()
+	)
+	if err := host.Register("worker", plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.EvalExpr(`require("host").export("sleep", function() while true do end end)`); err != nil {
+		t.Fatal(err)
+	}
+	// 调用方的 deadline 较长时仍以目标插件的超时为准
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var start = time.Now()
+	if _, err := host.Call(ctx, "worker", "sleep"); err == nil {
+		t.Error("expect timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("target timeout ignored, call took %s", elapsed)
+	}
+}
+
+func TestPluginHost_LoadDir(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		host = NewPluginHost()
+	)
+	writeFile(t, filepath.Join(dir, "billing.lua"), `
+		local host = require("host")
+		host.export("version", function() return 1 end)
+		host.export("fail", function() error("boom") end)
+	`)
+	writeFile(t, filepath.Join(dir, "notifications", "main.lua"), `
+		require("host").export("version", function() return 2 end)
+	`)
+	writeFile(t, filepath.Join(dir, "readme.txt"), `ignored`)
+	if err := host.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := host.Get("notifications"); !ok {
+		t.Fatal("notifications not loaded")
+	}
+	if _, err := host.Call(context.Background(), "billing", "fail"); err == nil {
+		t.Error("expect error")
+	}
+	var status, _ = host.Status("billing")
+	if status.Calls != 1 || status.Errors != 1 || !strings.Contains(status.LastError, "boom") || status.BootAt.IsZero() {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	writeFile(t, filepath.Join(dir, "billing.lua"), `
+		require("host").export("version", function() return 3 end)
+	`)
+	if err := host.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+	var results, err = host.Call(context.Background(), "billing", "version")
+	if err != nil || results[0] != float64(3) {
+		t.Errorf("reload failed: %v %v", results, err)
+	}
+	if status, _ = host.Status("billing"); status.Reloads != 1 || status.Calls != 2 || status.Errors != 1 {
+		t.Errorf("unexpected reloads: %+v", status)
+	}
+
+	if err = host.Unload("notifications"); err != nil {
+		t.Error(err)
+	}
+	if len(host.Statuses()) != 1 {
+		t.Errorf("unexpected statuses: %+v", host.Statuses())
+	}
+	if err = host.Shutdown(nil); err != nil {
+		t.Error(err)
+	}
+	if _, err = host.Call(context.Background(), "billing", "version"); !errors.Is(err, ErrHostClosed) {
+		t.Errorf("expect closed error, got %v", err)
+	}
+}
+
+func TestPluginHost_LoadManifest(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		host = NewPluginHost()
+	)
+	writeFile(t, filepath.Join(dir, "scripts", "clock.lua"), `
+		require("host").export("now", function() return os.time() end)
+	`)
+	writeFile(t, filepath.Join(dir, "plugins.json"), `{"plugins": [
+		{"name": "clock", "file": "scripts/clock.lua", "deterministic": true, "call_timeout": "1s"}
+	]}`)
+	if err := host.LoadManifest(filepath.Join(dir, "plugins.json")); err != nil {
+		t.Fatal(err)
+	}
+	var results, err = host.Call(context.Background(), "clock", "now")
+	if err != nil || results[0] != float64(0) {
+		t.Errorf("unexpected result: %v %v", results, err)
+	}
+}
+
+func TestPluginHost_ReloadUnloaded(t *testing.T) {
+	var (
+		reg     = metrics.NewRegistry()
+		host    = NewPluginHost().SetMetrics(reg)
+		file    = filepath.Join(t.TempDir(), "svc.lua")
+		loop    = timer.NewLoop(core.NewManualClock(time.Unix(0, 0)))
+		options = PluginOptions{ModuleOptions: map[string]interface{}{timer.Name: loop}}
+	)
+	var zone, err = shared.DefineZone("reload_unloaded", 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.RemoveZone(zone.Name())
+	writeFile(t, file, `require("host").export("version", function() return 1 end)`)
+	if err = host.Load("svc", file, options); err != nil {
+		t.Fatal(err)
+	}
+	// 新实例加载期间插件被卸载: 新实例不再登记, 被关闭且不计入重载次数
+	writeFile(t, file, `
+		local zone = require("shared").zone("reload_unloaded")
+		zone:set("loading", true)
+		local deadline = os.clock() + 5
+		while not zone:get("unloaded") and os.clock() < deadline do end
+		require("timer").setInterval(function() end, 1000)
+	`)
+	go func() {
+		for {
+			if _, ok := zone.Get("loading"); ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		_ = host.Unload("svc")
+		_ = zone.Set("unloaded", true, 0)
+	}()
+	if err = host.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := host.Get("svc"); ok {
+		t.Error("unloaded plugin registered by reload")
+	}
+	if n := loop.Len(); n != 0 {
+		t.Errorf("reloaded instance not closed, %d timers left", n)
+	}
+	var out strings.Builder
+	_ = reg.WriteText(&out)
+	if strings.Contains(out.String(), `lua_plugin_reloads_total{plugin="svc"}`) {
+		t.Errorf("reload counted without swap:\n%s", out.String())
+	}
+}
+
+func writeFile(t *testing.T, file, content string) {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPluginHost_Metrics(t *testing.T) {
+	var (
+		reg    = metrics.NewRegistry()
+		host   = NewPluginHost().SetMetrics(reg)
+		plugin = NewLua(PluginOptions{ModuleOptions: map[string]interface{}{metrics.Name: reg}})
+	)
+	defer plugin.Close()
+	if err := host.Register("orders", plugin); err != nil {
+		t.Fatal(err)
+	}
+	var code = `
+		require("host").export("create", function(n)
+			if n < 0 then error("negative") end
+			return n
+		end)
+	`
+	if err := plugin.EvalExpr(code); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = host.Call(context.Background(), "orders", "create", 1)
+	_, _ = host.Call(context.Background(), "orders", "create", -1)
+	var pool = NewPluginPool(plugin, 2)
+	var vm, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(vm)
+	var out strings.Builder
+	_ = reg.WriteText(&out)
+	for _, line := range []string{
+		`lua_plugin_calls_total{plugin="orders"} 2`,
+		`lua_plugin_errors_total{plugin="orders"} 1`,
+		`lua_plugin_call_duration_seconds_count{plugin="orders"} 2`,
+		`lua_plugin_pool_size{plugin="orders"} 1`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+	pool.Close()
+	out.Reset()
+	_ = reg.WriteText(&out)
+	if !strings.Contains(out.String(), `lua_plugin_pool_size{plugin="orders"} 0`) {
+		t.Errorf("expected empty pool gauge:\n%s", out.String())
+	}
+}
+
+func TestPluginHost_Trace(t *testing.T) {
+	var (
+		exporter = trace.NewMemoryExporter()
+		host     = NewPluginHost()
+		plugin   = NewLua(PluginOptions{ModuleOptions: map[string]interface{}{trace.Name: trace.NewTracer(exporter)}})
+	)
+	defer plugin.Close()
+	plugin.SetLoader(CreateExtendsLoader).Boot()
+	if err := host.Register("orders", plugin); err != nil {
+		t.Fatal(err)
+	}
+	var code = `
+		require("host").export("create", function()
+			return trace.span("validate", function() return true end)
+		end)
+	`
+	if err := plugin.EvalExpr(code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := host.Call(context.Background(), "orders", "create"); err != nil {
+		t.Fatal(err)
+	}
+	var spans = exporter.Spans()
+	if len(spans) != 3 || spans[0].Name != "plugin.eval" || spans[1].Name != "validate" || spans[2].Name != "plugin.call" {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	if spans[1].ParentID != spans[2].SpanID || spans[2].Attributes["method"] != "create" || spans[2].Attributes["plugin"] != "orders" {
+		t.Errorf("unexpected span hierarchy %+v", spans)
+	}
+	var fn, err = plugin.GetLState().LoadString("return 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = plugin.call(context.Background(), "direct", fn); err != nil {
+		t.Fatal(err)
+	}
+	if spans = exporter.Spans(); len(spans) != 4 || spans[3].Name != "plugin.call" || spans[3].Attributes["method"] != "direct" {
+		t.Errorf("direct call not traced %v", spans)
+	}
+}
+
+func TestPluginHost_Logger(t *testing.T) {
+	var (
+		out    = logrus.New()
+		buf    bytes.Buffer
+		host   = NewPluginHost()
+		plugin = NewLua(PluginOptions{Logger: out})
+	)
+	defer plugin.Close()
+	out.Out, out.Formatter = &buf, &logrus.JSONFormatter{}
+	plugin.SetLoader(CreateExtendsLoader).Boot()
+	if err := host.Register("orders", plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.EvalExpr(`logger.info("order created", {id = 7})`); err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%s: %q", err, buf.String())
+	}
+	if entry["msg"] != "order created" || entry[logger.FieldPlugin] != "orders" || entry["id"] != float64(7) {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
@@ -0,0 +1,384 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/json"
+	"github.com/weblfe/plugin_lua/modules/logger"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// LuaHandler 以 lua 函数处理 http 请求, 每个请求从 vm 池取出独立的 vm 执行
+	//
+	//	function handlers.route(req, res) return 200, {["Content-Type"] = "text/plain"}, "ok" end
+	//
+	// 中间件签名为 function(req, res, next), 调用 next() 继续处理并返回其结果
+	LuaHandler struct {
+		pool       *PluginPool
+		route      string
+		middleware []string
+		// MaxBodySize req:body() 读取的最大字节数, 0 使用 DefaultMaxBodySize
+		MaxBodySize int64
+	}
+
+	luaRequest struct {
+		request *http.Request
+		limit   int64
+		body    []byte
+		read    bool
+		err     error
+	}
+
+	luaResponse struct {
+		writer      http.ResponseWriter
+		status      int
+		wroteHeader bool
+		written     bool
+	}
+)
+
+const (
+	DefaultMaxBodySize = 10 << 20
+)
+
+// HTTPHandler 创建调用 route (如 "handlers.route") 的 http.Handler, middleware 按顺序包裹 route
+func HTTPHandler(plugin *luaPluginImpl, route string, middleware ...string) *LuaHandler {
+	return &LuaHandler{
+		pool:       NewPluginPool(plugin, DefaultPoolSize),
+		route:      route,
+		middleware: middleware,
+	}
+}
+
+// SetPoolSize 设置 vm 池的上限, 需在处理请求之前调用; 原有的池被关闭
+func (handler *LuaHandler) SetPoolSize(size int) *LuaHandler {
+	var previous = handler.pool
+	handler.pool = NewPluginPool(previous.origin, size)
+	previous.Close()
+	return handler
+}
+
+// Pool 处理请求使用的 vm 池
+func (handler *LuaHandler) Pool() *PluginPool {
+	return handler.pool
+}
+
+// Close 关闭 vm 池
+func (handler *LuaHandler) Close() {
+	handler.pool.Close()
+}
+
+func (handler *LuaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// vm 归还到取出它的池
+	var (
+		pool  = handler.pool
+		name  = pool.origin.Runtime().Name
+		start = time.Now()
+	)
+	var ctx, span = trace.Of(pool.origin.Runtime()).Start(trace.Extract(r.Context(), r.Header), "http.handler")
+	span.SetAttribute("route", handler.route).SetAttribute("http.method", r.Method).SetAttribute("http.path", r.URL.Path)
+	var vm, err = pool.Get(ctx)
+	if err != nil {
+		handler.logf("lua handler %s: %s", handler.route, err.Error())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		span.SetAttribute("http.status", http.StatusServiceUnavailable).Finish(err)
+		pool.metrics.observe(name, start, err)
+		return
+	}
+	var res = &luaResponse{writer: w, status: http.StatusOK}
+	defer func() {
+		span.SetAttribute("http.status", res.status).Finish(err)
+		pool.metrics.observe(name, start, err)
+	}()
+	defer func() {
+		var (
+			apiErr   *lua.ApiError
+			panicked = errors.As(err, &apiErr) && apiErr.Type == lua.ApiErrorPanic
+		)
+		if v := recover(); v != nil {
+			err, panicked = fmt.Errorf("panic: %v", v), true
+		}
+		// panic 后 vm 状态不可信, 丢弃
+		if panicked {
+			pool.Discard(vm)
+		} else {
+			pool.Put(vm)
+		}
+		if err == nil {
+			return
+		}
+		handler.logf("lua handler %s: %s", handler.route, err.Error())
+		res.fail()
+	}()
+	err = handler.serve(ctx, vm, r, res)
+}
+
+func (handler *LuaHandler) serve(ctx context.Context, vm *luaPluginImpl, r *http.Request, res *luaResponse) error {
+	var rt = vm.Runtime()
+	if err := rt.Acquire(ctx); err != nil {
+		return err
+	}
+	defer rt.Release()
+	var (
+		L        = vm.GetLState()
+		top      = L.GetTop()
+		previous = L.RemoveContext()
+	)
+	L.SetContext(ctx)
+	defer func() {
+		L.SetTop(top)
+		L.RemoveContext()
+		if previous != nil {
+			L.SetContext(previous)
+		}
+	}()
+	var chain = make([]*lua.LFunction, 0, len(handler.middleware)+1)
+	for _, name := range append(append([]string{}, handler.middleware...), handler.route) {
+		var fn, ok = lookupFunction(L, name).(*lua.LFunction)
+		if !ok {
+			return fmt.Errorf("%s is not a function", name)
+		}
+		chain = append(chain, fn)
+	}
+	var (
+		req     = newLuaRequest(L, r, handler.maxBodySize())
+		resp    = newLuaResponse(L, res)
+		results []lua.LValue
+		err     = L.CallByParam(lua.P{
+			Fn:      L.NewFunction(next(chain, req, resp)),
+			NRet:    lua.MultRet,
+			Protect: true,
+		})
+	)
+	if err != nil {
+		return err
+	}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		results = append(results, L.Get(i))
+	}
+	return res.finish(L, results)
+}
+
+// next 依次调用中间件, 最后调用 route
+func next(chain []*lua.LFunction, req, resp lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		var (
+			top  = L.GetTop()
+			args = []lua.LValue{req, resp}
+		)
+		if len(chain) > 1 {
+			args = append(args, L.NewFunction(next(chain[1:], req, resp)))
+		}
+		L.CallByParam(lua.P{Fn: chain[0], NRet: lua.MultRet, Protect: false}, args...)
+		return L.GetTop() - top
+	}
+}
+
+func (handler *LuaHandler) maxBodySize() int64 {
+	if handler.MaxBodySize > 0 {
+		return handler.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// logf 脚本错误与 panic 经插件的 logger 输出 (PluginOptions.Logger 注入的 Sink), 附加 plugin 字段
+func (handler *LuaHandler) logf(format string, args ...interface{}) {
+	logger.Entry(handler.pool.origin.Runtime()).Errorf(format, args...)
+}
+
+// lookupFunction 按 "a.b.c" 查找全局变量
+func lookupFunction(L *lua.LState, name string) lua.LValue {
+	var value lua.LValue = L.G.Global
+	for _, key := range strings.Split(name, ".") {
+		var t, ok = value.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		value = L.GetField(t, key)
+	}
+	return value
+}
+
+// newLuaRequest req.method, req.path, req.query, req.headers 与惰性读取的 req:body()
+func newLuaRequest(L *lua.LState, r *http.Request, limit int64) *lua.LTable {
+	var (
+		req   = &luaRequest{request: r, limit: limit}
+		t     = L.NewTable()
+		query = L.NewTable()
+	)
+	for k, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query.RawSetString(k, lua.LString(values[0]))
+		}
+	}
+	t.RawSetString("method", lua.LString(r.Method))
+	t.RawSetString("path", lua.LString(r.URL.Path))
+	t.RawSetString("host", lua.LString(r.Host))
+	t.RawSetString("remote_addr", lua.LString(r.RemoteAddr))
+	t.RawSetString("query", query)
+	t.RawSetString("headers", headerTable(L, r.Header))
+	t.RawSetString("body", L.NewFunction(func(L *lua.LState) int {
+		var data, err = req.readBody()
+		if err != nil {
+			L.RaiseError("read body: %s", err.Error())
+		}
+		L.Push(lua.LString(data))
+		return 1
+	}))
+	t.RawSetString("json", L.NewFunction(func(L *lua.LState) int {
+		var data, err = req.readBody()
+		if err != nil {
+			L.RaiseError("read body: %s", err.Error())
+		}
+		value, err := json.Decode(L, data, json.Options{})
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		L.Push(value)
+		return 1
+	}))
+	return t
+}
+
+func (req *luaRequest) readBody() ([]byte, error) {
+	if req.read {
+		return req.body, req.err
+	}
+	req.read = true
+	if req.request.Body == nil {
+		return nil, nil
+	}
+	req.body, req.err = ioutil.ReadAll(io.LimitReader(req.request.Body, req.limit+1))
+	if req.err == nil && int64(len(req.body)) > req.limit {
+		req.body, req.err = nil, fmt.Errorf("body exceeds %d bytes", req.limit)
+	}
+	return req.body, req.err
+}
+
+// newLuaResponse res:status(code), res:header(k, v), res:write(s), res:json(v)
+func newLuaResponse(L *lua.LState, res *luaResponse) *lua.LTable {
+	var t = L.NewTable()
+	t.RawSetString("status", L.NewFunction(func(L *lua.LState) int {
+		res.status = L.CheckInt(2)
+		return 0
+	}))
+	t.RawSetString("header", L.NewFunction(func(L *lua.LState) int {
+		res.writer.Header().Set(L.CheckString(2), L.CheckString(3))
+		return 0
+	}))
+	t.RawSetString("write", L.NewFunction(func(L *lua.LState) int {
+		for i := 2; i <= L.GetTop(); i++ {
+			res.write([]byte(L.CheckString(i)))
+		}
+		return 0
+	}))
+	t.RawSetString("json", L.NewFunction(func(L *lua.LState) int {
+		var data, err = json.Encode(L, L.CheckAny(2), json.Options{})
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		if res.writer.Header().Get("Content-Type") == "" {
+			res.writer.Header().Set("Content-Type", "application/json")
+		}
+		res.write(data)
+		return 0
+	}))
+	return t
+}
+
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	var (
+		t    = L.NewTable()
+		keys = make([]string, 0, len(header))
+	)
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t.RawSetString(k, lua.LString(strings.Join(header[k], ", ")))
+	}
+	return t
+}
+
+func (res *luaResponse) writeHeader() {
+	if res.wroteHeader {
+		return
+	}
+	res.wroteHeader = true
+	res.writer.WriteHeader(res.status)
+}
+
+func (res *luaResponse) write(data []byte) {
+	res.writeHeader()
+	res.written = true
+	_, _ = res.writer.Write(data)
+}
+
+// finish 未通过 res 写出时使用返回值: status, headers, body, body 为 table 时编码为 json
+func (res *luaResponse) finish(L *lua.LState, results []lua.LValue) error {
+	if res.written {
+		return nil
+	}
+	if len(results) > 0 {
+		if s, ok := results[0].(lua.LString); ok {
+			results = []lua.LValue{lua.LNumber(http.StatusOK), lua.LNil, s}
+		}
+	}
+	var body []byte
+	for i, value := range results {
+		switch {
+		case i == 0 && value != lua.LNil:
+			var status, ok = value.(lua.LNumber)
+			if !ok {
+				return errors.New("status must be a number")
+			}
+			res.status = int(status)
+		case i == 1 && value != lua.LNil:
+			var headers, ok = value.(*lua.LTable)
+			if !ok {
+				return errors.New("headers must be a table")
+			}
+			core.ForEach(L, headers, func(k lua.LValue, v lua.LValue) {
+				res.writer.Header().Set(k.String(), v.String())
+			})
+		case i == 2 && value != lua.LNil:
+			if t, ok := value.(*lua.LTable); ok {
+				var data, err = json.Encode(L, t, json.Options{})
+				if err != nil {
+					return err
+				}
+				if res.writer.Header().Get("Content-Type") == "" {
+					res.writer.Header().Set("Content-Type", "application/json")
+				}
+				body = data
+			} else {
+				body = []byte(lua.LVAsString(value))
+			}
+		}
+	}
+	res.writeHeader()
+	if len(body) > 0 {
+		_, _ = res.writer.Write(body)
+	}
+	return nil
+}
+
+// fail 尚未写出响应时返回 500, 不向客户端暴露脚本错误
+func (res *luaResponse) fail() {
+	if res.wroteHeader {
+		return
+	}
+	res.wroteHeader = true
+	http.Error(res.writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,194 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/logger"
+	"github.com/weblfe/plugin_lua/modules/metrics"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	var (
+		out, hook = test.NewNullLogger()
+		plugin    = NewLua(PluginOptions{Logger: out}).SetLoader(CreateExtendsLoader)
+	)
+	plugin.Boot()
+	plugin.Runtime().Name = "web"
+	plugin.LoadLib(&core.LuaRegistryFunction{
+		LName: "boom",
+		LFunction: func(L *lua.LState) int {
+			L.SetGlobal("boom", L.NewFunction(func(L *lua.LState) int {
+				panic("boom")
+			}))
+			return 0
+		},
+	})
+	var err = plugin.Define(`
+handlers = {}
+function handlers.route(req, res)
+	if req.path == "/write" then
+		res:status(201)
+		res:header("X-Mode", "write")
+		res:write("hello ", req.query.name)
+		return
+	elseif req.path == "/json" then
+		local body = req:json()
+		return 200, nil, {sum = body.a + body.b}
+	elseif req.path == "/error" then
+		error("script failed")
+	elseif req.path == "/panic" then
+		boom()
+	end
+	return 200, {["X-Agent"] = req.headers["User-Agent"]}, req.method .. " " .. req:body()
+end
+
+middleware = {}
+function middleware.auth(req, res, next)
+	if req.headers["Authorization"] ~= "secret" then
+		return 401, nil, "unauthorized"
+	end
+	res:header("X-Auth", "ok")
+	return next()
+end
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler = HTTPHandler(plugin, "handlers.route", "middleware.auth").SetPoolSize(2)
+	defer handler.Close()
+	var server = httptest.NewServer(handler)
+	defer server.Close()
+
+	var do = func(method, path, body string, auth bool) (*http.Response, string) {
+		var req, _ = http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("User-Agent", "test")
+		if auth {
+			req.Header.Set("Authorization", "secret")
+		}
+		var resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var data, _ = ioutil.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	if resp, body := do("POST", "/echo", "payload", true); resp.StatusCode != 200 || body != "POST payload" ||
+		resp.Header.Get("X-Agent") != "test" || resp.Header.Get("X-Auth") != "ok" {
+		t.Errorf("unexpected echo response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp, body := do("GET", "/echo", "", false); resp.StatusCode != 401 || body != "unauthorized" {
+		t.Errorf("middleware should reject, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := do("GET", "/write?name=lua", "", true); resp.StatusCode != 201 || body != "hello lua" || resp.Header.Get("X-Mode") != "write" {
+		t.Errorf("unexpected write response %d %q", resp.StatusCode, body)
+	}
+	if resp, body := do("POST", "/json", `{"a": 1, "b": 2}`, true); resp.StatusCode != 200 || body != `{"sum":3}` {
+		t.Errorf("unexpected json response %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := do("GET", "/error", "", true); resp.StatusCode != 500 {
+		t.Errorf("script error should be 500, got %d", resp.StatusCode)
+	}
+	if resp, _ := do("GET", "/panic", "", true); resp.StatusCode != 500 {
+		t.Errorf("panic should be 500, got %d", resp.StatusCode)
+	}
+	if entries := hook.AllEntries(); len(entries) != 2 || !strings.Contains(entries[0].Message, "script failed") ||
+		entries[1].Level != logrus.ErrorLevel || entries[1].Data[logger.FieldPlugin] != "web" {
+		t.Errorf("handler errors not logged through the plugin sink: %v", entries)
+	}
+
+	// 并发请求共享大小为 2 的 vm 池
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, _ := do("GET", "/echo", "", true); resp.StatusCode != 200 {
+				t.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	if size := handler.Pool().Size(); size > 2 {
+		t.Errorf("pool size exceeds limit: %d", size)
+	}
+}
+
+func TestHTTPHandler_SetPoolSize(t *testing.T) {
+	var (
+		reg    = metrics.NewRegistry()
+		plugin = NewLua(PluginOptions{ModuleOptions: map[string]interface{}{metrics.Name: reg}})
+	)
+	defer plugin.Close()
+	plugin.Runtime().Name = "web"
+	if err := plugin.Define(`handlers = {route = function() return 200, nil, "ok" end}`); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		handler  = HTTPHandler(plugin, "handlers.route")
+		previous = handler.Pool()
+		gauge    = func() string {
+			var out strings.Builder
+			_ = reg.WriteText(&out)
+			return out.String()
+		}
+	)
+	defer handler.Close()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(gauge(), `lua_plugin_pool_size{plugin="web"} 1`) {
+		t.Fatalf("expected one pooled vm:\n%s", gauge())
+	}
+	// 替换的池被关闭, 其中的 vm 不再计入
+	handler.SetPoolSize(2)
+	if !strings.Contains(gauge(), `lua_plugin_pool_size{plugin="web"} 0`) {
+		t.Errorf("previous pool not closed:\n%s", gauge())
+	}
+	if _, err := previous.Get(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("expect closed pool, got %v", err)
+	}
+	var rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 200 || handler.Pool().Size() != 1 {
+		t.Errorf("unexpected status %d, pool size %d", rec.Code, handler.Pool().Size())
+	}
+}
+
+func TestHTTPHandler_Metrics(t *testing.T) {
+	var (
+		reg    = metrics.NewRegistry()
+		out, _ = test.NewNullLogger()
+		plugin = NewLua(PluginOptions{Logger: out, ModuleOptions: map[string]interface{}{metrics.Name: reg}})
+	)
+	defer plugin.Close()
+	plugin.Runtime().Name = "web"
+	if err := plugin.Define(`handlers = {route = function(req) if req.path == "/error" then error("failed") end return 200 end}`); err != nil {
+		t.Fatal(err)
+	}
+	var handler = HTTPHandler(plugin, "handlers.route")
+	defer handler.Close()
+	for _, path := range []string{"/", "/", "/error"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	var text strings.Builder
+	_ = reg.WriteText(&text)
+	for _, line := range []string{
+		`lua_plugin_calls_total{plugin="web"} 3`,
+		`lua_plugin_errors_total{plugin="web"} 1`,
+		`lua_plugin_call_duration_seconds_count{plugin="web"} 3`,
+	} {
+		if !strings.Contains(text.String(), line) {
+			t.Errorf("missing %q in:\n%s", line, text.String())
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package plugins
+
+import (
+	"bytes"
+	"github.com/yuin/gopher-lua"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// readScript 读取脚本 (配置了 ScriptRoot 时从中读取), 配置了 Verifier 时校验签名 (失败即拒绝加载)
+func (plugin *luaPluginImpl) readScript(file string) ([]byte, error) {
+	var root = plugin.scriptRoot()
+	if root != nil {
+		file = rootPath(file)
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if root != nil {
+		data, err = fs.ReadFile(root, file)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if verifier := plugin.verifier(); verifier != nil {
+		if root != nil {
+			err = verifier.VerifyFS(root, file, data)
+		} else {
+			err = verifier.Verify(file, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (plugin *luaPluginImpl) loadScript(L *lua.LState, file string) (*lua.LFunction, error) {
+	var data, err = plugin.readScript(file)
+	if err != nil {
+		return nil, err
+	}
+	return L.Load(bytes.NewReader(data), file)
+}
+
+func (plugin *luaPluginImpl) doScript(L *lua.LState, file string) error {
+	var fn, err = plugin.loadScript(L, file)
+	if err != nil {
+		return err
+	}
+	L.Push(fn)
+	return L.PCall(0, lua.MultRet, nil)
+}
+
+func (plugin *luaPluginImpl) scriptRoot() fs.FS {
+	if plugin.options == nil {
+		return nil
+	}
+	return plugin.options.ScriptRoot
+}
+
+func (plugin *luaPluginImpl) verifier() *ScriptVerifier {
+	if plugin.options == nil {
+		return nil
+	}
+	return plugin.options.Verifier
+}
+
+// installLoader 替换 package.loaders 中的 lua 文件加载器与 dofile, loadfile, 使其同样从 ScriptRoot 读取并经过签名校验
+// 插件派生的 vm (如 task) 经 Runtime.Prepare 安装相同的加载器
+func (plugin *luaPluginImpl) installLoader() {
+	if plugin.verifier() == nil && plugin.scriptRoot() == nil {
+		return
+	}
+	plugin.prepare(plugin.GetLState())
+	plugin.Runtime().Prepare = plugin.prepare
+}
+
+func (plugin *luaPluginImpl) prepare(state *lua.LState) {
+	var (
+		pkg    = state.GetGlobal(lua.LoadLibName)
+		loader = state.GetField(pkg, "loaders")
+	)
+	if loaders, ok := loader.(*lua.LTable); ok && loaders.Len() >= 2 {
+		loaders.RawSetInt(2, state.NewFunction(plugin.requireLoader))
+	}
+	state.SetGlobal("dofile", state.NewFunction(plugin.luaDofile))
+	state.SetGlobal("loadfile", state.NewFunction(plugin.luaLoadfile))
+}
+
+// luaDofile dofile(file) ..., 不支持从标准输入读取
+func (plugin *luaPluginImpl) luaDofile(L *lua.LState) int {
+	var fn, err = plugin.loadScript(L, L.CheckString(1))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	var top = L.GetTop()
+	L.Push(fn)
+	L.Call(0, lua.MultRet)
+	return L.GetTop() - top
+}
+
+// luaLoadfile loadfile(file) fn | nil, err
+func (plugin *luaPluginImpl) luaLoadfile(L *lua.LState) int {
+	var fn, err = plugin.loadScript(L, L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(fn)
+	return 1
+}
+
+func (plugin *luaPluginImpl) requireLoader(L *lua.LState) int {
+	var (
+		name      = L.CheckString(1)
+		file, msg = plugin.findScript(L, name)
+	)
+	if file == "" {
+		L.Push(lua.LString(msg))
+		return 1
+	}
+	var fn, err = plugin.loadScript(L, file)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	L.Push(fn)
+	return 1
+}
+
+// findScript 按 package.path 查找模块文件, ScriptRoot 中只查找相对路径
+func (plugin *luaPluginImpl) findScript(L *lua.LState, name string) (string, string) {
+	var (
+		messages []string
+		root     = plugin.scriptRoot()
+		path     = L.GetField(L.GetGlobal(lua.LoadLibName), "path")
+		patterns = strings.Split(lua.LVAsString(path), ";")
+	)
+	if root != nil {
+		name = strings.Replace(name, ".", "/", -1)
+		patterns = append(patterns, "?.lua", "?/init.lua")
+	} else {
+		name = strings.Replace(name, ".", string(os.PathSeparator), -1)
+	}
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		var (
+			err  error
+			file = strings.Replace(pattern, "?", name, -1)
+		)
+		if root != nil {
+			if filepath.IsAbs(file) {
+				continue
+			}
+			_, err = fs.Stat(root, rootPath(file))
+		} else {
+			_, err = os.Stat(file)
+		}
+		if err == nil {
+			return file, ""
+		}
+		messages = append(messages, err.Error())
+	}
+	return "", "\n\t" + strings.Join(messages, "\n\t")
+}
+
+// rootPath 转换为 fs.FS 路径 (斜杠分隔, 无 ./ 前缀)
+func rootPath(file string) string {
+	return path.Clean(strings.TrimPrefix(filepath.ToSlash(file), "./"))
+}
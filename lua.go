@@ -1,11 +1,16 @@
 package plugins
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"github.com/weblfe/plugin_lua/core"
 	"github.com/weblfe/plugin_lua/modules"
+	"github.com/weblfe/plugin_lua/modules/trace"
 	"github.com/yuin/gopher-lua"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"runtime"
 	"sort"
 	"sync"
@@ -25,10 +30,34 @@ type (
 		loader      BootLoader
 		cache       map[string]bool
 		extLibs     []*core.LuaRegistryFunction
+		runtime     *core.Runtime
+		// libs, scripts 已加载的模块与已执行的脚本, 供 Clone 重放
+		libs    []*core.LuaRegistryFunction
+		scripts []script
+	}
+
+	// script DoFile 的文件或 Define 的代码
+	script struct {
+		file string
+		code string
 	}
 
 	PluginOptions struct {
 		Extends []*core.LuaRegistryFunction
+		// Deterministic 确定性执行: 固定时钟, 固定随机种子, 有序遍历
+		Deterministic bool
+		Clock         core.Clock
+		Seed          int64
+		// CallTimeout PluginHost 调用该插件的超时, 0 使用 host 的默认值
+		CallTimeout time.Duration
+		// ModuleOptions 模块的插件级配置, key 为模块名, 如 "http": &http.Options{...}
+		ModuleOptions map[string]interface{}
+		// Logger 插件日志的输出: *logrus.Logger, logger.Handler 或 logger.Sink, 日志附加 plugin 字段
+		Logger interface{}
+		// Verifier 非空时 DoFile/LoadFile/require 加载的脚本必须通过签名校验
+		Verifier *ScriptVerifier
+		// ScriptRoot 非空时 DoFile/LoadFile/require 从中读取脚本 (如 Bundle.FS)
+		ScriptRoot fs.FS
 		lua.Options
 	}
 
@@ -81,10 +110,38 @@ func (plugin *luaPluginImpl) init() *luaPluginImpl {
 		plugin.constructor = &sync.Once{}
 	}
 	plugin.cache = make(map[string]bool)
+	plugin.initRuntime()
+	plugin.installLoader()
 	runtime.SetFinalizer(plugin, (*luaPluginImpl).destroy)
 	return plugin
 }
 
+func (plugin *luaPluginImpl) initRuntime() {
+	var rt = core.NewRuntime()
+	if opts := plugin.options; opts != nil {
+		if opts.Clock != nil {
+			rt.SetClock(opts.Clock)
+		} else if opts.Deterministic {
+			rt.SetClock(core.NewManualClock(time.Unix(0, 0)))
+		}
+		if opts.Seed != 0 || opts.Deterministic {
+			rt.Seed(opts.Seed)
+		}
+		rt.Options = opts.ModuleOptions
+		rt.Logger = opts.Logger
+		rt.CallTimeout = opts.CallTimeout
+	}
+	plugin.runtime = rt
+	core.SetRuntime(plugin.GetLState(), rt)
+	if plugin.options != nil && plugin.options.Deterministic {
+		core.OpenDeterministic(plugin.GetLState())
+	}
+}
+
+func (plugin *luaPluginImpl) Runtime() *core.Runtime {
+	return plugin.runtime
+}
+
 func (plugin *luaPluginImpl) SetLoader(loader BootLoader) *luaPluginImpl {
 	if loader == nil || !plugin.bootAt.IsZero() {
 		return plugin
@@ -163,19 +220,145 @@ func (plugin *luaPluginImpl) GetLState() *lua.LState {
 }
 
 func (plugin *luaPluginImpl) Eval(data []byte) error {
-	return plugin.GetVM().DoString(string(data))
+	return plugin.EvalExpr(string(data))
 }
 
+// EvalExpr 执行代码, 不记录到 Clone 的重放列表 (可能有副作用), 定义函数与全局变量的代码使用 Define
 func (plugin *luaPluginImpl) EvalExpr(luaExpr string) error {
-	return plugin.GetVM().DoString(luaExpr)
+	return plugin.exec("plugin.eval", func() error {
+		return plugin.GetVM().DoString(luaExpr)
+	})
+}
+
+// Define 执行定义性的代码 (函数, 全局配置等), 成功后记录, Clone 时在新 vm 中重放
+func (plugin *luaPluginImpl) Define(code string) error {
+	return plugin.exec("plugin.define", func() error {
+		if err := plugin.GetVM().DoString(code); err != nil {
+			return err
+		}
+		plugin.scripts = append(plugin.scripts, script{code: code})
+		return nil
+	})
 }
 
 func (plugin *luaPluginImpl) LoadFile(file string) (*lua.LFunction, error) {
-	return plugin.GetVM().LoadFile(file)
+	var fn *lua.LFunction
+	var err = plugin.exec("plugin.load", func() (err error) {
+		fn, err = plugin.loadScript(plugin.GetLState(), file)
+		return err
+	})
+	return fn, err
 }
 
+// DoFile 执行脚本文件 (入口脚本), 成功后记录, Clone 时在新 vm 中重放
 func (plugin *luaPluginImpl) DoFile(file string) error {
-	return plugin.GetVM().DoFile(file)
+	return plugin.exec("plugin.dofile", func() error {
+		if err := plugin.doScript(plugin.GetLState(), file); err != nil {
+			return err
+		}
+		plugin.scripts = append(plugin.scripts, script{file: file})
+		return nil
+	})
+}
+
+// Clone 以相同的配置创建新的 vm, 重新加载模块并按顺序重放 DoFile 与 Define 执行过的脚本
+func (plugin *luaPluginImpl) Clone() (*luaPluginImpl, error) {
+	var (
+		options = *plugin.options
+		clone   = NewLua(options)
+	)
+	clone.Boot()
+	clone.Runtime().Name = plugin.Runtime().Name
+	var err = plugin.exec("plugin.clone", func() error {
+		for _, lib := range plugin.libs {
+			clone.LoadLib(lib, clone.GetLState())
+		}
+		for _, s := range plugin.scripts {
+			if s.file != "" {
+				if err := clone.DoFile(s.file); err != nil {
+					return err
+				}
+			} else if err := clone.Define(s.code); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		clone.Close()
+		return nil, err
+	}
+	return clone, nil
+}
+
+// exec 独占 vm 执行, 与 host 调用等其他 goroutine 串行; 执行期间 vm 的 context 携带名为 name 的 span
+func (plugin *luaPluginImpl) exec(name string, fn func() error) (err error) {
+	var rt = plugin.Runtime()
+	if err = rt.Acquire(context.Background()); err != nil {
+		return err
+	}
+	defer rt.Release()
+	var (
+		state    = plugin.GetLState()
+		previous = state.RemoveContext()
+		parent   = previous
+	)
+	if parent == nil {
+		parent = context.Background()
+	}
+	var ctx, span = trace.Of(rt).Start(parent, name)
+	span.SetAttribute("plugin", rt.Name)
+	state.SetContext(ctx)
+	defer func() {
+		state.RemoveContext()
+		if previous != nil {
+			state.SetContext(previous)
+		}
+		span.Finish(err)
+	}()
+	return fn()
+}
+
+// call 在 ctx 下执行 lua 函数 method, 参数与返回值经 core.Codec 复制, 记录 plugin.call span
+func (plugin *luaPluginImpl) call(ctx context.Context, method string, fn *lua.LFunction, args ...interface{}) (results []interface{}, err error) {
+	var rt = plugin.Runtime()
+	ctx, span := trace.Of(rt).Start(ctx, "plugin.call")
+	span.SetAttribute("plugin", rt.Name).SetAttribute("method", method)
+	defer func() {
+		span.Finish(err)
+	}()
+	if err = rt.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer rt.Release()
+	var (
+		state    = plugin.GetLState()
+		top      = state.GetTop()
+		previous = state.RemoveContext()
+		params   []lua.LValue
+	)
+	state.SetContext(ctx)
+	defer func() {
+		state.SetTop(top)
+		state.RemoveContext()
+		if previous != nil {
+			state.SetContext(previous)
+		}
+	}()
+	for _, v := range args {
+		params = append(params, core.ToLua(state, v))
+	}
+	if err = state.CallByParam(lua.P{Fn: fn, NRet: lua.MultRet, Protect: true}, params...); err != nil {
+		return nil, err
+	}
+	for i := top + 1; i <= state.GetTop(); i++ {
+		var v, err = core.ToGo(state.Get(i))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+	return results, nil
 }
 
 func (plugin *luaPluginImpl) Libs() []string {
@@ -198,6 +381,16 @@ func (plugin *luaPluginImpl) Libs() []string {
 	return libArr
 }
 
+// Modules 已注册 (LoadLib) 的模块名, 已排序
+func (plugin *luaPluginImpl) Modules() []string {
+	var names = make([]string, 0, len(plugin.libs))
+	for _, lib := range plugin.libs {
+		names = append(names, lib.LName)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (plugin *luaPluginImpl) LoadByIo(reader io.ReadCloser, name string) (*lua.LFunction, error) {
 	if reader == nil {
 		return nil, errors.New("reader nil")
@@ -205,7 +398,22 @@ func (plugin *luaPluginImpl) LoadByIo(reader io.ReadCloser, name string) (*lua.L
 	defer func() {
 		_ = reader.Close()
 	}()
-	return plugin.GetVM().Load(reader, name)
+	var data, err = ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// 无法定位签名文件时以 name 作为脚本路径校验
+	if verifier := plugin.verifier(); verifier != nil {
+		if err = verifier.Verify(name, data); err != nil {
+			return nil, err
+		}
+	}
+	var fn *lua.LFunction
+	err = plugin.exec("plugin.load", func() (err error) {
+		fn, err = plugin.GetVM().Load(bytes.NewReader(data), name)
+		return err
+	})
+	return fn, err
 }
 
 func (plugin *luaPluginImpl) LoadLib(lib *core.LuaRegistryFunction, stateVm ...*lua.LState) *luaPluginImpl {
@@ -224,11 +432,31 @@ func (plugin *luaPluginImpl) LoadLib(lib *core.LuaRegistryFunction, stateVm ...*
 	state.Push(lua.LString(lib.LName))
 	state.Call(1, 0)
 	plugin.cache[lib.LName] = true
+	plugin.libs = append(plugin.libs, lib)
 	return plugin
 }
 
+func (plugin *luaPluginImpl) BootAt() time.Time {
+	return plugin.bootAt
+}
+
+// Close 等待 vm 空闲后释放
+func (plugin *luaPluginImpl) Close() {
+	if plugin == nil || plugin.lvm == nil {
+		return
+	}
+	var rt = plugin.Runtime()
+	if err := rt.Acquire(context.Background()); err == nil {
+		defer rt.Release()
+	}
+	plugin.destroy()
+}
+
 func (plugin *luaPluginImpl) destroy() {
 	runtime.SetFinalizer(plugin, nil)
+	if plugin.runtime != nil {
+		plugin.runtime.Close()
+	}
 	if plugin.lvm != nil {
 		plugin.lvm.Close()
 		plugin.lvm = nil
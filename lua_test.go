@@ -2,6 +2,8 @@ package plugins
 
 import (
 	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
 	"testing"
 )
 
@@ -48,3 +50,38 @@ func TestLuaPluginImpl_LoadFile(t *testing.T) {
 		t.Error(err2)
 	}
 }
+
+func TestLuaPluginImpl_Clone(t *testing.T) {
+	var (
+		checkouts = 0
+		plugin    = NewLua()
+	)
+	defer plugin.Close()
+	plugin.LoadLib(&core.LuaRegistryFunction{
+		LName: "checkout",
+		LFunction: func(L *lua.LState) int {
+			L.SetGlobal("checkout", L.NewFunction(func(L *lua.LState) int {
+				checkouts++
+				return 0
+			}))
+			return 0
+		},
+	})
+	if err := plugin.Define(`function double(n) return n * 2 end`); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.EvalExpr(`checkout()`); err != nil {
+		t.Fatal(err)
+	}
+	var clone, err = plugin.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	if checkouts != 1 {
+		t.Errorf("EvalExpr should not be replayed by Clone, checkout ran %d times", checkouts)
+	}
+	if err = clone.EvalExpr(`assert(double(21) == 42)`); err != nil {
+		t.Error(err)
+	}
+}
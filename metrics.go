@@ -0,0 +1,82 @@
+package plugins
+
+import (
+	"github.com/weblfe/plugin_lua/modules/metrics"
+	"time"
+)
+
+type (
+	// pluginMetrics 插件运行时的内置指标, 以 plugin 标签区分
+	pluginMetrics struct {
+		calls    *metrics.Family
+		errors   *metrics.Family
+		latency  *metrics.Family
+		reloads  *metrics.Family
+		poolSize *metrics.Family
+	}
+)
+
+const (
+	MetricCalls    = "lua_plugin_calls_total"
+	MetricErrors   = "lua_plugin_errors_total"
+	MetricLatency  = "lua_plugin_call_duration_seconds"
+	MetricReloads  = "lua_plugin_reloads_total"
+	MetricPoolSize = "lua_plugin_pool_size"
+)
+
+// newPluginMetrics 在 reg 中注册内置指标, 为空时使用 metrics.DefaultRegistry
+func newPluginMetrics(reg *metrics.Registry) *pluginMetrics {
+	if reg == nil {
+		reg = metrics.DefaultRegistry()
+	}
+	var m = new(pluginMetrics)
+	m.calls, _ = reg.Counter(MetricCalls, "Total number of plugin calls.", metrics.PluginLabel)
+	m.errors, _ = reg.Counter(MetricErrors, "Total number of failed plugin calls.", metrics.PluginLabel)
+	m.latency, _ = reg.Histogram(MetricLatency, "Plugin call latency in seconds.", nil, metrics.PluginLabel)
+	m.reloads, _ = reg.Counter(MetricReloads, "Total number of plugin reloads.", metrics.PluginLabel)
+	m.poolSize, _ = reg.Gauge(MetricPoolSize, "Number of VMs created by plugin pools.", metrics.PluginLabel)
+	return m
+}
+
+// registryOf 插件配置的注册表 (ModuleOptions["metrics"])
+func registryOf(plugin *luaPluginImpl) *metrics.Registry {
+	if reg, ok := plugin.Runtime().Option(metrics.Name).(*metrics.Registry); ok {
+		return reg
+	}
+	return nil
+}
+
+func (m *pluginMetrics) observe(plugin string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	if s, err := m.calls.With(plugin); err == nil {
+		s.Inc()
+	}
+	if s, err := m.latency.With(plugin); err == nil {
+		_ = s.Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		if s, err := m.errors.With(plugin); err == nil {
+			s.Inc()
+		}
+	}
+}
+
+func (m *pluginMetrics) reload(plugin string) {
+	if m == nil {
+		return
+	}
+	if s, err := m.reloads.With(plugin); err == nil {
+		s.Inc()
+	}
+}
+
+func (m *pluginMetrics) pool(plugin string, delta float64) {
+	if m == nil {
+		return
+	}
+	if s, err := m.poolSize.With(plugin); err == nil {
+		_ = s.Add(delta)
+	}
+}
@@ -0,0 +1,373 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// WritableFS 可写的文件系统, name 均为 io/fs 的相对路径格式
+	WritableFS interface {
+		iofs.StatFS
+		iofs.ReadDirFS
+		iofs.ReadFileFS
+		WriteFile(name string, data []byte, perm iofs.FileMode) error
+		MkdirAll(name string, perm iofs.FileMode) error
+		Remove(name string) error
+		RemoveAll(name string) error
+	}
+
+	// dirFS 以本地目录为根, 拒绝经由符号链接逃逸出根目录
+	dirFS struct {
+		root string
+	}
+
+	// MemFS 内存文件系统, 目录显式保存, 根目录 "." 总是存在
+	MemFS struct {
+		safe  sync.RWMutex
+		files map[string]*memEntry
+	}
+
+	memEntry struct {
+		data  []byte
+		mode  iofs.FileMode
+		mtime time.Time
+	}
+
+	memInfo struct {
+		name string
+		*memEntry
+	}
+
+	// memFile Open 返回的文件, 内容为打开时的快照
+	memFile struct {
+		info    *memInfo
+		data    *bytes.Reader
+		entries []iofs.DirEntry
+	}
+)
+
+var (
+	ErrPathEscape = errors.New("path escapes root")
+)
+
+// DirFS 以目录 root 为根的可写文件系统
+func DirFS(root string) (WritableFS, error) {
+	var abs, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return nil, err
+	}
+	return &dirFS{root: abs}, nil
+}
+
+// resolve 转换为本地路径, 已存在的部分解析符号链接后必须仍在根目录内
+func (d *dirFS) resolve(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	var (
+		full     = filepath.Join(d.root, filepath.FromSlash(name))
+		existing = full
+		rest     string
+	)
+	for {
+		var resolved, err = filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !within(d.root, resolved) {
+				return "", &iofs.PathError{Op: op, Path: name, Err: ErrPathEscape}
+			}
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, iofs.ErrNotExist) || existing == d.root {
+			return "", &iofs.PathError{Op: op, Path: name, Err: err}
+		}
+		// 悬空的符号链接, 写入时会跟随到未知位置
+		if _, err = os.Lstat(existing); err == nil {
+			return "", &iofs.PathError{Op: op, Path: name, Err: ErrPathEscape}
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+}
+
+func within(root, file string) bool {
+	return file == root || strings.HasPrefix(file, root+string(filepath.Separator))
+}
+
+func (d *dirFS) Open(name string) (iofs.File, error) {
+	var file, err = d.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+func (d *dirFS) Stat(name string) (iofs.FileInfo, error) {
+	var file, err = d.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(file)
+}
+
+func (d *dirFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	var file, err = d.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(file)
+}
+
+func (d *dirFS) ReadFile(name string) ([]byte, error) {
+	var file, err = d.resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file)
+}
+
+func (d *dirFS) WriteFile(name string, data []byte, perm iofs.FileMode) error {
+	var file, err = d.resolve("write", name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, perm)
+}
+
+func (d *dirFS) MkdirAll(name string, perm iofs.FileMode) error {
+	var file, err = d.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(file, perm)
+}
+
+func (d *dirFS) Remove(name string) error {
+	var file, err = d.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	if file == d.root {
+		return &iofs.PathError{Op: "remove", Path: name, Err: iofs.ErrPermission}
+	}
+	return os.Remove(file)
+}
+
+func (d *dirFS) RemoveAll(name string) error {
+	var file, err = d.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	if file == d.root {
+		return &iofs.PathError{Op: "remove", Path: name, Err: iofs.ErrPermission}
+	}
+	return os.RemoveAll(file)
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memEntry)}
+}
+
+// entry 查找 name, 须持有锁
+func (m *MemFS) entry(op, name string) (*memInfo, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return &memInfo{name: ".", memEntry: &memEntry{mode: iofs.ModeDir | dirPerm}}, nil
+	}
+	var e, ok = m.files[name]
+	if !ok {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+	}
+	return &memInfo{name: path.Base(name), memEntry: e}, nil
+}
+
+// children 目录 name 下的条目, 按名称排序, 须持有锁
+func (m *MemFS) children(name string) []iofs.DirEntry {
+	var entries []iofs.DirEntry
+	for file, e := range m.files {
+		if path.Dir(file) == name && file != name {
+			entries = append(entries, iofs.FileInfoToDirEntry(&memInfo{name: path.Base(file), memEntry: e}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+func (m *MemFS) Open(name string) (iofs.File, error) {
+	m.safe.RLock()
+	defer m.safe.RUnlock()
+	var info, err = m.entry("open", name)
+	if err != nil {
+		return nil, err
+	}
+	var file = &memFile{info: info, data: bytes.NewReader(info.data)}
+	if info.IsDir() {
+		file.entries = m.children(name)
+	}
+	return file, nil
+}
+
+func (m *MemFS) Stat(name string) (iofs.FileInfo, error) {
+	m.safe.RLock()
+	defer m.safe.RUnlock()
+	return m.entry("stat", name)
+}
+
+func (m *MemFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	m.safe.RLock()
+	defer m.safe.RUnlock()
+	var info, err = m.entry("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return m.children(name), nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.safe.RLock()
+	defer m.safe.RUnlock()
+	var info, err = m.entry("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &iofs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return append([]byte(nil), info.data...), nil
+}
+
+// WriteFile 父目录必须已存在
+func (m *MemFS) WriteFile(name string, data []byte, perm iofs.FileMode) error {
+	m.safe.Lock()
+	defer m.safe.Unlock()
+	if err := m.checkParent("write", name); err != nil {
+		return err
+	}
+	if e, ok := m.files[name]; ok && e.mode.IsDir() {
+		return &iofs.PathError{Op: "write", Path: name, Err: errors.New("is a directory")}
+	}
+	m.files[name] = &memEntry{data: append([]byte(nil), data...), mode: perm, mtime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm iofs.FileMode) error {
+	m.safe.Lock()
+	defer m.safe.Unlock()
+	if !iofs.ValidPath(name) {
+		return &iofs.PathError{Op: "mkdir", Path: name, Err: iofs.ErrInvalid}
+	}
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		if e, ok := m.files[dir]; ok {
+			if !e.mode.IsDir() {
+				return &iofs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+			}
+			continue
+		}
+		m.files[dir] = &memEntry{mode: iofs.ModeDir | perm, mtime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.safe.Lock()
+	defer m.safe.Unlock()
+	var e, ok = m.files[name]
+	if !ok {
+		return &iofs.PathError{Op: "remove", Path: name, Err: iofs.ErrNotExist}
+	}
+	if e.mode.IsDir() && len(m.children(name)) > 0 {
+		return &iofs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.safe.Lock()
+	defer m.safe.Unlock()
+	if name == "." {
+		return &iofs.PathError{Op: "remove", Path: name, Err: iofs.ErrPermission}
+	}
+	for file := range m.files {
+		if file == name || strings.HasPrefix(file, name+"/") {
+			delete(m.files, file)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) checkParent(op, name string) error {
+	if !iofs.ValidPath(name) || name == "." {
+		return &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	var dir = path.Dir(name)
+	if dir == "." {
+		return nil
+	}
+	var e, ok = m.files[dir]
+	if !ok {
+		return &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+	}
+	if !e.mode.IsDir() {
+		return &iofs.PathError{Op: op, Path: name, Err: fmt.Errorf("%s is not a directory", dir)}
+	}
+	return nil
+}
+
+func (i *memInfo) Name() string        { return i.name }
+func (i *memInfo) Size() int64         { return int64(len(i.data)) }
+func (i *memInfo) Mode() iofs.FileMode { return i.mode }
+func (i *memInfo) ModTime() time.Time  { return i.mtime }
+func (i *memInfo) IsDir() bool         { return i.mode.IsDir() }
+func (i *memInfo) Sys() interface{}    { return nil }
+
+func (f *memFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &iofs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	return f.data.Read(p)
+}
+
+// ReadDir 实现 fs.ReadDirFile, n <= 0 时返回剩余的全部条目
+func (f *memFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !f.info.IsDir() {
+		return nil, &iofs.PathError{Op: "readdir", Path: f.info.name, Err: errors.New("not a directory")}
+	}
+	if n <= 0 || n > len(f.entries) {
+		if n > 0 && len(f.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(f.entries)
+	}
+	var entries = f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
@@ -0,0 +1,313 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	iofs "io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Options 插件级配置, 通过 PluginOptions.ModuleOptions["fs"] 注入
+	Options struct {
+		// Roots 允许访问的根, lua 中以 "name:path" 指定, 省略 name 时使用第一个
+		Roots []*Root
+	}
+
+	// Root 可访问的根目录
+	Root struct {
+		Name string
+		// FS 实现 WritableFS 时可写, 否则只读
+		FS       iofs.FS
+		ReadOnly bool
+		// Quota 根目录内文件的总字节数上限, 0 不限制
+		Quota int64
+		// MaxFileSize 单个文件的字节数上限, 0 不限制
+		MaxFileSize int64
+
+		// safe 串行化写入与删除, used 为已用字节数, 首次写入时统计, 之后随写入与删除更新
+		safe    sync.Mutex
+		used    int64
+		counted bool
+	}
+)
+
+const (
+	dirPerm  iofs.FileMode = 0755
+	filePerm iofs.FileMode = 0644
+)
+
+var (
+	ErrNoRoot        = errors.New("no root configured")
+	ErrReadOnly      = errors.New("read-only root")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	Funcs = map[string]lua.LGFunction{
+		"read":   luaRead,
+		"write":  luaWrite,
+		"append": luaAppend,
+		"list":   luaList,
+		"stat":   luaStat,
+		"exists": luaExists,
+		"mkdir":  luaMkdir,
+		"remove": luaRemove,
+	}
+)
+
+// GetOptions 获取 L 所属插件的 fs 配置
+func GetOptions(L *lua.LState) *Options {
+	if opts, ok := core.GetRuntime(L).Option(Name).(*Options); ok && opts != nil {
+		return opts
+	}
+	return &Options{}
+}
+
+// Resolve 解析 "name:path", 返回根与清理后的相对路径, 拒绝 .. 越界
+// 仅当 name 为已配置的根时视为前缀, 否则整体作为第一个根下的路径
+func (opts *Options) Resolve(file string) (*Root, string, error) {
+	if len(opts.Roots) == 0 {
+		return nil, "", ErrNoRoot
+	}
+	var root = opts.Roots[0]
+	if i := strings.Index(file, ":"); i > 0 {
+		for _, r := range opts.Roots {
+			if r.Name == file[:i] {
+				root, file = r, file[i+1:]
+				break
+			}
+		}
+	}
+	var name = path.Clean(strings.TrimLeft(strings.ReplaceAll(file, "\\", "/"), "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return nil, "", &iofs.PathError{Op: "resolve", Path: file, Err: ErrPathEscape}
+	}
+	return root, name, nil
+}
+
+func (root *Root) writable(op, name string) (WritableFS, error) {
+	var w, ok = root.FS.(WritableFS)
+	if !ok || root.ReadOnly {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: ErrReadOnly}
+	}
+	return w, nil
+}
+
+// usage 根目录内文件的总字节数, 须持有 root.safe
+func (root *Root) usage() (int64, error) {
+	if root.counted {
+		return root.used, nil
+	}
+	var used, err = size(root.FS, ".")
+	if err != nil {
+		return 0, err
+	}
+	root.used, root.counted = used, true
+	return used, nil
+}
+
+// size name 的字节数, 目录为其中文件的总和, 不存在时为 0
+func size(fsys iofs.FS, name string) (int64, error) {
+	var total int64
+	var err = iofs.WalkDir(fsys, name, func(file string, d iofs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		var info, e = d.Info()
+		if e == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	if errors.Is(err, iofs.ErrNotExist) {
+		return 0, nil
+	}
+	return total, err
+}
+
+// Write 写入文件, append 为 true 时追加; 配额检查与写入在同一把锁内完成
+func (root *Root) Write(name string, data []byte, append bool) error {
+	var w, err = root.writable("write", name)
+	if err != nil {
+		return err
+	}
+	root.safe.Lock()
+	defer root.safe.Unlock()
+	var old []byte
+	if old, err = w.ReadFile(name); err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		return err
+	}
+	if append {
+		data = joinBytes(old, data)
+	}
+	var delta = int64(len(data) - len(old))
+	if root.MaxFileSize > 0 && int64(len(data)) > root.MaxFileSize {
+		return &iofs.PathError{Op: "write", Path: name, Err: fmt.Errorf("%w: file size %d > %d", ErrQuotaExceeded, len(data), root.MaxFileSize)}
+	}
+	if root.Quota > 0 {
+		var used, err = root.usage()
+		if err != nil {
+			return err
+		}
+		if used+delta > root.Quota {
+			return &iofs.PathError{Op: "write", Path: name, Err: fmt.Errorf("%w: %d + %d > %d bytes", ErrQuotaExceeded, used-int64(len(old)), len(data), root.Quota)}
+		}
+	}
+	if err = w.WriteFile(name, data, filePerm); err != nil {
+		return err
+	}
+	root.used += delta
+	return nil
+}
+
+// Remove 删除文件或空目录, recursive 为 true 时删除整个目录
+func (root *Root) Remove(name string, recursive bool) error {
+	var w, err = root.writable("remove", name)
+	if err != nil {
+		return err
+	}
+	root.safe.Lock()
+	defer root.safe.Unlock()
+	var removed int64
+	if root.counted {
+		if removed, err = size(root.FS, name); err != nil {
+			return err
+		}
+	}
+	if recursive {
+		err = w.RemoveAll(name)
+	} else {
+		err = w.Remove(name)
+	}
+	if err != nil {
+		return err
+	}
+	root.used -= removed
+	return nil
+}
+
+func joinBytes(a, b []byte) []byte {
+	var data = make([]byte, 0, len(a)+len(b))
+	return append(append(data, a...), b...)
+}
+
+func resolve(L *lua.LState) (*Root, string) {
+	var root, name, err = GetOptions(L).Resolve(L.CheckString(1))
+	if err != nil {
+		L.RaiseError("fs: %s", err.Error())
+	}
+	return root, name
+}
+
+func fail(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+func infoTable(L *lua.LState, info iofs.FileInfo) *lua.LTable {
+	var t = L.CreateTable(0, 5)
+	t.RawSetString("name", lua.LString(info.Name()))
+	t.RawSetString("size", lua.LNumber(info.Size()))
+	t.RawSetString("dir", lua.LBool(info.IsDir()))
+	t.RawSetString("mode", lua.LString(info.Mode().String()))
+	t.RawSetString("mtime", lua.LString(info.ModTime().Format(time.RFC3339)))
+	return t
+}
+
+// luaRead fs.read(path) string | nil, err
+func luaRead(L *lua.LState) int {
+	var root, name = resolve(L)
+	var data, err = iofs.ReadFile(root.FS, name)
+	if err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// luaWrite fs.write(path, data) true | nil, err
+func luaWrite(L *lua.LState) int {
+	var root, name = resolve(L)
+	if err := root.Write(name, []byte(L.CheckString(2)), false); err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// luaAppend fs.append(path, data) true | nil, err
+func luaAppend(L *lua.LState) int {
+	var root, name = resolve(L)
+	if err := root.Write(name, []byte(L.CheckString(2)), true); err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// luaList fs.list(path) {{name,size,dir,mode,mtime}, ...} | nil, err
+func luaList(L *lua.LState) int {
+	var root, name = resolve(L)
+	var entries, err = iofs.ReadDir(root.FS, name)
+	if err != nil {
+		return fail(L, err)
+	}
+	var t = L.CreateTable(len(entries), 0)
+	for _, entry := range entries {
+		var info, err = entry.Info()
+		if err != nil {
+			return fail(L, err)
+		}
+		t.Append(infoTable(L, info))
+	}
+	L.Push(t)
+	return 1
+}
+
+// luaStat fs.stat(path) {name,size,dir,mode,mtime} | nil, err
+func luaStat(L *lua.LState) int {
+	var root, name = resolve(L)
+	var info, err = iofs.Stat(root.FS, name)
+	if err != nil {
+		return fail(L, err)
+	}
+	L.Push(infoTable(L, info))
+	return 1
+}
+
+// luaExists fs.exists(path) bool
+func luaExists(L *lua.LState) int {
+	var root, name = resolve(L)
+	var _, err = iofs.Stat(root.FS, name)
+	L.Push(lua.LBool(err == nil))
+	return 1
+}
+
+// luaMkdir fs.mkdir(path) true | nil, err, 同时创建父目录
+func luaMkdir(L *lua.LState) int {
+	var root, name = resolve(L)
+	var w, err = root.writable("mkdir", name)
+	if err == nil {
+		err = w.MkdirAll(name, dirPerm)
+	}
+	if err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// luaRemove fs.remove(path [, recursive]) true | nil, err
+func luaRemove(L *lua.LState) int {
+	var root, name = resolve(L)
+	if err := root.Remove(name, L.OptBool(2, false)); err != nil {
+		return fail(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
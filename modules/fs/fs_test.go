@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func newState(opts *Options) *lua.LState {
+	var (
+		L  = lua.NewState()
+		rt = core.NewRuntime()
+	)
+	rt.Options = map[string]interface{}{Name: opts}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaFsTables())
+	return L
+}
+
+func TestModule(t *testing.T) {
+	var (
+		reports   = NewMemFS()
+		templates = fstest.MapFS{"page.html": {Data: []byte("<p>hi</p>")}}
+		L         = newState(&Options{Roots: []*Root{
+			{Name: "reports", FS: reports, Quota: 16},
+			{Name: "templates", FS: templates},
+		}})
+	)
+	defer L.Close()
+	var script = `
+local fs = require("fs")
+assert(fs.read("templates:page.html") == "<p>hi</p>")
+local _, err = fs.write("templates:page.html", "x")
+assert(string.find(err, "read%-only"), err)
+
+assert(fs.mkdir("daily/2024"))
+assert(fs.write("daily/2024/a.txt", "hello"))
+assert(fs.append("reports:daily/2024/a.txt", " world"))
+assert(fs.read("daily/2024/a.txt") == "hello world")
+assert(fs.exists("/daily/2024/a.txt") and not fs.exists("missing"))
+
+local info = assert(fs.stat("daily/2024/a.txt"))
+assert(info.size == 11 and not info.dir)
+local items = assert(fs.list("daily"))
+assert(#items == 1 and items[1].name == "2024" and items[1].dir)
+
+local _, err = fs.write("daily/b.txt", "more than quota")
+assert(string.find(err, "quota"), err)
+
+local _, err = fs.remove("daily")
+assert(err ~= nil)
+assert(fs.remove("daily", true))
+assert(not fs.exists("daily/2024/a.txt"))
+
+assert(not pcall(fs.read, "../secret"))
+assert(not pcall(fs.read, "a/../../secret"))
+assert(fs.read("unknown:file") == nil)
+assert(fs.write("a:b.txt", "x") and fs.exists("reports:a:b.txt"))
+`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		root    = filepath.Join(dir, "root")
+		outside = filepath.Join(dir, "outside")
+	)
+	_ = os.MkdirAll(root, os.ModePerm)
+	_ = os.MkdirAll(outside, os.ModePerm)
+	_ = os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip(err)
+	}
+	_ = os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+	var fsys, err = DirFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fsys.WriteFile("a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fsys.ReadFile("a.txt"); err != nil || string(data) != "a" {
+		t.Errorf("unexpected read %q %v", data, err)
+	}
+	if _, err = fsys.ReadFile("link/secret"); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("symlink escape should be rejected, got %v", err)
+	}
+	if err = fsys.WriteFile("link/new", []byte("x"), 0644); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("write through symlink should be rejected, got %v", err)
+	}
+	if err = fsys.WriteFile("dangling", []byte("x"), 0644); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("write through dangling symlink should be rejected, got %v", err)
+	}
+	if _, err = fsys.ReadFile("../outside/secret"); !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("traversal should be rejected, got %v", err)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	var fsys = NewMemFS()
+	if err := fsys.MkdirAll("a/b", dirPerm); err != nil {
+		t.Fatal(err)
+	}
+	_ = fsys.WriteFile("a/b/c.txt", []byte("c"), filePerm)
+	_ = fsys.WriteFile("d.txt", []byte("d"), filePerm)
+	if err := fstest.TestFS(fsys, "a/b/c.txt", "d.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuota_Concurrent(t *testing.T) {
+	var (
+		root = &Root{Name: "data", FS: NewMemFS(), Quota: 100}
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = root.Write("f"+strconv.Itoa(i), make([]byte, 10), false)
+		}(i)
+	}
+	wg.Wait()
+	var used, err = size(root.FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 100 || root.used != used {
+		t.Errorf("expected 100 bytes used, got %d (counter %d)", used, root.used)
+	}
+	var entries, _ = iofs.ReadDir(root.FS, ".")
+	if err = root.Remove(entries[0].Name(), false); err == nil {
+		err = root.Write(entries[0].Name(), make([]byte, 5), false)
+	}
+	if err != nil || root.used != 95 {
+		t.Errorf("unexpected usage %d after remove: %v", root.used, err)
+	}
+}
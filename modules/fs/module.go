@@ -0,0 +1,15 @@
+package fs
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "fs"
+)
+
+func NewLuaFsTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(Name, Funcs)
+		state.Push(mod)
+		return 1
+	}
+}
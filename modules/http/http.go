@@ -0,0 +1,322 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/json"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// Options 插件级配置, 通过 PluginOptions.ModuleOptions["http"] 注入
+	Options struct {
+		// AllowHosts 允许访问的主机: "api.local", "api.local:8080", "*.svc.local", "*" 允许全部
+		// 为空时拒绝所有请求
+		AllowHosts []string
+		// MaxBodySize 响应体的最大字节数, 0 使用 DefaultMaxBodySize
+		MaxBodySize int64
+		// Timeout 请求的默认超时, 0 使用 DefaultTimeout
+		Timeout time.Duration
+		// Client 为空时使用 nethttp.DefaultClient 的 Transport
+		Client *nethttp.Client
+	}
+
+	// Request lua 侧的 request{method,url,headers,body,timeout}, timeout 单位为毫秒
+	Request struct {
+		Method  string
+		URL     string
+		Headers map[string]string
+		Body    string
+		Timeout time.Duration
+	}
+
+	// Response lua 侧的 {status,headers,body}
+	Response struct {
+		Status  int
+		Headers nethttp.Header
+		Body    []byte
+	}
+)
+
+const (
+	DefaultMaxBodySize = 10 << 20
+	DefaultTimeout     = 30 * time.Second
+)
+
+var (
+	ErrHostNotAllowed = errors.New("host not allowed")
+	ErrBodyTooLarge   = errors.New("response body too large")
+
+	Funcs = map[string]lua.LGFunction{
+		"request":   luaRequest,
+		"get":       luaGet,
+		"post":      luaPost,
+		"get_json":  luaGetJson,
+		"post_json": luaPostJson,
+	}
+)
+
+// GetOptions 获取 L 所属插件的 http 配置
+func GetOptions(L *lua.LState) *Options {
+	if opts, ok := core.GetRuntime(L).Option(Name).(*Options); ok && opts != nil {
+		return opts
+	}
+	return &Options{}
+}
+
+// Allowed 检查主机 (可带端口) 是否在允许列表中
+func (opts *Options) Allowed(host string) bool {
+	var hostname = host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, pattern := range opts.AllowHosts {
+		switch {
+		case pattern == "*", strings.EqualFold(pattern, host), strings.EqualFold(pattern, hostname):
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(strings.ToLower(hostname), strings.ToLower(pattern[1:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (opts *Options) maxBodySize() int64 {
+	if opts.MaxBodySize > 0 {
+		return opts.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+func (opts *Options) timeout(request *Request) time.Duration {
+	switch {
+	case request.Timeout > 0:
+		return request.Timeout
+	case opts.Timeout > 0:
+		return opts.Timeout
+	}
+	return DefaultTimeout
+}
+
+// client 重定向的目标同样需要在允许列表中
+func (opts *Options) client() *nethttp.Client {
+	var client = nethttp.Client{}
+	if opts.Client != nil {
+		client = *opts.Client
+	}
+	var checkRedirect = client.CheckRedirect
+	client.CheckRedirect = func(req *nethttp.Request, via []*nethttp.Request) error {
+		if !opts.Allowed(req.URL.Host) {
+			return fmt.Errorf("redirect to %s: %w", req.URL.Host, ErrHostNotAllowed)
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &client
+}
+
+// Do 发起请求, ctx 取消或超时时请求中止
+func Do(ctx context.Context, opts *Options, request *Request) (*Response, error) {
+	var target, err = url.Parse(request.URL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	if !opts.Allowed(target.Host) {
+		return nil, fmt.Errorf("%s: %w", target.Host, ErrHostNotAllowed)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout(request))
+	defer cancel()
+	var method = strings.ToUpper(request.Method)
+	if method == "" {
+		method = nethttp.MethodGet
+	}
+	var body io.Reader
+	if request.Body != "" {
+		body = strings.NewReader(request.Body)
+	}
+	req, err := nethttp.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	trace.Inject(ctx, req.Header)
+	for k, v := range request.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := opts.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var limit = opts.maxBodySize()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: limit %d bytes", ErrBodyTooLarge, limit)
+	}
+	return &Response{Status: resp.StatusCode, Headers: resp.Header, Body: data}, nil
+}
+
+// ParseRequest 读取 lua 侧的请求 table
+func ParseRequest(L *lua.LState, t *lua.LTable) *Request {
+	var request = &Request{
+		Method:  lua.LVAsString(t.RawGetString("method")),
+		URL:     lua.LVAsString(t.RawGetString("url")),
+		Body:    lua.LVAsString(t.RawGetString("body")),
+		Headers: make(map[string]string),
+	}
+	if n, ok := t.RawGetString("timeout").(lua.LNumber); ok && n > 0 {
+		request.Timeout = time.Duration(float64(n) * float64(time.Millisecond))
+	}
+	if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+		// 统一为规范形式, 避免大小写不同的同名 header 以随机顺序覆盖
+		core.ForEach(L, headers, func(k lua.LValue, v lua.LValue) {
+			request.Headers[nethttp.CanonicalHeaderKey(k.String())] = v.String()
+		})
+	}
+	return request
+}
+
+// ToLua 转换为 {status,headers,body}, 多值的 header 以 ", " 连接
+func (resp *Response) ToLua(L *lua.LState) *lua.LTable {
+	var (
+		t       = L.NewTable()
+		headers = L.NewTable()
+		keys    = make([]string, 0, len(resp.Headers))
+	)
+	for k := range resp.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		headers.RawSetString(k, lua.LString(strings.Join(resp.Headers[k], ", ")))
+	}
+	t.RawSetString("status", lua.LNumber(resp.Status))
+	t.RawSetString("headers", headers)
+	t.RawSetString("body", lua.LString(resp.Body))
+	return t
+}
+
+func do(L *lua.LState, request *Request) (resp *Response, err error) {
+	var ctx, span = trace.StartL(L, "http.request")
+	span.SetAttribute("http.method", strings.ToUpper(request.Method)).SetAttribute("http.url", request.URL)
+	defer func() {
+		if resp != nil {
+			span.SetAttribute("http.status", resp.Status)
+		}
+		span.Finish(err)
+	}()
+	return Do(ctx, GetOptions(L), request)
+}
+
+func fail(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// luaRequest http.request{method,url,headers,body,timeout} response | nil, err
+func luaRequest(L *lua.LState) int {
+	var resp, err = do(L, ParseRequest(L, L.CheckTable(1)))
+	if err != nil {
+		return fail(L, err)
+	}
+	L.Push(resp.ToLua(L))
+	return 1
+}
+
+// luaGet http.get(url [, request]) response | nil, err
+func luaGet(L *lua.LState) int {
+	var request = ParseRequest(L, L.OptTable(2, L.NewTable()))
+	request.Method, request.URL = nethttp.MethodGet, L.CheckString(1)
+	var resp, err = do(L, request)
+	if err != nil {
+		return fail(L, err)
+	}
+	L.Push(resp.ToLua(L))
+	return 1
+}
+
+// luaPost http.post(url, body [, request]) response | nil, err
+func luaPost(L *lua.LState) int {
+	var request = ParseRequest(L, L.OptTable(3, L.NewTable()))
+	request.Method, request.URL, request.Body = nethttp.MethodPost, L.CheckString(1), L.OptString(2, "")
+	var resp, err = do(L, request)
+	if err != nil {
+		return fail(L, err)
+	}
+	L.Push(resp.ToLua(L))
+	return 1
+}
+
+// luaGetJson http.get_json(url [, request]) value, response | nil, err
+func luaGetJson(L *lua.LState) int {
+	var request = ParseRequest(L, L.OptTable(2, L.NewTable()))
+	request.Method, request.URL = nethttp.MethodGet, L.CheckString(1)
+	return doJson(L, request)
+}
+
+// luaPostJson http.post_json(url, value [, request]) value, response | nil, err
+func luaPostJson(L *lua.LState) int {
+	var request = ParseRequest(L, L.OptTable(3, L.NewTable()))
+	var body, err = json.Encode(L, L.CheckAny(2), json.Options{})
+	if err != nil {
+		return fail(L, err)
+	}
+	request.Method, request.URL, request.Body = nethttp.MethodPost, L.CheckString(1), string(body)
+	if _, ok := request.Headers["Content-Type"]; !ok {
+		request.Headers["Content-Type"] = "application/json"
+	}
+	return doJson(L, request)
+}
+
+// doJson 2xx 以外的状态码视为错误, 响应体按 json 解码
+func doJson(L *lua.LState, request *Request) int {
+	if _, ok := request.Headers["Accept"]; !ok {
+		request.Headers["Accept"] = "application/json"
+	}
+	var resp, err = do(L, request)
+	if err != nil {
+		return fail(L, err)
+	}
+	if resp.Status < 200 || resp.Status > 299 {
+		return fail(L, fmt.Errorf("%s %s: status %d", request.Method, request.URL, resp.Status))
+	}
+	var value = lua.LValue(lua.LNil)
+	if len(bytes.TrimSpace(resp.Body)) > 0 {
+		if value, err = json.Decode(L, resp.Body, json.Options{}); err != nil {
+			return fail(L, err)
+		}
+	}
+	L.Push(value)
+	L.Push(resp.ToLua(L))
+	return 2
+}
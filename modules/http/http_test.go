@@ -0,0 +1,116 @@
+package http
+
+import (
+	"context"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/json"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newState(opts *Options) *lua.LState {
+	var (
+		L  = lua.NewState()
+		rt = core.NewRuntime()
+	)
+	rt.Options = map[string]interface{}{Name: opts}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaHttpTables())
+	L.PreloadModule(json.Name, json.NewLuaJsonTables())
+	return L
+}
+
+func TestRequest(t *testing.T) {
+	var server = httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			var body, _ = ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Set("X-Token", r.Header.Get("X-Token"))
+			_, _ = w.Write(body)
+		case "/headers":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"accept":"` + r.Header.Get("Accept") + `","type":"` + r.Header.Get("Content-Type") + `"}`))
+		case "/json":
+			var body, _ = ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"got":` + string(body) + `}`))
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("x", 2048)))
+		case "/redirect":
+			nethttp.Redirect(w, r, "http://forbidden.local/", nethttp.StatusFound)
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+	var target, _ = url.Parse(server.URL)
+	var L = newState(&Options{AllowHosts: []string{target.Hostname()}, MaxBodySize: 1024})
+	defer L.Close()
+	L.SetGlobal("base", lua.LString(server.URL))
+	var script = `
+local http = require("http")
+local resp = assert(http.request{method = "PUT", url = base .. "/echo", headers = {["X-Token"] = "t"}, body = "hello"})
+assert(resp.status == 200 and resp.body == "hello")
+assert(resp.headers["X-Method"] == "PUT" and resp.headers["X-Token"] == "t")
+
+local value = assert(http.post_json(base .. "/json", {n = 1}))
+assert(value.got.n == 1)
+for i = 1, 10 do
+	local got = assert(http.post_json(base .. "/headers", {}, {headers = {accept = "text/plain", ["content-type"] = "application/vnd.api+json"}}))
+	assert(got.accept == "text/plain" and got.type == "application/vnd.api+json", got.accept .. " " .. got.type)
+end
+
+local _, err = http.get(base .. "/large")
+assert(string.find(err, "too large"), err)
+local _, err = http.get("http://forbidden.local/")
+assert(string.find(err, "not allowed"), err)
+local _, err = http.get(base .. "/redirect")
+assert(string.find(err, "not allowed"), err)
+local _, err = http.get(base .. "/slow", {timeout = 50})
+assert(err ~= nil)
+`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	// 执行上下文取消时请求中止
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	var start = time.Now()
+	// 请求返回错误后 vm 同样因上下文结束而中止
+	if err := L.DoString(`require("http").get(base .. "/slow")`); err == nil {
+		t.Error("expect context error")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("request should be canceled with the context")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	var opts = &Options{AllowHosts: []string{"api.local:8080", "*.svc.local"}}
+	for host, expect := range map[string]bool{
+		"api.local:8080": true,
+		"api.local:9090": false,
+		"a.svc.local":    true,
+		"svc.local":      false,
+		"other.local":    false,
+	} {
+		if opts.Allowed(host) != expect {
+			t.Errorf("%s: expect %v", host, expect)
+		}
+	}
+	if (&Options{}).Allowed("api.local") {
+		t.Error("empty allow-list should deny all hosts")
+	}
+}
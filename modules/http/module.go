@@ -0,0 +1,15 @@
+package http
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "http"
+)
+
+func NewLuaHttpTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(Name, Funcs)
+		state.Push(mod)
+		return 1
+	}
+}
@@ -2,8 +2,19 @@ package modules
 
 import (
 	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/fs"
+	"github.com/weblfe/plugin_lua/modules/http"
+	"github.com/weblfe/plugin_lua/modules/json"
 	"github.com/weblfe/plugin_lua/modules/logger"
+	"github.com/weblfe/plugin_lua/modules/metrics"
 	"github.com/weblfe/plugin_lua/modules/migrate"
+	"github.com/weblfe/plugin_lua/modules/regex"
+	"github.com/weblfe/plugin_lua/modules/shared"
+	"github.com/weblfe/plugin_lua/modules/sql"
+	"github.com/weblfe/plugin_lua/modules/task"
+	"github.com/weblfe/plugin_lua/modules/timer"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"github.com/yuin/gopher-lua"
 )
 
 var (
@@ -21,8 +32,60 @@ func init() {
 				LName:     migrate.Name,
 				LFunction: migrate.NewLuaMigrateTables(),
 			},
+			{
+				LName:     json.Name,
+				LFunction: json.NewLuaJsonTables(),
+			},
+			{
+				LName:     http.Name,
+				LFunction: http.NewLuaHttpTables(),
+			},
+			{
+				LName:     sql.Name,
+				LFunction: sql.NewLuaSqlTables(),
+			},
+			{
+				LName:     fs.Name,
+				LFunction: fs.NewLuaFsTables(),
+			},
+			{
+				LName:     regex.Name,
+				LFunction: regex.NewLuaRegexTables(),
+			},
+			{
+				LName:     timer.Name,
+				LFunction: timer.NewLuaTimerTables(),
+			},
+			{
+				LName:     shared.Name,
+				LFunction: shared.NewLuaSharedTables(),
+			},
+			{
+				LName:     task.Name,
+				LFunction: task.NewLuaTaskTables(),
+			},
+			{
+				LName:     metrics.Name,
+				LFunction: metrics.NewLuaMetricsTables(),
+			},
+			{
+				LName:     trace.Name,
+				LFunction: trace.NewLuaTraceTables(),
+			},
 		}
 	}
+	task.SetStateFactory(newTaskState)
+}
+
+// newTaskState task 使用的 vm, 预加载全部模块
+func newTaskState() *lua.LState {
+	var state = lua.NewState()
+	for _, lib := range _modules {
+		state.Push(state.NewFunction(lib.LFunction))
+		state.Push(lua.LString(lib.LName))
+		state.Call(1, 0)
+	}
+	return state
 }
 
 func GetModules() []*core.LuaRegistryFunction {
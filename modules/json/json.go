@@ -0,0 +1,393 @@
+package json
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// Options 编解码选项, lua 侧以 table 传入: {pretty=, indent=, exact=, strict=}
+	Options struct {
+		// Pretty 缩进输出, Indent 为空时使用两个空格
+		Pretty bool
+		Indent string
+		// Exact 解码时超出 2^53 的整数保留为字符串, 避免精度丢失
+		Exact bool
+		// Strict 解码时拒绝重复的 key 与非法 utf-8
+		Strict bool
+	}
+
+	// Error 编解码错误, 解码错误带有输入中的字节偏移
+	Error struct {
+		Offset int64
+		Path   string
+		Msg    string
+	}
+
+	decoder struct {
+		dec  *stdjson.Decoder
+		data []byte
+		opts Options
+	}
+
+	nullValue struct{}
+)
+
+const (
+	arrayMetaName  = "json.array"
+	objectMetaName = "json.object"
+	maxExactInt    = 1 << 53
+)
+
+var (
+	// Null json.null 哨兵, 对应 go 的 nil
+	Null = &lua.LUserData{Value: nullValue{}}
+
+	Funcs = map[string]lua.LGFunction{
+		"encode": luaEncode,
+		"decode": luaDecode,
+		"pretty": luaPretty,
+		"stream": luaStream,
+		"array":  luaArray,
+		"object": luaObject,
+	}
+)
+
+func (e *Error) Error() string {
+	switch {
+	case e.Path != "":
+		return fmt.Sprintf("json: %s: %s", e.Path, e.Msg)
+	case e.Offset >= 0:
+		return fmt.Sprintf("json: offset %d: %s", e.Offset, e.Msg)
+	}
+	return "json: " + e.Msg
+}
+
+func (nullValue) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+func (nullValue) String() string {
+	return "null"
+}
+
+// Codec json 使用的 go/lua 转换规则: json.null 对应 nil, 空 table 通过 json.array/json.object 标记区分
+func Codec(L *lua.LState) *core.Codec {
+	var (
+		array  = L.NewTypeMetatable(arrayMetaName)
+		object = L.NewTypeMetatable(objectMetaName)
+	)
+	return &core.Codec{
+		Null: Null,
+		Kind: func(t *lua.LTable) core.TableKind {
+			switch t.Metatable {
+			case array:
+				return core.TableArray
+			case object:
+				return core.TableObject
+			}
+			return core.TableAuto
+		},
+		Mark: func(L *lua.LState, t *lua.LTable, kind core.TableKind) {
+			// 只有空 table 无法从内容判断类型
+			if key, _ := t.Next(lua.LNil); key != lua.LNil {
+				return
+			}
+			if kind == core.TableArray {
+				L.SetMetatable(t, array)
+			} else {
+				L.SetMetatable(t, object)
+			}
+		},
+	}
+}
+
+// Encode 将 lua 值编码为 json, 环引用与不支持的类型返回带路径的错误
+func Encode(L *lua.LState, v lua.LValue, opts Options) ([]byte, error) {
+	var value, err = Codec(L).ToGo(v)
+	if err != nil {
+		var codecErr *core.CodecError
+		if errors.As(err, &codecErr) {
+			var path = codecErr.Path
+			if path == "" {
+				path = "$"
+			}
+			return nil, &Error{Offset: -1, Path: path, Msg: codecErr.Reason}
+		}
+		return nil, err
+	}
+	var (
+		buf     = bytes.NewBuffer(nil)
+		encoder = stdjson.NewEncoder(buf)
+	)
+	encoder.SetEscapeHTML(false)
+	if opts.Pretty {
+		var indent = opts.Indent
+		if indent == "" {
+			indent = "  "
+		}
+		encoder.SetIndent("", indent)
+	}
+	if err = encoder.Encode(value); err != nil {
+		return nil, &Error{Offset: -1, Msg: strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Decode 解码单个 json 值, 值之后除空白外不允许有其他内容
+func Decode(L *lua.LState, data []byte, opts Options) (lua.LValue, error) {
+	if err := checkUTF8(data, opts); err != nil {
+		return lua.LNil, err
+	}
+	var d = newDecoder(data, opts)
+	var value, err = d.value()
+	if err != nil {
+		return lua.LNil, err
+	}
+	if err = d.eof(); err != nil {
+		return lua.LNil, err
+	}
+	return Codec(L).ToLua(L, value), nil
+}
+
+func newDecoder(data []byte, opts Options) *decoder {
+	var dec = stdjson.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return &decoder{dec: dec, data: data, opts: opts}
+}
+
+func checkUTF8(data []byte, opts Options) error {
+	if !opts.Strict || utf8.Valid(data) {
+		return nil
+	}
+	for offset := 0; offset < len(data); {
+		var r, size = utf8.DecodeRune(data[offset:])
+		if r == utf8.RuneError && size <= 1 {
+			return &Error{Offset: int64(offset), Msg: "invalid utf-8"}
+		}
+		offset += size
+	}
+	return nil
+}
+
+func (d *decoder) value() (interface{}, error) {
+	var offset = d.offset()
+	var token, err = d.dec.Token()
+	if err != nil {
+		return nil, d.error(offset, err)
+	}
+	switch v := token.(type) {
+	case stdjson.Delim:
+		switch v {
+		case '[':
+			return d.array()
+		case '{':
+			return d.object()
+		}
+		return nil, &Error{Offset: offset, Msg: fmt.Sprintf("unexpected %q", rune(v))}
+	case stdjson.Number:
+		return d.number(offset, v)
+	}
+	return token, nil
+}
+
+func (d *decoder) array() (interface{}, error) {
+	var arr = make([]interface{}, 0)
+	for d.dec.More() {
+		var item, err = d.value()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, item)
+	}
+	return arr, d.end()
+}
+
+func (d *decoder) object() (interface{}, error) {
+	var m = make(map[string]interface{})
+	for d.dec.More() {
+		var offset = d.offset()
+		var token, err = d.dec.Token()
+		if err != nil {
+			return nil, d.error(offset, err)
+		}
+		var key, _ = token.(string)
+		if _, ok := m[key]; ok && d.opts.Strict {
+			return nil, &Error{Offset: offset, Msg: fmt.Sprintf("duplicate key %q", key)}
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, d.end()
+}
+
+func (d *decoder) end() error {
+	var offset = d.offset()
+	if _, err := d.dec.Token(); err != nil {
+		return d.error(offset, err)
+	}
+	return nil
+}
+
+// eof 顶层值之后只允许空白
+func (d *decoder) eof() error {
+	var offset = d.offset()
+	if _, err := d.dec.Token(); err != io.EOF {
+		return &Error{Offset: offset, Msg: "unexpected data after top-level value"}
+	}
+	return nil
+}
+
+// offset 下一个 token 的位置: InputOffset 指向上一个 token 之后, 跳过空白与分隔符
+func (d *decoder) offset() int64 {
+	var offset = d.dec.InputOffset()
+	for ; offset < int64(len(d.data)); offset++ {
+		switch d.data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func (d *decoder) number(offset int64, n stdjson.Number) (interface{}, error) {
+	var literal = n.String()
+	if d.opts.Exact && !strings.ContainsAny(literal, ".eE") {
+		var i, err = strconv.ParseInt(literal, 10, 64)
+		if err != nil || i > maxExactInt || i < -maxExactInt {
+			return literal, nil
+		}
+	}
+	var f, err = n.Float64()
+	if err != nil {
+		return nil, &Error{Offset: offset, Msg: fmt.Sprintf("invalid number %s", literal)}
+	}
+	return f, nil
+}
+
+func (d *decoder) error(offset int64, err error) error {
+	var syntax *stdjson.SyntaxError
+	switch {
+	case errors.As(err, &syntax):
+		return &Error{Offset: syntax.Offset, Msg: strings.TrimPrefix(syntax.Error(), "json: ")}
+	case err == io.EOF, err == io.ErrUnexpectedEOF:
+		return &Error{Offset: d.dec.InputOffset(), Msg: "unexpected end of input"}
+	}
+	return &Error{Offset: offset, Msg: err.Error()}
+}
+
+// ParseOptions 读取 lua 侧的选项 table
+func ParseOptions(v lua.LValue) Options {
+	var (
+		opts     Options
+		table, _ = v.(*lua.LTable)
+	)
+	if table == nil {
+		return opts
+	}
+	opts.Pretty = lua.LVAsBool(table.RawGetString("pretty"))
+	opts.Exact = lua.LVAsBool(table.RawGetString("exact"))
+	opts.Strict = lua.LVAsBool(table.RawGetString("strict"))
+	if indent, ok := table.RawGetString("indent").(lua.LString); ok {
+		opts.Indent = string(indent)
+		opts.Pretty = true
+	}
+	return opts
+}
+
+// luaEncode json.encode(value [, options]) string | nil, err
+func luaEncode(L *lua.LState) int {
+	var data, err = Encode(L, L.CheckAny(1), ParseOptions(L.Get(2)))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// luaPretty json.pretty(value [, indent]) string | nil, err
+func luaPretty(L *lua.LState) int {
+	var data, err = Encode(L, L.CheckAny(1), Options{Pretty: true, Indent: L.OptString(2, "")})
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// luaDecode json.decode(str [, options]) value | nil, err
+func luaDecode(L *lua.LState) int {
+	var value, err = Decode(L, []byte(L.CheckString(1)), ParseOptions(L.Get(2)))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(value)
+	return 1
+}
+
+// luaStream json.stream(str [, options]) iterator
+// 依次解码连续的多个 json 值 (如 NDJSON), 解码失败时抛出带偏移的错误
+//
+//	for i, v in json.stream(lines) do ... end
+func luaStream(L *lua.LState) int {
+	var (
+		data  = []byte(L.CheckString(1))
+		opts  = ParseOptions(L.Get(2))
+		d     = newDecoder(data, opts)
+		codec = Codec(L)
+		index = 0
+	)
+	if err := checkUTF8(data, opts); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		if !d.dec.More() {
+			if err := d.eof(); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			return 0
+		}
+		var value, err = d.value()
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		index++
+		L.Push(lua.LNumber(index))
+		L.Push(codec.ToLua(L, value))
+		return 2
+	}))
+	return 1
+}
+
+// luaArray json.array([t]) 标记 table 编码为数组
+func luaArray(L *lua.LState) int {
+	return mark(L, arrayMetaName)
+}
+
+// luaObject json.object([t]) 标记 table 编码为对象
+func luaObject(L *lua.LState) int {
+	return mark(L, objectMetaName)
+}
+
+func mark(L *lua.LState, name string) int {
+	var t = L.OptTable(1, L.NewTable())
+	L.SetMetatable(t, L.NewTypeMetatable(name))
+	L.Push(t)
+	return 1
+}
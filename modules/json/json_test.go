@@ -0,0 +1,70 @@
+package json
+
+import (
+	"github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+)
+
+func newState() *lua.LState {
+	var L = lua.NewState()
+	L.PreloadModule(Name, NewLuaJsonTables())
+	return L
+}
+
+func TestEncodeDecode(t *testing.T) {
+	var L = newState()
+	defer L.Close()
+	var script = `
+local json = require("json")
+assert(json.encode({1, 2, 3}) == "[1,2,3]")
+assert(json.encode({b = 1, a = "x"}) == '{"a":"x","b":1}')
+assert(json.encode(json.array()) == "[]")
+assert(json.encode({}) == "{}")
+assert(json.encode({a = json.null}) == '{"a":null}')
+assert(json.pretty({a = {1}}) == '{\n  "a": [\n    1\n  ]\n}')
+
+local v = json.decode('{"a": [], "b": {}, "c": null, "d": 1.5}')
+assert(v.c == json.null and v.d == 1.5)
+assert(json.encode(v) == '{"a":[],"b":{},"c":null,"d":1.5}')
+
+local big = json.decode('{"id": 9007199254740993}', {exact = true})
+assert(big.id == "9007199254740993")
+assert(type(json.decode('9007199254740993')) == "number")
+
+local cyclic = {}
+cyclic.self = cyclic
+local _, err = json.encode(cyclic)
+assert(string.find(err, "cycle"), err)
+
+local _, err = json.decode('{"a": 1,}')
+assert(string.find(err, "offset 8"), err)
+local _, err = json.decode('{"a": 1} x')
+assert(string.find(err, "offset 9"), err)
+local _, err = json.decode('{"a": 1, "a": 2}', {strict = true})
+assert(string.find(err, "offset 9") and string.find(err, "duplicate"), err)
+assert(json.decode('{"a": 1, "a": 2}').a == 2)
+
+local items = {}
+for i, item in json.stream('{"n": 1}\n{"n": 2}\n[3]') do
+	items[i] = item
+end
+assert(#items == 3 and items[2].n == 2 and items[3][1] == 3)
+assert(not pcall(function() for _ in json.stream('1 ]') do end end))
+`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeOffset(t *testing.T) {
+	var L = newState()
+	defer L.Close()
+	var _, err = Decode(L, []byte("[1, 2, tru]"), Options{})
+	if err == nil || !strings.Contains(err.Error(), "offset") {
+		t.Errorf("expect error with offset, got %v", err)
+	}
+	if _, err = Decode(L, []byte("\"\xff\""), Options{Strict: true}); err == nil || err.(*Error).Offset != 1 {
+		t.Errorf("expect invalid utf-8 at offset 1, got %v", err)
+	}
+}
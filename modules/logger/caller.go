@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+)
+
+type (
+	// callerFormatter 将 lua 调用位置字段改写为消息前缀
+	callerFormatter struct {
+		logrus.Formatter
+	}
+)
+
+const (
+	CallerNone   = "none"
+	CallerFields = "fields"
+	CallerPrefix = "prefix"
+
+	FieldLuaFile = "lua_file"
+	FieldLuaLine = "lua_line"
+	FieldLuaFunc = "lua_func"
+)
+
+// Caller 获取 lua 调用栈第 depth 层 (1 为直接调用 logger 的函数) 的源文件, 行号与函数名
+func Caller(L *lua.LState, depth int) (string, int, string, bool) {
+	if L == nil {
+		return "", 0, "", false
+	}
+	var dbg, ok = L.GetStack(depth)
+	if !ok {
+		return "", 0, "", false
+	}
+	if _, err := L.GetInfo("Sln", dbg, lua.LNil); err != nil {
+		return "", 0, "", false
+	}
+	return dbg.Source, dbg.CurrentLine, dbg.Name, true
+}
+
+// entryL 附加字段, 插件名与 lua 调用位置 (已启用时) 的日志条目
+func (l *LuaFunctionTable) entryL(L *lua.LState) *logrus.Entry {
+	var entry = pluginEntry(L, l.entry())
+	if l.caller == "" || l.caller == CallerNone {
+		return entry
+	}
+	var depth = l.callerDepth
+	if depth <= 0 {
+		depth = 1
+	}
+	if file, line, name, ok := Caller(L, depth); ok {
+		var fields = logrus.Fields{FieldLuaFile: file, FieldLuaLine: line}
+		if name != "" {
+			fields[FieldLuaFunc] = name
+		}
+		entry = entry.WithFields(fields)
+	}
+	return entry
+}
+
+func (f *callerFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if file, ok := entry.Data[FieldLuaFile]; ok {
+		var prefix = fmt.Sprintf("%v:%v", file, entry.Data[FieldLuaLine])
+		if name, ok := entry.Data[FieldLuaFunc]; ok {
+			prefix += fmt.Sprintf(" %v", name)
+		}
+		entry.Message = prefix + ": " + entry.Message
+		delete(entry.Data, FieldLuaFile)
+		delete(entry.Data, FieldLuaLine)
+		delete(entry.Data, FieldLuaFunc)
+	}
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+)
+
+func TestCaller(t *testing.T) {
+	var cases = []struct {
+		options  map[string]string
+		expected string
+	}{
+		{map[string]string{"format": "json", "caller": "fields"}, `"lua_file":"orders.lua","lua_func":"handler","lua_line":3`},
+		{map[string]string{"format": "json", "caller": "prefix"}, `"msg":"orders.lua:3 handler: created"`},
+		{map[string]string{"format": "json", "caller": "fields", "caller_depth": "2"}, `"lua_line":8`},
+		{map[string]string{"format": "json"}, `"msg":"created"`},
+	}
+	for _, c := range cases {
+		var opts, err = ParseOptions(c.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			L      = lua.NewState()
+			buf    bytes.Buffer
+			logger *LuaFunctionTable
+		)
+		logger, _ = New(opts)
+		logger.logger.Out = &buf
+		L.SetGlobal("log", logger.Table(L))
+		var fn, loadErr = L.Load(strings.NewReader(`
+local function handler()
+	log.info("created")
+end
+local function audit(msg)
+	log.logInfo(msg)
+end
+handler()
+audit("audited")
+`), "orders.lua")
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		}
+		L.Push(fn)
+		if err = L.PCall(0, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		L.Close()
+		var lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 || !strings.Contains(lines[0]+lines[1], c.expected) {
+			t.Errorf("%v: expected %s in %s", c.options, c.expected, buf.String())
+		}
+		var entry map[string]interface{}
+		_ = json.Unmarshal([]byte(lines[0]), &entry)
+		if c.options["caller"] == "prefix" && entry[FieldLuaFile] != nil {
+			t.Errorf("prefix mode should not keep caller fields: %v", entry)
+		}
+	}
+	if _, err := ParseOptions(map[string]string{"caller": "stack"}); err == nil {
+		t.Error("expected unknown caller mode error")
+	}
+}
@@ -0,0 +1,294 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// luaHook logger.addHook 注册的 lua 回调, 只在持有所属 vm 执行权时执行
+	luaHook struct {
+		id     uint64
+		levels map[logrus.Level]bool
+		fn     *lua.LFunction
+		L      *lua.LState
+		owner  *core.Runtime
+		// running hook 执行中; 此时只有执行 hook 的 vm 能再次进入, 因此为该 hook 自身产生的日志
+		running int32
+	}
+
+	// hookSet logger 及其子 logger 共用的 hooks
+	hookSet struct {
+		safe   sync.RWMutex
+		seq    uint64
+		hooks  []*luaHook
+		queues map[*core.Runtime]*hookQueue
+	}
+
+	// hookQueue hooks 所属 vm 忙碌时其他 vm 的日志在此排队, 由一个 goroutine 在获得执行权后依次执行 hooks 并输出
+	hookQueue struct {
+		safe    sync.Mutex
+		jobs    []func(L *lua.LState)
+		running bool
+	}
+)
+
+var (
+	// HookQueueSize 每个 vm 排队等待 hooks 的日志上限, 超出时丢弃 (不跳过 hooks 直接输出)
+	HookQueueSize = 1024
+)
+
+// add 注册 hook, 所属 vm 关闭时移除
+func (s *hookSet) add(hook *luaHook) uint64 {
+	s.safe.Lock()
+	s.seq++
+	hook.id = s.seq
+	s.hooks = append(s.hooks, hook)
+	s.safe.Unlock()
+	var id = hook.id
+	hook.owner.OnClose(func() {
+		s.remove(id)
+	})
+	return id
+}
+
+func (s *hookSet) remove(id uint64) bool {
+	s.safe.Lock()
+	defer s.safe.Unlock()
+	for i, hook := range s.hooks {
+		if hook.id == id {
+			s.hooks = append(s.hooks[:i:i], s.hooks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// match 日志所在 vm 注册的 hooks; 该 vm 未注册时 (如 task, 连接池中的 vm) 取同名插件第一个 vm 的 hooks
+func (s *hookSet) match(L *lua.LState, level logrus.Level) []*luaHook {
+	if s == nil || L == nil {
+		return nil
+	}
+	s.safe.RLock()
+	defer s.safe.RUnlock()
+	if len(s.hooks) == 0 {
+		return nil
+	}
+	var (
+		own, other []*luaHook
+		name       = core.GetRuntime(L).Name
+	)
+	for _, hook := range s.hooks {
+		if !hook.levels[level] {
+			continue
+		}
+		switch {
+		case hook.L.G == L.G:
+			own = append(own, hook)
+		case name != "" && hook.owner.Name == name && (len(other) == 0 || other[0].owner == hook.owner):
+			other = append(other, hook)
+		}
+	}
+	if len(own) > 0 {
+		return own
+	}
+	return other
+}
+
+// dispatch 执行 hooks 后输出: 日志来自所属 vm 时直接执行; 所属 vm 空闲时获取执行权后执行;
+// 否则排队到所属 vm 空闲时执行, 日志的写入随之推迟, 所属 vm 关闭或队列已满时丢弃
+func (s *hookSet) dispatch(L *lua.LState, hooks []*luaHook, level logrus.Level, entry *logrus.Entry, msg string) {
+	var owner = hooks[0].owner
+	if hooks[0].L.G == L.G {
+		fire(L, hooks, level, entry, msg)
+		return
+	}
+	if owner.TryAcquire() {
+		defer owner.Release()
+		if !owner.Closed() {
+			fire(hooks[0].L.G.MainThread, hooks, level, entry, msg)
+		}
+		return
+	}
+	if entry.Time.IsZero() {
+		entry = entry.WithTime(time.Now())
+	}
+	s.enqueue(owner, func(L *lua.LState) {
+		fire(L, hooks, level, entry, msg)
+	}, hooks[0].L.G.MainThread)
+}
+
+func (s *hookSet) enqueue(owner *core.Runtime, job func(L *lua.LState), L *lua.LState) {
+	s.safe.Lock()
+	if s.queues == nil {
+		s.queues = make(map[*core.Runtime]*hookQueue)
+	}
+	var q, ok = s.queues[owner]
+	if !ok {
+		q = new(hookQueue)
+		s.queues[owner] = q
+	}
+	s.safe.Unlock()
+	if !ok {
+		owner.OnClose(func() {
+			s.safe.Lock()
+			delete(s.queues, owner)
+			s.safe.Unlock()
+		})
+	}
+	q.safe.Lock()
+	defer q.safe.Unlock()
+	if len(q.jobs) >= HookQueueSize {
+		_, _ = fmt.Fprintf(os.Stderr, "logger: hook queue of %q full, entry dropped\n", owner.Name)
+		return
+	}
+	q.jobs = append(q.jobs, job)
+	if !q.running {
+		q.running = true
+		go q.run(owner, L)
+	}
+}
+
+// run 依次获取所属 vm 的执行权并执行排队的日志, 队列为空时退出; 所属 vm 已关闭时丢弃
+func (q *hookQueue) run(owner *core.Runtime, L *lua.LState) {
+	for {
+		q.safe.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			q.safe.Unlock()
+			return
+		}
+		var job = q.jobs[0]
+		q.jobs = q.jobs[1:]
+		q.safe.Unlock()
+		_ = owner.Acquire(context.Background())
+		if !owner.Closed() {
+			job(L)
+		}
+		owner.Release()
+	}
+}
+
+// fire 在 hooks 所属 vm 上依次执行后输出, 任一 hook 返回 false 时丢弃; hook 执行中产生的日志不再触发该 hook
+func fire(L *lua.LState, hooks []*luaHook, level logrus.Level, entry *logrus.Entry, msg string) {
+	for _, hook := range hooks {
+		if !atomic.CompareAndSwapInt32(&hook.running, 0, 1) {
+			continue
+		}
+		var record = &Record{Level: level, Message: msg, Fields: entry.Data}
+		var keep, err = hook.invoke(L, record)
+		atomic.StoreInt32(&hook.running, 0)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "logger: hook %d: %v\n", hook.id, err)
+			continue
+		}
+		if !keep {
+			return
+		}
+		entry, msg = logrus.NewEntry(entry.Logger).WithTime(entry.Time).WithFields(record.Fields), record.Message
+	}
+	entry.Log(level, msg)
+}
+
+// invoke fn({level=, message=, fields=}), 返回 false 丢弃, 可修改 message 与 fields 或返回新的 table
+func (hook *luaHook) invoke(L *lua.LState, record *Record) (bool, error) {
+	var entry = L.NewTable()
+	entry.RawSetString("level", lua.LString(record.Level.String()))
+	entry.RawSetString("message", lua.LString(record.Message))
+	entry.RawSetString("fields", core.ToLua(L, map[string]interface{}(record.Fields)))
+	var top = L.GetTop()
+	defer L.SetTop(top)
+	if err := L.CallByParam(lua.P{Fn: hook.fn, NRet: 1, Protect: true}, entry); err != nil {
+		return true, err
+	}
+	switch ret := L.Get(-1).(type) {
+	case lua.LBool:
+		if !ret {
+			return false, nil
+		}
+	case *lua.LTable:
+		entry = ret
+	}
+	record.Message = lua.LVAsString(entry.RawGetString("message"))
+	if fields, ok := entry.RawGetString("fields").(*lua.LTable); ok {
+		record.Fields = Fields(L, fields)
+	} else {
+		record.Fields = logrus.Fields{}
+	}
+	return true, nil
+}
+
+// parseHookLevels nil 或 "*" 为全部级别, 否则为级别名或级别名的数组
+func parseHookLevels(L *lua.LState, v lua.LValue) (map[logrus.Level]bool, error) {
+	var (
+		levels = make(map[logrus.Level]bool)
+		names  []string
+	)
+	switch value := v.(type) {
+	case *lua.LNilType:
+		names = []string{"*"}
+	case lua.LString:
+		names = []string{string(value)}
+	case *lua.LTable:
+		for i := 1; i <= value.Len(); i++ {
+			names = append(names, lua.LVAsString(value.RawGetInt(i)))
+		}
+	default:
+		return nil, fmt.Errorf("levels must be a string or table, got %s", v.Type().String())
+	}
+	for _, name := range names {
+		if name == "*" {
+			for _, level := range logrus.AllLevels {
+				levels[level] = true
+			}
+			continue
+		}
+		var level, err = logrus.ParseLevel(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		levels[level] = true
+	}
+	return levels, nil
+}
+
+// log 执行采样, 限流与 hooks 后输出, 级别未启用, 超出限制或 hook 丢弃时不输出
+func (l *LuaFunctionTable) log(L *lua.LState, entry *logrus.Entry, level logrus.Level, msg string) {
+	if !l.logger.IsLevelEnabled(level) {
+		return
+	}
+	if l.limiter != nil && !l.limiter.Allow(pluginEntry(L, l.entry()), level, msg) {
+		return
+	}
+	var hooks = l.hooks.match(L, level)
+	if len(hooks) == 0 {
+		entry.Log(level, msg)
+		return
+	}
+	l.hooks.dispatch(L, hooks, level, entry, msg)
+}
+
+// addHook logger.addHook(levels, fn) id, fn(entry) 返回 false 丢弃该条日志
+func (l *LuaFunctionTable) addHook(L *lua.LState) int {
+	var levels, err = parseHookLevels(L, L.Get(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	var hook = &luaHook{levels: levels, fn: L.CheckFunction(2), L: L.G.MainThread, owner: core.GetRuntime(L)}
+	L.Push(lua.LNumber(l.hooks.add(hook)))
+	return 1
+}
+
+// removeHook logger.removeHook(id) bool
+func (l *LuaFunctionTable) removeHook(L *lua.LState) int {
+	L.Push(lua.LBool(l.hooks.remove(uint64(L.CheckNumber(1)))))
+	return 1
+}
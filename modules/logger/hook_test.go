@@ -0,0 +1,195 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddHook(t *testing.T) {
+	var (
+		L      = lua.NewState()
+		buf    bytes.Buffer
+		logger = NewLogger()
+	)
+	defer L.Close()
+	logger.logger.Out = &buf
+	logger.logger.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+	L.SetGlobal("log", logger.Table(L))
+	var err = L.DoString(`
+errors = 0
+log.addHook({"error"}, function(entry)
+	errors = errors + 1
+	entry.message = entry.message:gsub("token=%w+", "token=***")
+	entry.fields.redacted = true
+end)
+local drop = log.addHook("warn", function(entry)
+	log.warn("inside hook")
+	return false
+end)
+log.addHook(nil, function(entry)
+	if entry.fields.replace then
+		return {message = "replaced", fields = {}}
+	end
+end)
+log.logErrorLn("login failed", "token=abc123")
+log.withFields({user = "lua"}).error("again token=xyz")
+log.warn("dropped")
+log.info("original", {replace = true})
+assert(log.removeHook(drop))
+assert(not log.removeHook(drop))
+log.warn("kept")
+assert(not pcall(log.addHook, "loud", print))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := L.GetGlobal("errors"); n != lua.LNumber(2) {
+		t.Errorf("expected 2 error hooks, got %v", n)
+	}
+	var out = buf.String()
+	for _, want := range []string{
+		`level=error msg="login failed token=***" redacted=true`,
+		`level=error msg="again token=***" redacted=true user=lua`,
+		`level=info msg=replaced`,
+		`level=warning msg=kept`,
+		// hook 内的日志不再触发自身
+		`level=warning msg="inside hook"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "dropped") || strings.Count(out, "inside hook") != 1 || strings.Contains(out, "abc123") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestHookOtherGoroutine(t *testing.T) {
+	var (
+		owner, worker = lua.NewState(), lua.NewState()
+		buf           bytes.Buffer
+		logger        = NewLogger()
+		rt            = core.GetRuntime(owner)
+	)
+	defer owner.Close()
+	defer worker.Close()
+	logger.logger.Out = &buf
+	logger.logger.Formatter = &logrus.JSONFormatter{}
+	rt.Name, core.GetRuntime(worker).Name = "orders", "orders"
+	owner.SetGlobal("log", logger.Table(owner))
+	worker.SetGlobal("log", logger.Table(worker))
+	if err := owner.DoString(`
+count = 0
+log.addHook("error", function(entry)
+	count = count + 1
+	entry.fields.seen_by = "owner"
+end)
+`); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := worker.DoString(`for i = 1, 3 do log.error("from worker") end`); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+	if err := rt.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var count = owner.GetGlobal("count")
+	rt.Release()
+	if count != lua.LNumber(3) || strings.Count(buf.String(), `"seen_by":"owner"`) != 3 {
+		t.Errorf("unexpected count %v, output:\n%s", count, buf.String())
+	}
+	rt.Close()
+	buf.Reset()
+	if err := worker.DoString(`log.error("after close")`); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "seen_by") {
+		t.Errorf("hook not removed on close: %s", buf.String())
+	}
+}
+
+// lockedBuffer 供其他 goroutine 写入日志时读取
+type lockedBuffer struct {
+	safe sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.safe.Lock()
+	defer b.safe.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.safe.Lock()
+	defer b.safe.Unlock()
+	return b.buf.String()
+}
+
+func TestHookOwnerBusy(t *testing.T) {
+	var (
+		owner, worker = lua.NewState(), lua.NewState()
+		buf           lockedBuffer
+		logger        = NewLogger()
+		rt            = core.GetRuntime(owner)
+	)
+	defer owner.Close()
+	defer worker.Close()
+	logger.logger.Out = &buf
+	logger.logger.Formatter = &logrus.JSONFormatter{}
+	rt.Name, core.GetRuntime(worker).Name = "orders", "orders"
+	owner.SetGlobal("log", logger.Table(owner))
+	worker.SetGlobal("log", logger.Table(worker))
+	if err := owner.DoString(`
+log.addHook("error", function(entry)
+	entry.fields.token = "***"
+end)
+`); err != nil {
+		t.Fatal(err)
+	}
+	// 所属 vm 忙碌 (如 plugin.call 等待 task) 时, worker 的日志不能跳过 hook 直接输出
+	if err := rt.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.DoString(`log.error("from task", {token = "secret"})`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if out := buf.String(); out != "" {
+		t.Fatalf("entry written while owner busy: %s", out)
+	}
+	rt.Release()
+	var deadline = time.Now().Add(time.Second)
+	for !strings.Contains(buf.String(), `"token":"***"`) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if out := buf.String(); !strings.Contains(out, `"token":"***"`) || strings.Contains(out, "secret") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	// 所属 vm 关闭前仍在排队的日志丢弃
+	if err := rt.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.DoString(`log.error("before close", {token = "secret"})`); err != nil {
+		t.Fatal(err)
+	}
+	rt.Close()
+	rt.Release()
+	time.Sleep(50 * time.Millisecond)
+	if out := buf.String(); strings.Contains(out, "before close") {
+		t.Errorf("queued entry written after owner closed: %s", out)
+	}
+}
@@ -0,0 +1,239 @@
+package logger
+
+import (
+	"container/list"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// LimitOptions 采样与限流配置, 按消息 (级别 + 内容) 分别计数
+	LimitOptions struct {
+		// RateLimit 每个消息每秒允许的条数, 0 不限流
+		RateLimit float64
+		// RateBurst 令牌桶容量, 0 为 RateLimit 向上取整
+		RateBurst int
+		// SampleFirst, SampleThereafter 每个消息在 SampleWindow 内先输出 SampleFirst 条, 之后每 SampleThereafter 条输出 1 条
+		SampleFirst      int
+		SampleThereafter int
+		// SampleWindow 采样计数的重置周期, 0 不重置
+		SampleWindow time.Duration
+		// SummaryInterval 输出 "suppressed N messages" 汇总的周期, 0 使用 DefaultSummaryInterval
+		SummaryInterval time.Duration
+		Clock           core.Clock
+	}
+
+	// Limiter 丢弃超出采样与限流的日志, 周期性地为每个消息输出一条汇总
+	Limiter struct {
+		safe   sync.Mutex
+		opts   LimitOptions
+		logger *logrus.Logger
+		keys   map[limitKey]*limitState
+		// recent 按最近使用排序的 limitKey, 超出 limitMaxKeys 时淘汰最久未使用的
+		recent  *list.List
+		dropped map[limitKey]*limitDrop
+		stop    chan struct{}
+	}
+
+	limitKey struct {
+		level   logrus.Level
+		message string
+	}
+
+	limitState struct {
+		tokens float64
+		last   time.Time
+		window time.Time
+		count  int
+		elem   *list.Element
+	}
+
+	// limitDrop 汇总周期内丢弃的条数, entry 为首次丢弃时所属 logger 的条目 (附加字段与插件名)
+	limitDrop struct {
+		n     int
+		entry *logrus.Entry
+	}
+)
+
+const (
+	DefaultSummaryInterval = time.Minute
+
+	SuppressedField        = "suppressed"
+	SuppressedMessageField = "suppressed_msg"
+
+	// limitMaxKeys 计数状态的上限, 超出时淘汰最久未使用的, 避免消息内容各不相同时无限增长
+	limitMaxKeys = 10000
+)
+
+// NewLimiter 创建 Limiter, 汇总写入 Allow 传入的 entry, 未传入时写入 logger
+func NewLimiter(opts LimitOptions, logger *logrus.Logger) *Limiter {
+	if opts.Clock == nil {
+		opts.Clock = core.SystemClock
+	}
+	if opts.SummaryInterval <= 0 {
+		opts.SummaryInterval = DefaultSummaryInterval
+	}
+	if opts.RateLimit > 0 && opts.RateBurst <= 0 {
+		opts.RateBurst = int(math.Ceil(opts.RateLimit))
+	}
+	return &Limiter{
+		opts:    opts,
+		logger:  logger,
+		keys:    make(map[limitKey]*limitState),
+		recent:  list.New(),
+		dropped: make(map[limitKey]*limitDrop),
+	}
+}
+
+// Allow 是否输出该条日志, 被丢弃的计入下一次汇总; entry 为所属 logger 的条目, 汇总以其输出
+func (lim *Limiter) Allow(entry *logrus.Entry, level logrus.Level, msg string) bool {
+	lim.safe.Lock()
+	defer lim.safe.Unlock()
+	var (
+		key   = limitKey{level: level, message: msg}
+		now   = lim.opts.Clock.Now()
+		state = lim.keys[key]
+	)
+	if state == nil {
+		if len(lim.keys) >= limitMaxKeys {
+			var oldest = lim.recent.Back()
+			lim.recent.Remove(oldest)
+			delete(lim.keys, oldest.Value.(limitKey))
+		}
+		state = &limitState{tokens: float64(lim.opts.RateBurst), last: now, window: now}
+		state.elem = lim.recent.PushFront(key)
+		lim.keys[key] = state
+	} else {
+		lim.recent.MoveToFront(state.elem)
+	}
+	if !lim.sample(state, now) || !lim.take(state, now) {
+		var drop = lim.dropped[key]
+		if drop == nil {
+			drop = &limitDrop{entry: entry}
+			lim.dropped[key] = drop
+		}
+		drop.n++
+		return false
+	}
+	return true
+}
+
+// sample 先输出 SampleFirst 条, 之后每 SampleThereafter 条输出 1 条
+func (lim *Limiter) sample(state *limitState, now time.Time) bool {
+	var first, thereafter = lim.opts.SampleFirst, lim.opts.SampleThereafter
+	if first <= 0 && thereafter <= 0 {
+		return true
+	}
+	if lim.opts.SampleWindow > 0 && now.Sub(state.window) >= lim.opts.SampleWindow {
+		state.window, state.count = now, 0
+	}
+	state.count++
+	if state.count <= first {
+		return true
+	}
+	return thereafter > 0 && (state.count-first)%thereafter == 0
+}
+
+// take 令牌桶, 按经过的时间补充令牌
+func (lim *Limiter) take(state *limitState, now time.Time) bool {
+	if lim.opts.RateLimit <= 0 {
+		return true
+	}
+	if elapsed := now.Sub(state.last); elapsed > 0 {
+		state.tokens = math.Min(float64(lim.opts.RateBurst), state.tokens+elapsed.Seconds()*lim.opts.RateLimit)
+		state.last = now
+	}
+	if state.tokens < 1 {
+		return false
+	}
+	state.tokens--
+	return true
+}
+
+// Flush 为每个有丢弃的消息输出 "suppressed N messages" 汇总, 返回丢弃的总数
+func (lim *Limiter) Flush() int {
+	lim.safe.Lock()
+	var dropped = lim.dropped
+	lim.dropped = make(map[limitKey]*limitDrop)
+	lim.safe.Unlock()
+	var keys = make([]limitKey, 0, len(dropped))
+	for key := range dropped {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].level != keys[j].level {
+			return keys[i].level < keys[j].level
+		}
+		return keys[i].message < keys[j].message
+	})
+	var total = 0
+	for _, key := range keys {
+		var drop = dropped[key]
+		total += drop.n
+		var entry = drop.entry
+		if entry == nil && lim.logger != nil {
+			entry = logrus.NewEntry(lim.logger)
+		}
+		if entry != nil {
+			entry.WithFields(logrus.Fields{SuppressedField: drop.n, SuppressedMessageField: key.message}).
+				Logf(key.level, "suppressed %d messages", drop.n)
+		}
+	}
+	return total
+}
+
+// Start 每隔 SummaryInterval 输出汇总, 直到 Stop
+func (lim *Limiter) Start() {
+	lim.safe.Lock()
+	defer lim.safe.Unlock()
+	if lim.stop != nil {
+		return
+	}
+	var (
+		stop   = make(chan struct{})
+		ticker = time.NewTicker(lim.opts.SummaryInterval)
+	)
+	lim.stop = stop
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lim.Flush()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止周期汇总并输出剩余的汇总
+func (lim *Limiter) Stop() {
+	lim.safe.Lock()
+	var stop = lim.stop
+	lim.stop = nil
+	lim.safe.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	lim.Flush()
+}
+
+// LimitOptions 采样与限流配置, 均未配置时返回 nil
+func (opts *Options) LimitOptions() *LimitOptions {
+	if opts.RateLimit <= 0 && opts.SampleFirst <= 0 && opts.SampleThereafter <= 0 {
+		return nil
+	}
+	return &LimitOptions{
+		RateLimit:        opts.RateLimit,
+		RateBurst:        opts.RateBurst,
+		SampleFirst:      opts.SampleFirst,
+		SampleThereafter: opts.SampleThereafter,
+		SampleWindow:     opts.SampleWindow,
+		SummaryInterval:  opts.SummaryInterval,
+	}
+}
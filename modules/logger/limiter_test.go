@@ -0,0 +1,147 @@
+package logger
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var (
+		clock = core.NewManualClock(time.Unix(0, 0))
+		buf   bytes.Buffer
+		out   = logrus.New()
+	)
+	out.Out, out.Formatter = &buf, &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+	var rate = NewLimiter(LimitOptions{RateLimit: 2, Clock: clock}, out)
+	var allowed = 0
+	for i := 0; i < 5; i++ {
+		if rate.Allow(nil, logrus.ErrorLevel, "db down") {
+			allowed++
+		}
+	}
+	if !rate.Allow(nil, logrus.ErrorLevel, "other") || allowed != 2 {
+		t.Errorf("expected 2 allowed, got %d", allowed)
+	}
+	clock.Add(500 * time.Millisecond)
+	if !rate.Allow(nil, logrus.ErrorLevel, "db down") || rate.Allow(nil, logrus.ErrorLevel, "db down") {
+		t.Error("expected one token after 500ms")
+	}
+	if n := rate.Flush(); n != 4 || !strings.Contains(buf.String(), `level=error msg="suppressed 4 messages" suppressed=4 suppressed_msg="db down"`) {
+		t.Errorf("unexpected summary %d: %s", n, buf.String())
+	}
+	if n := rate.Flush(); n != 0 {
+		t.Errorf("expected empty summary, got %d", n)
+	}
+
+	var sample = NewLimiter(LimitOptions{SampleFirst: 2, SampleThereafter: 3, SampleWindow: time.Second, Clock: clock}, nil)
+	var kept []int
+	for i := 1; i <= 10; i++ {
+		if sample.Allow(nil, logrus.InfoLevel, "tick") {
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) != 4 || kept[2] != 5 || kept[3] != 8 {
+		t.Errorf("unexpected sampled %v", kept)
+	}
+	clock.Add(time.Second)
+	if !sample.Allow(nil, logrus.InfoLevel, "tick") || sample.Flush() != 6 {
+		t.Error("expected sampling window reset")
+	}
+}
+
+func TestCreateLimits(t *testing.T) {
+	var (
+		L   = lua.NewState()
+		buf bytes.Buffer
+	)
+	defer L.Close()
+	var opts, err = ParseOptions(map[string]string{"sample_first": "3", "sample_thereafter": "0", "rate_limit": "100", "summary_interval": "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.limiter.Stop()
+	logger.logger.Out = &buf
+	L.SetGlobal("log", logger.Table(L))
+	if err = L.DoString(`for i = 1, 1000 do log.logErrorLn("same", "error") end`); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "same error"); n != 3 {
+		t.Errorf("expected 3 lines, got %d", n)
+	}
+	logger.limiter.Flush()
+	if !strings.Contains(buf.String(), "suppressed 997 messages") {
+		t.Errorf("missing summary in %s", buf.String())
+	}
+	for _, section := range []map[string]string{{"rate_limit": "-1"}, {"sample_first": "x"}, {"summary_interval": "soon"}} {
+		if _, err = ParseOptions(section); err == nil {
+			t.Errorf("expected error for %v", section)
+		}
+	}
+}
+
+func TestLimiter_Evict(t *testing.T) {
+	var (
+		clock = core.NewManualClock(time.Unix(0, 0))
+		lim   = NewLimiter(LimitOptions{RateLimit: 1, Clock: clock}, nil)
+	)
+	if !lim.Allow(nil, logrus.ErrorLevel, "flood") {
+		t.Fatal("first message dropped")
+	}
+	// 大量不同的消息不应清除持续刷屏的消息的限流状态
+	for i := 0; i < limitMaxKeys*2; i++ {
+		lim.Allow(nil, logrus.InfoLevel, strconv.Itoa(i))
+		if lim.Allow(nil, logrus.ErrorLevel, "flood") {
+			t.Fatalf("flood allowed after %d other messages", i)
+		}
+	}
+	if n := len(lim.keys); n != limitMaxKeys || lim.recent.Len() != limitMaxKeys {
+		t.Errorf("expected %d keys, got %d", limitMaxKeys, n)
+	}
+	if _, ok := lim.keys[limitKey{level: logrus.InfoLevel, message: "0"}]; ok {
+		t.Error("least recently used key not evicted")
+	}
+}
+
+func TestLimiter_SummaryFields(t *testing.T) {
+	var (
+		L   = lua.NewState()
+		buf bytes.Buffer
+	)
+	defer L.Close()
+	var opts, err = ParseOptions(map[string]string{"sample_first": "1", "summary_interval": "1h", "service": "billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.limiter.Stop()
+	logger.logger.Out, logger.logger.Formatter = &buf, &logrus.JSONFormatter{}
+	core.GetRuntime(L).Name = "orders"
+	L.SetGlobal("log", logger.Table(L))
+	if err = L.DoString(`for i = 1, 3 do log.error("same", {token = "secret"}) end`); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	logger.limiter.Flush()
+	var out = buf.String()
+	for _, want := range []string{`"suppressed":2`, `"plugin":"orders"`, `"service":"billing"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("summary missing %s: %s", want, out)
+		}
+	}
+	if strings.Contains(out, "secret") {
+		t.Errorf("summary carries per-entry fields: %s", out)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/weblfe/plugin_lua/core"
 	"github.com/yuin/gopher-lua"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -15,6 +16,17 @@ import (
 type (
 	LuaFunctionTable struct {
 		logger *logrus.Logger
+		// fields withFields 附加的字段, 子 logger 与父 logger 共用 logrus.Logger
+		fields logrus.Fields
+		// caller, callerDepth 记录 lua 调用位置的方式与栈深度
+		caller      string
+		callerDepth int
+		// tee 配置了多个输出时按级别分发, 子 logger 共用
+		tee *tee
+		// hooks logger.addHook 注册的 lua hooks, 子 logger 共用
+		hooks *hookSet
+		// limiter 采样与限流, 子 logger 共用
+		limiter *Limiter
 	}
 )
 
@@ -29,7 +41,21 @@ func NewLogger() *LuaFunctionTable {
 }
 
 // Create function create(file string,level string,mode number) logger
+// 或 create{file=, level=, mode=, format=, colors=, timestamp_format=, rename={msg="message"}, service=}
+// 或 create{level=, sinks={{type="stderr", level="error"}, {type="file", file=, format="json"}, {type="memory", size=}}}
 func Create(L *lua.LState) int {
+	if t, ok := L.Get(1).(*lua.LTable); ok {
+		var opts, err = LuaOptions(L, t)
+		var logger *LuaFunctionTable
+		if err == nil {
+			logger, err = New(opts)
+		}
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+		L.Push(logger.closable(L, logger.Table(L)))
+		return 1
+	}
 	var args = core.GetArgs(L)
 	if len(args) <= 0 {
 		return 0
@@ -77,10 +103,23 @@ func Create(L *lua.LState) int {
 	for k, fn := range logger.methods() {
 		table.RawSet(lua.LString(k), L.NewFunction(fn))
 	}
-	L.Push(table)
+	L.Push(logger.closable(L, table))
 	return 1
 }
 
+// closable 为 create 创建的 logger 添加 close(), vm 关闭时同样关闭其输出
+func (l *LuaFunctionTable) closable(L *lua.LState, table *lua.LTable) *lua.LTable {
+	core.GetRuntime(L).OnClose(l.destroy)
+	table.RawSetString("close", L.NewFunction(l.logClose))
+	return table
+}
+
+// logClose logger.close() 停止限流汇总并关闭文件输出, 之后的日志被丢弃
+func (l *LuaFunctionTable) logClose(L *lua.LState) int {
+	l.destroy()
+	return 0
+}
+
 func (l *LuaFunctionTable) methods() map[string]lua.LGFunction {
 	return map[string]lua.LGFunction{
 		"create":     Create,
@@ -96,6 +135,82 @@ func (l *LuaFunctionTable) methods() map[string]lua.LGFunction {
 		"logTraceLn": l.logTraceLn,
 		"setLevel":   l.logSetLevel,
 		"getLevel":   l.logGetLevel,
+		"withFields": l.withFields,
+		"buffer":     l.logBuffer,
+		"addHook":    l.addHook,
+		"removeHook": l.removeHook,
+		"info":       l.leveled(logrus.InfoLevel),
+		"error":      l.leveled(logrus.ErrorLevel),
+		"warn":       l.leveled(logrus.WarnLevel),
+		"debug":      l.leveled(logrus.DebugLevel),
+		"trace":      l.leveled(logrus.TraceLevel),
+	}
+}
+
+// Fields 转换 lua table 为 logrus 字段, 数值, 布尔与嵌套 table 保留类型, 无法转换的值 (如函数) 记为字符串
+func Fields(L *lua.LState, t *lua.LTable) logrus.Fields {
+	var fields = make(logrus.Fields)
+	if t == nil {
+		return fields
+	}
+	core.ForEach(L, t, func(k lua.LValue, v lua.LValue) {
+		if value, err := core.ToGo(v); err == nil {
+			fields[k.String()] = value
+		} else {
+			fields[k.String()] = v.String()
+		}
+	})
+	return fields
+}
+
+// WithFields 创建附加 fields 的子 logger
+func (l *LuaFunctionTable) WithFields(fields logrus.Fields) *LuaFunctionTable {
+	var child = &LuaFunctionTable{
+		logger:      l.logger,
+		fields:      make(logrus.Fields, len(l.fields)+len(fields)),
+		caller:      l.caller,
+		callerDepth: l.callerDepth,
+		tee:         l.tee,
+		hooks:       l.hooks,
+		limiter:     l.limiter,
+	}
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		child.fields[k] = v
+	}
+	return child
+}
+
+// Table 转换为 lua 侧的 logger table
+func (l *LuaFunctionTable) Table(L *lua.LState) *lua.LTable {
+	var table = L.NewTable()
+	for k, fn := range l.methods() {
+		table.RawSetString(k, L.NewFunction(fn))
+	}
+	return table
+}
+
+func (l *LuaFunctionTable) entry() *logrus.Entry {
+	return l.logger.WithFields(l.fields)
+}
+
+// withFields logger.withFields(fields) logger
+func (l *LuaFunctionTable) withFields(L *lua.LState) int {
+	L.Push(l.WithFields(Fields(L, L.CheckTable(1))).Table(L))
+	return 1
+}
+
+// leveled logger.info(msg [, fields]) 等, fields 仅附加到本条日志
+func (l *LuaFunctionTable) leveled(level logrus.Level) lua.LGFunction {
+	return func(L *lua.LState) int {
+		var entry = l.entryL(L)
+		if t, ok := L.Get(2).(*lua.LTable); ok {
+			entry = entry.WithFields(Fields(L, t))
+		}
+		l.log(L, entry, level, L.ToStringMeta(L.CheckAny(1)).String())
+		return 0
 	}
 }
 
@@ -131,26 +246,32 @@ func (l *LuaFunctionTable) logGetLevel(L *lua.LState) int {
 }
 
 func (l *LuaFunctionTable) setOut(out string, mod ...os.FileMode) *LuaFunctionTable {
-	mod = append(mod, os.ModePerm)
 	if out == "" {
 		return l
 	}
+	if fd, err := openOut(out, mod...); err == nil {
+		l.logger.Out = fd
+		runtime.SetFinalizer(l, (*LuaFunctionTable).destroy)
+	} else {
+		fmt.Println(err.Error())
+	}
+	return l
+}
+
+// openOut 以追加模式打开日志文件, 目录不存在时创建
+func openOut(out string, mod ...os.FileMode) (*os.File, error) {
+	mod = append(mod, os.ModePerm)
 	var file, err = filepath.Abs(out)
 	if err != nil {
-		fmt.Println(err.Error())
-		return l
+		return nil, err
 	}
-	if _, e := os.Stat(file); e != nil {
-		if !os.IsNotExist(e) {
-			return l
+	if _, err = os.Stat(file); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
 		}
 		_ = os.MkdirAll(filepath.Dir(file), mod[0])
 	}
-	if fd, err2 := os.OpenFile(file, os.O_CREATE|os.O_RDWR|os.O_APPEND, mod[0]); err2 == nil {
-		l.logger.Out = fd
-		runtime.SetFinalizer(l, (*LuaFunctionTable).destroy)
-	}
-	return l
+	return os.OpenFile(file, os.O_CREATE|os.O_RDWR|os.O_APPEND, mod[0])
 }
 
 func (l *LuaFunctionTable) setLevel(level string) *LuaFunctionTable {
@@ -171,6 +292,7 @@ func (l *LuaFunctionTable) setLevel(level string) *LuaFunctionTable {
 
 func (l *LuaFunctionTable) init() *LuaFunctionTable {
 	l.logger = logrus.New()
+	l.hooks = new(hookSet)
 	return l
 }
 
@@ -179,7 +301,7 @@ func (l *LuaFunctionTable) logInfoLn(L *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Infoln(args...)
+	l.log(L, l.entryL(L), logrus.InfoLevel, sprintln(args...))
 	return 1
 }
 
@@ -188,7 +310,7 @@ func (l *LuaFunctionTable) logInfo(state *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Infoln(args...)
+	l.log(state, l.entryL(state), logrus.InfoLevel, sprintln(args...))
 	return 1
 }
 
@@ -197,7 +319,7 @@ func (l *LuaFunctionTable) logTrace(state *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Trace(args...)
+	l.log(state, l.entryL(state), logrus.TraceLevel, fmt.Sprint(args...))
 	return 1
 }
 
@@ -206,7 +328,7 @@ func (l *LuaFunctionTable) logWarn(state *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Warn(args...)
+	l.log(state, l.entryL(state), logrus.WarnLevel, fmt.Sprint(args...))
 	return 1
 }
 
@@ -215,7 +337,7 @@ func (l *LuaFunctionTable) logWarnLn(state *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Warnln(args...)
+	l.log(state, l.entryL(state), logrus.WarnLevel, sprintln(args...))
 	return 1
 }
 
@@ -224,7 +346,7 @@ func (l *LuaFunctionTable) logTraceLn(state *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Traceln(args...)
+	l.log(state, l.entryL(state), logrus.TraceLevel, sprintln(args...))
 	return 1
 }
 
@@ -233,7 +355,7 @@ func (l *LuaFunctionTable) logDebug(L *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Debug(args...)
+	l.log(L, l.entryL(L), logrus.DebugLevel, fmt.Sprint(args...))
 	return 1
 }
 
@@ -242,7 +364,7 @@ func (l *LuaFunctionTable) logDebugLn(L *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Debugln(args...)
+	l.log(L, l.entryL(L), logrus.DebugLevel, sprintln(args...))
 	return 1
 }
 
@@ -251,7 +373,7 @@ func (l *LuaFunctionTable) logErrorLn(L *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Errorln(args...)
+	l.log(L, l.entryL(L), logrus.ErrorLevel, sprintln(args...))
 	return 1
 }
 
@@ -260,19 +382,32 @@ func (l *LuaFunctionTable) logError(L *lua.LState) int {
 	if len(args) <= 0 {
 		return 0
 	}
-	l.logger.Error(args...)
+	l.log(L, l.entryL(L), logrus.ErrorLevel, fmt.Sprint(args...))
 	return 1
 }
 
+// destroy 停止限流汇总, 关闭 tee 与文件输出, 之后的日志被丢弃; 重复调用无效
 func (l *LuaFunctionTable) destroy() {
-	if l.logger.Out == nil {
+	runtime.SetFinalizer(l, nil)
+	if l.limiter != nil {
+		l.limiter.Stop()
+	}
+	if l.tee != nil {
+		_ = l.tee.Close()
+	}
+	var out = l.logger.Out
+	if out == nil || out == ioutil.Discard {
 		return
 	}
-	runtime.SetFinalizer(l, nil)
-	if l.logger.Out != os.Stderr && l.logger.Out != os.Stdin {
-		if closer, ok := l.logger.Out.(io.WriteCloser); ok {
+	l.logger.SetOutput(ioutil.Discard)
+	if out != os.Stdout && out != os.Stderr && out != os.Stdin {
+		if closer, ok := out.(io.Closer); ok {
 			_ = closer.Close()
 		}
-		l.logger.Out = nil
 	}
 }
+
+// sprintln 与 logrus 的 *ln 方法相同: 参数间以空格分隔, 不含末尾换行
+func sprintln(args ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
@@ -0,0 +1,174 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithFields(t *testing.T) {
+	var (
+		L      = lua.NewState()
+		buf    bytes.Buffer
+		logger = NewLogger()
+	)
+	defer L.Close()
+	logger.logger.Out = &buf
+	logger.logger.Formatter = &logrus.JSONFormatter{}
+	L.SetGlobal("log", logger.Table(L))
+	var err = L.DoString(`
+local order = log.withFields({order_id = 42, user = "lua", paid = true})
+order.info("order created", {amount = 9.5, items = {"a", "b"}})
+order.withFields({step = 2}).warn("order delayed")
+order.debug("hidden")
+log.logInfo("legacy", 1)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", buf.String())
+	}
+	var entry map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "order created" || entry["level"] != "info" || entry["order_id"] != float64(42) ||
+		entry["paid"] != true || entry["amount"] != 9.5 || len(entry["items"].([]interface{})) != 2 {
+		t.Errorf("unexpected entry %v", entry)
+	}
+	entry = nil
+	_ = json.Unmarshal([]byte(lines[1]), &entry)
+	if entry["level"] != "warning" || entry["step"] != float64(2) || entry["user"] != "lua" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+	entry = nil
+	_ = json.Unmarshal([]byte(lines[2]), &entry)
+	if entry["msg"] != "legacy 1" || entry["order_id"] != nil {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestCreateOptions(t *testing.T) {
+	var (
+		L    = lua.NewState()
+		file = filepath.Join(t.TempDir(), "app.log")
+	)
+	defer L.Close()
+	L.SetGlobal("create", L.NewFunction(Create))
+	L.SetGlobal("file", lua.LString(file))
+	var err = L.DoString(`
+local log = create{
+	file = file,
+	level = "debug",
+	format = "json",
+	timestamp_format = "2006",
+	rename = {msg = "message", level = "severity"},
+	service = "orders",
+}
+log.debug("created", {id = 1})
+assert(not pcall(create, {format = "xml"}))
+assert(not pcall(create, {rename = {caller = "c"}}))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data, _ = ioutil.ReadFile(file)
+	var entry map[string]interface{}
+	if err = json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if entry["message"] != "created" || entry["severity"] != "debug" || entry["service"] != "orders" || entry["id"] != float64(1) || len(entry["time"].(string)) != 4 {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	var opts, err = ParseOptions(map[string]string{"format": "logfmt", "mode": "0600", "colors": "true", "rename": "msg=message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Mode != 0600 || !opts.Colors || opts.Rename["msg"] != "message" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	var logger, _ = New(opts)
+	var buf bytes.Buffer
+	logger.logger.Out = &buf
+	logger.entry().Info("hello world")
+	if out := buf.String(); !strings.Contains(out, `message="hello world"`) || !strings.HasPrefix(out, "time=") {
+		t.Errorf("unexpected logfmt output %q", out)
+	}
+	for _, section := range []map[string]string{{"format": "xml"}, {"mode": "rw"}, {"unknown": "1"}, {"rename": "msg"}} {
+		if _, err = ParseOptions(section); err == nil {
+			t.Errorf("expected error for %v", section)
+		}
+	}
+}
+
+func TestShared_Release(t *testing.T) {
+	var (
+		opts  = &Options{File: filepath.Join(t.TempDir(), "app.log")}
+		first = core.NewRuntime()
+		clone = core.NewRuntime()
+	)
+	var logger, err = Shared(first, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := Shared(clone, opts); again != logger {
+		t.Fatal("runtimes with the same options should share the logger")
+	}
+	first.Close()
+	if logger.logger.Out == ioutil.Discard {
+		t.Fatal("logger closed while still in use")
+	}
+	clone.Close()
+	if logger.logger.Out != ioutil.Discard {
+		t.Error("logger output not closed after the last runtime closed")
+	}
+	loggers.safe.Lock()
+	defer loggers.safe.Unlock()
+	if _, ok := loggers.items[opts]; ok {
+		t.Error("logger not evicted")
+	}
+}
+
+func TestCreate_Close(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		L   = lua.NewState()
+		rt  = core.GetRuntime(L)
+	)
+	defer L.Close()
+	L.SetGlobal("create", L.NewFunction(Create))
+	L.SetGlobal("dir", lua.LString(dir))
+	var err = L.DoString(`
+closed = create{file = dir .. "/closed.log"}
+closed.info("before")
+closed.close()
+closed.info("after")
+closed.close()
+open = create(dir .. "/open.log", "info")
+open.logInfo("kept")
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "closed.log")); !strings.Contains(string(data), "before") || strings.Contains(string(data), "after") {
+		t.Errorf("unexpected content %q", data)
+	}
+	rt.Close()
+	if err = L.DoString(`open.logInfo("dropped")`); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "open.log")); strings.Contains(string(data), "dropped") {
+		t.Errorf("logger not closed with the vm: %q", data)
+	}
+}
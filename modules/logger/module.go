@@ -1,19 +1,38 @@
 package logger
 
-import "github.com/yuin/gopher-lua"
+import (
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+)
 
 const (
-		Name = "logger"
+	Name = "logger"
 )
 
-func  NewLuaLoggerTables() lua.LGFunction{
-		return func(state *lua.LState) int {
-				var mod lua.LValue
-				if len(Funcs) <= 0 {
-						return 0
+func NewLuaLoggerTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod lua.LValue
+		if len(Funcs) <= 0 {
+			return 0
+		}
+		var funcs = Funcs
+		// 插件配置了 ModuleOptions["logger"] 时使用独立的 logger, 否则使用宿主注入的 Sink
+		var rt = core.GetRuntime(state)
+		// 配置的 logger 创建失败 (如文件无法打开) 时记录错误, 使用宿主的输出
+		if opts, ok := rt.Option(Name).(*Options); ok && opts != nil {
+			if logger, err := Shared(rt, opts); err == nil {
+				funcs = logger.methods()
+			} else {
+				Entry(rt).WithError(err).Error("create plugin logger failed, falling back to the host logger")
+				if logger := ForRuntime(rt); logger != nil {
+					funcs = logger.methods()
 				}
-				mod = state.RegisterModule(Name, Funcs)
-				state.Push(mod)
-				return 1
+			}
+		} else if logger := ForRuntime(rt); logger != nil {
+			funcs = logger.methods()
 		}
-}
\ No newline at end of file
+		mod = state.RegisterModule(Name, funcs)
+		state.Push(mod)
+		return 1
+	}
+}
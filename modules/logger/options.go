@@ -0,0 +1,469 @@
+package logger
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Options logger 配置, 可由 lua create{...}, 插件清单的 logger 段或 PluginOptions.ModuleOptions["logger"] 提供
+	Options struct {
+		File  string
+		Level string
+		Mode  os.FileMode
+		// Format text, json 或 logfmt
+		Format string
+		// Colors text 格式是否输出颜色
+		Colors          bool
+		TimestampFormat string
+		// Rename 重命名内置字段, key 为 msg, level, time, func, file
+		Rename map[string]string
+		// Service 非空时每条日志附加 service 字段
+		Service string
+		// MaxSize, Rotate, MaxBackups, MaxAge, Compress 文件轮转, 见 RotateOptions
+		MaxSize    int64
+		Rotate     string
+		MaxBackups int
+		MaxAge     time.Duration
+		Compress   bool
+		// Caller 记录 lua 调用位置: none, fields (lua_file, lua_line, lua_func) 或 prefix (消息前缀)
+		Caller string
+		// CallerDepth 调用位置所在的栈深度, 默认 1 (直接调用 logger 的函数), 经过包装函数时相应增加
+		CallerDepth int
+		// Sinks 多个输出, 各自的最低级别与格式, 配置后不使用 File
+		Sinks []*SinkOptions
+		// RateLimit, RateBurst, SampleFirst, SampleThereafter, SampleWindow, SummaryInterval 采样与限流, 见 LimitOptions
+		RateLimit        float64
+		RateBurst        int
+		SampleFirst      int
+		SampleThereafter int
+		SampleWindow     time.Duration
+		SummaryInterval  time.Duration
+	}
+)
+
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+
+	ServiceField = "service"
+)
+
+var (
+	// loggers 按配置缓存, 同一插件 Clone 出的 vm 共用 logger 与输出文件; refs 为使用中的运行时数, 归零时关闭
+	loggers = struct {
+		safe  sync.Mutex
+		items map[*Options]*LuaFunctionTable
+		refs  map[*Options]int
+	}{items: make(map[*Options]*LuaFunctionTable), refs: make(map[*Options]int)}
+
+	renameKeys = map[string]bool{
+		logrus.FieldKeyMsg:   true,
+		logrus.FieldKeyLevel: true,
+		logrus.FieldKeyTime:  true,
+		logrus.FieldKeyFunc:  true,
+		logrus.FieldKeyFile:  true,
+	}
+)
+
+// ParseOptions 解析字符串形式的配置 (如插件清单的 logger 段), rename 格式为 "msg=message,level=severity"
+func ParseOptions(section map[string]string) (*Options, error) {
+	var opts = new(Options)
+	for _, key := range sortedKeys(section) {
+		var value = section[key]
+		switch key {
+		case "file":
+			opts.File = value
+		case "level":
+			opts.Level = value
+		case "mode":
+			var mode, err = strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("logger: invalid mode %q", value)
+			}
+			opts.Mode = os.FileMode(mode)
+		case "format":
+			opts.Format = value
+		case "colors":
+			var colors, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("logger: invalid colors %q", value)
+			}
+			opts.Colors = colors
+		case "timestamp_format":
+			opts.TimestampFormat = value
+		case "rename":
+			opts.Rename = make(map[string]string)
+			for _, pair := range strings.Split(value, ",") {
+				var kv = strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("logger: invalid rename %q", pair)
+				}
+				opts.Rename[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		case "service":
+			opts.Service = value
+		case "max_size":
+			var size, err = parseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("logger: invalid max_size %q", value)
+			}
+			opts.MaxSize = size
+		case "rotate":
+			opts.Rotate = value
+		case "max_backups":
+			var n, err = strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("logger: invalid max_backups %q", value)
+			}
+			opts.MaxBackups = n
+		case "max_age":
+			var age, err = parseAge(value)
+			if err != nil {
+				return nil, fmt.Errorf("logger: invalid max_age %q", value)
+			}
+			opts.MaxAge = age
+		case "compress":
+			var enabled, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("logger: invalid %s %q", key, value)
+			}
+			opts.Compress = enabled
+		case "caller":
+			opts.Caller = value
+		case "caller_depth":
+			var depth, err = strconv.Atoi(value)
+			if err != nil || depth < 1 {
+				return nil, fmt.Errorf("logger: invalid caller_depth %q", value)
+			}
+			opts.CallerDepth = depth
+		case "rate_limit":
+			var rate, err = strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 {
+				return nil, fmt.Errorf("logger: invalid rate_limit %q", value)
+			}
+			opts.RateLimit = rate
+		case "rate_burst", "sample_first", "sample_thereafter":
+			var n, err = strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("logger: invalid %s %q", key, value)
+			}
+			switch key {
+			case "rate_burst":
+				opts.RateBurst = n
+			case "sample_first":
+				opts.SampleFirst = n
+			default:
+				opts.SampleThereafter = n
+			}
+		case "sample_window", "summary_interval":
+			var interval, err = parseAge(value)
+			if err != nil || interval < 0 {
+				return nil, fmt.Errorf("logger: invalid %s %q", key, value)
+			}
+			if key == "sample_window" {
+				opts.SampleWindow = interval
+			} else {
+				opts.SummaryInterval = interval
+			}
+		default:
+			return nil, fmt.Errorf("logger: unknown option %q", key)
+		}
+	}
+	return opts, opts.Validate()
+}
+
+// LuaOptions 读取 lua create{...} 的配置 table, sinks 为输出配置的数组
+func LuaOptions(L *lua.LState, t *lua.LTable) (*Options, error) {
+	var sinks, _ = t.RawGetString("sinks").(*lua.LTable)
+	var section, err = luaSection(L, t, sinks != nil)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := ParseOptions(section)
+	if err != nil || sinks == nil {
+		return opts, err
+	}
+	for i := 1; i <= sinks.Len(); i++ {
+		var t, ok = sinks.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("logger: invalid sink #%d", i)
+		}
+		if section, err = luaSection(L, t, false); err != nil {
+			return nil, err
+		}
+		var sink *SinkOptions
+		if sink, err = ParseSinkOptions(section); err != nil {
+			return nil, err
+		}
+		opts.Sinks = append(opts.Sinks, sink)
+	}
+	return opts, opts.Validate()
+}
+
+// luaSection 转换 lua 配置 table 为字符串形式, skipSinks 时忽略 sinks
+func luaSection(L *lua.LState, t *lua.LTable, skipSinks bool) (map[string]string, error) {
+	var section = make(map[string]string)
+	var err error
+	core.ForEach(L, t, func(k lua.LValue, v lua.LValue) {
+		var key = k.String()
+		if skipSinks && key == "sinks" {
+			return
+		}
+		if rename, ok := v.(*lua.LTable); ok && key == "rename" {
+			var pairs []string
+			core.ForEach(L, rename, func(from lua.LValue, to lua.LValue) {
+				pairs = append(pairs, from.String()+"="+to.String())
+			})
+			section[key] = strings.Join(pairs, ",")
+			return
+		}
+		if n, ok := v.(lua.LNumber); ok && key == "mode" {
+			section[key] = strconv.FormatUint(uint64(n), 8)
+			return
+		}
+		if _, ok := v.(*lua.LTable); ok {
+			err = fmt.Errorf("logger: invalid %s", key)
+		}
+		section[key] = v.String()
+	})
+	return section, err
+}
+
+// Validate 校验格式与重命名的字段
+func (opts *Options) Validate() error {
+	switch opts.Format {
+	case "", FormatText, FormatJSON, FormatLogfmt:
+	default:
+		return fmt.Errorf("logger: unknown format %q", opts.Format)
+	}
+	for key := range opts.Rename {
+		if !renameKeys[key] {
+			return fmt.Errorf("logger: can not rename field %q", key)
+		}
+	}
+	switch opts.Rotate {
+	case "", PeriodHourly, PeriodDaily:
+	default:
+		return fmt.Errorf("logger: unknown rotate period %q", opts.Rotate)
+	}
+	switch opts.Caller {
+	case "", CallerNone, CallerFields, CallerPrefix:
+	default:
+		return fmt.Errorf("logger: unknown caller mode %q", opts.Caller)
+	}
+	if len(opts.Sinks) > 0 && opts.File != "" {
+		return fmt.Errorf("logger: file can not be combined with sinks, use a file sink")
+	}
+	return nil
+}
+
+// RotateOptions 文件轮转配置, 未配置任何轮转项时返回 nil
+func (opts *Options) RotateOptions() *RotateOptions {
+	if opts.MaxSize <= 0 && opts.Rotate == "" && opts.MaxBackups <= 0 && opts.MaxAge <= 0 && !opts.Compress {
+		return nil
+	}
+	return &RotateOptions{
+		MaxSize:    opts.MaxSize,
+		Period:     opts.Rotate,
+		MaxBackups: opts.MaxBackups,
+		MaxAge:     opts.MaxAge,
+		Compress:   opts.Compress,
+		Mode:       opts.Mode,
+	}
+}
+
+// Formatter 按配置创建 logrus.Formatter
+func (opts *Options) Formatter() (logrus.Formatter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	var fieldMap = opts.fieldMap()
+	switch opts.Format {
+	case FormatJSON:
+		return &logrus.JSONFormatter{TimestampFormat: opts.TimestampFormat, FieldMap: fieldMap}, nil
+	case FormatLogfmt:
+		return &logrus.TextFormatter{
+			DisableColors:    true,
+			FullTimestamp:    true,
+			QuoteEmptyFields: true,
+			TimestampFormat:  opts.TimestampFormat,
+			FieldMap:         fieldMap,
+		}, nil
+	}
+	return &logrus.TextFormatter{
+		ForceColors:     opts.Colors,
+		DisableColors:   !opts.Colors,
+		FullTimestamp:   opts.TimestampFormat != "",
+		TimestampFormat: opts.TimestampFormat,
+		FieldMap:        fieldMap,
+	}, nil
+}
+
+// fieldMap logrus.FieldMap 的 key 类型未导出, 只能以常量赋值
+func (opts *Options) fieldMap() logrus.FieldMap {
+	var fieldMap = make(logrus.FieldMap, len(opts.Rename))
+	for key, name := range opts.Rename {
+		switch key {
+		case logrus.FieldKeyMsg:
+			fieldMap[logrus.FieldKeyMsg] = name
+		case logrus.FieldKeyLevel:
+			fieldMap[logrus.FieldKeyLevel] = name
+		case logrus.FieldKeyTime:
+			fieldMap[logrus.FieldKeyTime] = name
+		case logrus.FieldKeyFunc:
+			fieldMap[logrus.FieldKeyFunc] = name
+		case logrus.FieldKeyFile:
+			fieldMap[logrus.FieldKeyFile] = name
+		}
+	}
+	return fieldMap
+}
+
+// New 按配置创建 logger, 未配置轮转且输出文件无法打开时保留标准错误输出; 配置 Sinks 时按级别分发到各输出
+func New(opts *Options) (*LuaFunctionTable, error) {
+	var formatter, err = opts.Formatter()
+	if err != nil {
+		return nil, err
+	}
+	var logger = NewLogger()
+	if opts.Caller == CallerPrefix {
+		formatter = &callerFormatter{Formatter: formatter}
+	}
+	logger.logger.Formatter = formatter
+	logger.caller, logger.callerDepth = opts.Caller, opts.CallerDepth
+	if len(opts.Sinks) > 0 {
+		var tee, level, err = newTee(opts)
+		if err != nil {
+			return nil, err
+		}
+		logger.tee = tee
+		logger.logger.Out, logger.logger.Formatter = ioutil.Discard, discardFormatter{}
+		logger.logger.SetLevel(level)
+		logger.logger.AddHook(tee)
+		runtime.SetFinalizer(logger, (*LuaFunctionTable).destroy)
+	} else if rotate := opts.RotateOptions(); opts.File != "" && rotate != nil {
+		var out, err = NewRotatingFile(opts.File, *rotate)
+		if err != nil {
+			return nil, err
+		}
+		logger.logger.Out = out
+		runtime.SetFinalizer(logger, (*LuaFunctionTable).destroy)
+	} else if opts.File != "" {
+		var mode []os.FileMode
+		if opts.Mode != 0 {
+			mode = append(mode, opts.Mode)
+		}
+		var out, err = openOut(opts.File, mode...)
+		if err != nil {
+			return nil, err
+		}
+		logger.logger.Out = out
+		runtime.SetFinalizer(logger, (*LuaFunctionTable).destroy)
+	}
+	if opts.Level != "" {
+		logger.setLevel(opts.Level)
+	}
+	if opts.Service != "" {
+		logger.fields = logrus.Fields{ServiceField: opts.Service}
+	}
+	if limit := opts.LimitOptions(); limit != nil {
+		logger.limiter = NewLimiter(*limit, logger.logger)
+		logger.limiter.Start()
+		runtime.SetFinalizer(logger, (*LuaFunctionTable).destroy)
+	}
+	return logger, nil
+}
+
+// Shared 获取 opts 对应的 logger, 首次调用时创建; rt 关闭时释放, 全部使用者关闭后关闭 logger 的输出
+func Shared(rt *core.Runtime, opts *Options) (*LuaFunctionTable, error) {
+	loggers.safe.Lock()
+	var logger, ok = loggers.items[opts]
+	if !ok {
+		var err error
+		if logger, err = New(opts); err != nil {
+			loggers.safe.Unlock()
+			return nil, err
+		}
+		loggers.items[opts] = logger
+	}
+	loggers.refs[opts]++
+	loggers.safe.Unlock()
+	rt.OnClose(func() {
+		release(opts)
+	})
+	return logger, nil
+}
+
+// release 释放一次 opts 对应 logger 的引用
+func release(opts *Options) {
+	loggers.safe.Lock()
+	var logger = loggers.items[opts]
+	if loggers.refs[opts]--; loggers.refs[opts] > 0 {
+		loggers.safe.Unlock()
+		return
+	}
+	delete(loggers.items, opts)
+	delete(loggers.refs, opts)
+	loggers.safe.Unlock()
+	if logger != nil {
+		logger.destroy()
+	}
+}
+
+// parseSize 解析 "100MB", "512KB", "1GB" 或字节数
+func parseSize(value string) (int64, error) {
+	var (
+		upper = strings.ToUpper(strings.TrimSpace(value))
+		unit  = int64(1)
+	)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, suffix.name) {
+			upper, unit = strings.TrimSpace(strings.TrimSuffix(upper, suffix.name)), suffix.size
+			break
+		}
+	}
+	var n, err = strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * unit, nil
+}
+
+// parseAge 解析 time.Duration, 以天为单位的 "7d" 或秒数
+func parseAge(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		var days, err = strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
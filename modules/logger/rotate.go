@@ -0,0 +1,366 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type (
+	// RotateOptions 日志文件轮转配置, 零值不轮转
+	RotateOptions struct {
+		// MaxSize 单个文件的最大字节数, 0 不限制
+		MaxSize int64
+		// Period 按时间轮转: hourly 或 daily
+		Period string
+		// MaxBackups 保留的轮转文件数, 0 不限制
+		MaxBackups int
+		// MaxAge 轮转文件的保留时间, 0 不限制
+		MaxAge time.Duration
+		// Compress 以 gzip 压缩轮转文件
+		Compress bool
+		Mode     os.FileMode
+		Clock    core.Clock
+	}
+
+	// RotatingFile 可轮转的日志文件, 轮转文件命名为 "<name>-<时间><ext>[.gz]"
+	RotatingFile struct {
+		safe    sync.Mutex
+		file    string
+		opts    RotateOptions
+		fd      *os.File
+		size    int64
+		period  time.Time
+		closed  bool
+		pending sync.WaitGroup
+	}
+)
+
+const (
+	PeriodHourly = "hourly"
+	PeriodDaily  = "daily"
+
+	backupTimeFormat = "20060102T150405"
+	compressSuffix   = ".gz"
+)
+
+var (
+	// rotating 已打开的文件, 供 ReopenAll 使用
+	rotating = struct {
+		safe  sync.Mutex
+		files map[*RotatingFile]bool
+	}{files: make(map[*RotatingFile]bool)}
+)
+
+// NewRotatingFile 打开 (或创建) 日志文件
+func NewRotatingFile(file string, opts RotateOptions) (*RotatingFile, error) {
+	switch opts.Period {
+	case "", PeriodHourly, PeriodDaily:
+	default:
+		return nil, fmt.Errorf("logger: unknown rotate period %q", opts.Period)
+	}
+	if opts.Mode == 0 {
+		opts.Mode = 0644
+	}
+	if opts.Clock == nil {
+		opts.Clock = core.SystemClock
+	}
+	var abs, err = filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	var rf = &RotatingFile{file: abs, opts: opts}
+	if err = rf.open(); err != nil {
+		return nil, err
+	}
+	rotating.safe.Lock()
+	rotating.files[rf] = true
+	rotating.safe.Unlock()
+	return rf, nil
+}
+
+// ReopenAll 重新打开全部轮转文件 (外部工具移动文件之后)
+func ReopenAll() {
+	rotating.safe.Lock()
+	var files = make([]*RotatingFile, 0, len(rotating.files))
+	for rf := range rotating.files {
+		files = append(files, rf)
+	}
+	rotating.safe.Unlock()
+	for _, rf := range files {
+		_ = rf.Reopen()
+	}
+}
+
+// ReopenOnSIGHUP 收到 SIGHUP 时调用 ReopenAll, 返回停止监听的函数
+// 只供宿主显式调用, 已有信号处理的宿主应在其中直接调用 ReopenAll
+func ReopenOnSIGHUP() (stop func()) {
+	var (
+		ch   = make(chan os.Signal, 1)
+		done = make(chan struct{})
+		once sync.Once
+	)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				ReopenAll()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+func (rf *RotatingFile) Name() string {
+	return rf.file
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.safe.Lock()
+	defer rf.safe.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.fd == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.due(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	var n, err = rf.fd.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate 立即轮转
+func (rf *RotatingFile) Rotate() error {
+	rf.safe.Lock()
+	defer rf.safe.Unlock()
+	return rf.rotate()
+}
+
+// Reopen 关闭并重新打开同名文件
+func (rf *RotatingFile) Reopen() error {
+	rf.safe.Lock()
+	defer rf.safe.Unlock()
+	if rf.closed {
+		return os.ErrClosed
+	}
+	if rf.fd != nil {
+		_ = rf.fd.Close()
+		rf.fd = nil
+	}
+	return rf.open()
+}
+
+// Close 关闭文件并等待进行中的压缩与清理, 之后的写入返回 os.ErrClosed
+func (rf *RotatingFile) Close() error {
+	rotating.safe.Lock()
+	delete(rotating.files, rf)
+	rotating.safe.Unlock()
+	rf.safe.Lock()
+	var err error
+	rf.closed = true
+	if rf.fd != nil {
+		err = rf.fd.Close()
+		rf.fd = nil
+	}
+	rf.safe.Unlock()
+	rf.pending.Wait()
+	return err
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.file), 0755); err != nil {
+		return err
+	}
+	var fd, err = os.OpenFile(rf.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, rf.opts.Mode)
+	if err != nil {
+		return err
+	}
+	var info os.FileInfo
+	if info, err = fd.Stat(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	rf.fd, rf.size = fd, info.Size()
+	rf.period = rf.periodOf(rf.opts.Clock.Now())
+	if rf.size > 0 && rf.opts.Period != "" {
+		rf.period = rf.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+// due 写入 n 字节前是否需要轮转
+func (rf *RotatingFile) due(n int64) bool {
+	if rf.opts.MaxSize > 0 && rf.size > 0 && rf.size+n > rf.opts.MaxSize {
+		return true
+	}
+	return rf.opts.Period != "" && rf.size > 0 && !rf.periodOf(rf.opts.Clock.Now()).Equal(rf.period)
+}
+
+func (rf *RotatingFile) periodOf(t time.Time) time.Time {
+	switch rf.opts.Period {
+	case PeriodHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case PeriodDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+func (rf *RotatingFile) rotate() error {
+	if rf.fd != nil {
+		if err := rf.fd.Close(); err != nil {
+			return err
+		}
+		rf.fd = nil
+	}
+	// 按时间轮转时以文件所属的周期命名, 而不是轮转发生的时间
+	var stamp = rf.opts.Clock.Now()
+	if rf.opts.Period != "" {
+		stamp = rf.period
+	}
+	var backup = rf.backupName(stamp)
+	if err := os.Rename(rf.file, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.pending.Add(1)
+	go func() {
+		defer rf.pending.Done()
+		if rf.opts.Compress {
+			_ = compress(backup)
+		}
+		rf.cleanup()
+	}()
+	return nil
+}
+
+// backupName 同一秒内多次轮转时追加序号
+func (rf *RotatingFile) backupName(now time.Time) string {
+	var (
+		ext  = filepath.Ext(rf.file)
+		base = strings.TrimSuffix(rf.file, ext) + "-" + now.Format(backupTimeFormat)
+		name = base + ext
+	)
+	for i := 1; exists(name) || exists(name+compressSuffix); i++ {
+		name = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return name
+}
+
+// backups 轮转文件, 按时间从新到旧排列
+func (rf *RotatingFile) backups() []os.FileInfo {
+	var (
+		dir    = filepath.Dir(rf.file)
+		ext    = filepath.Ext(rf.file)
+		prefix = strings.TrimSuffix(filepath.Base(rf.file), ext) + "-"
+		list   []os.FileInfo
+	)
+	var items, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, item := range items {
+		var name = strings.TrimSuffix(item.Name(), compressSuffix)
+		if item.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		if _, err = time.Parse(backupTimeFormat, strings.SplitN(strings.TrimPrefix(name, prefix), ".", 2)[0]); err != nil {
+			continue
+		}
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		var ti, si = backupOrder(list[i].Name(), prefix)
+		var tj, sj = backupOrder(list[j].Name(), prefix)
+		if ti != tj {
+			return ti > tj
+		}
+		return si > sj
+	})
+	return list
+}
+
+// backupOrder 轮转文件名中的时间与序号
+func backupOrder(name, prefix string) (string, int) {
+	var (
+		parts = strings.SplitN(strings.TrimPrefix(name, prefix), ".", 3)
+		seq   = 0
+	)
+	if len(parts) == 3 {
+		seq, _ = strconv.Atoi(parts[1])
+	}
+	return parts[0], seq
+}
+
+// cleanup 按数量与保留时间删除旧的轮转文件
+func (rf *RotatingFile) cleanup() {
+	var (
+		dir = filepath.Dir(rf.file)
+		now = rf.opts.Clock.Now()
+	)
+	for i, item := range rf.backups() {
+		var expired = rf.opts.MaxAge > 0 && now.Sub(item.ModTime()) > rf.opts.MaxAge
+		if (rf.opts.MaxBackups > 0 && i >= rf.opts.MaxBackups) || expired {
+			_ = os.Remove(filepath.Join(dir, item.Name()))
+		}
+	}
+}
+
+func compress(file string) error {
+	var src, err = os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	dst, err := os.OpenFile(file+compressSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var writer = gzip.NewWriter(dst)
+	if _, err = io.Copy(writer, src); err == nil {
+		err = writer.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file + compressSuffix)
+		return err
+	}
+	return os.Remove(file)
+}
+
+func exists(file string) bool {
+	var _, err = os.Stat(file)
+	return err == nil
+}
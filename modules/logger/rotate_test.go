@@ -0,0 +1,129 @@
+package logger
+
+import (
+	"compress/gzip"
+	"github.com/weblfe/plugin_lua/core"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	var items, err = ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, item := range items {
+		names = append(names, item.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotateBySize(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		clock = core.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	)
+	var rf, err = NewRotatingFile(filepath.Join(dir, "app.log"), RotateOptions{MaxSize: 10, MaxBackups: 2, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err = rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		clock.Add(time.Second)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var names = strings.Join(listDir(t, dir), ",")
+	if names != "app-20240101T000002.log,app-20240101T000003.log,app.log" {
+		t.Fatalf("unexpected files %s", names)
+	}
+	var data, _ = ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if string(data) != "fourth\n" {
+		t.Errorf("unexpected current file %q", data)
+	}
+}
+
+func TestRotateByPeriod(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		clock = core.NewManualClock(time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC))
+	)
+	var rf, err = NewRotatingFile(filepath.Join(dir, "app.log"), RotateOptions{Period: PeriodDaily, Compress: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = rf.Write([]byte("day one\n"))
+	clock.Add(20 * time.Minute)
+	_, _ = rf.Write([]byte("day one again\n"))
+	clock.Add(20 * time.Minute)
+	_, _ = rf.Write([]byte("day two\n"))
+	_ = rf.Close()
+	var names = listDir(t, dir)
+	// 轮转文件以其覆盖的日期命名, 而不是轮转发生的时间
+	if strings.Join(names, ",") != "app-20240101T000000.log.gz,app.log" {
+		t.Fatalf("unexpected files %v", names)
+	}
+	var fd, _ = os.Open(filepath.Join(dir, names[0]))
+	defer fd.Close()
+	var reader, gzErr = gzip.NewReader(fd)
+	if gzErr != nil {
+		t.Fatal(gzErr)
+	}
+	var data, _ = ioutil.ReadAll(reader)
+	if string(data) != "day one\nday one again\n" {
+		t.Errorf("unexpected rotated content %q", data)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		file = filepath.Join(dir, "app.log")
+	)
+	var rf, err = NewRotatingFile(file, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	_, _ = rf.Write([]byte("before\n"))
+	if err = os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	ReopenAll()
+	_, _ = rf.Write([]byte("after\n"))
+	var data, _ = ioutil.ReadFile(file)
+	if string(data) != "after\n" {
+		t.Errorf("unexpected content after reopen %q", data)
+	}
+}
+
+func TestRotateOptions(t *testing.T) {
+	var opts, err = ParseOptions(map[string]string{"max_size": "10MB", "rotate": "hourly", "max_backups": "3", "max_age": "7d", "compress": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotate = opts.RotateOptions()
+	if rotate == nil || rotate.MaxSize != 10<<20 || rotate.Period != PeriodHourly || rotate.MaxBackups != 3 || rotate.MaxAge != 7*24*time.Hour || !rotate.Compress {
+		t.Errorf("unexpected rotate options %+v", rotate)
+	}
+	if _, err = ParseOptions(map[string]string{"rotate": "weekly"}); err == nil {
+		t.Error("expected unknown period error")
+	}
+	// SIGHUP 由宿主通过 ReopenOnSIGHUP 或 ReopenAll 处理, 不能由插件配置开启
+	if _, err = ParseOptions(map[string]string{"reopen_on_sighup": "true"}); err == nil {
+		t.Error("expected reopen_on_sighup to be rejected")
+	}
+	if (&Options{}).RotateOptions() != nil {
+		t.Error("expected no rotation by default")
+	}
+}
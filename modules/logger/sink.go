@@ -0,0 +1,178 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type (
+	// Record 交给 Sink 的一条日志
+	Record struct {
+		Time    time.Time
+		Level   logrus.Level
+		Message string
+		Fields  logrus.Fields
+	}
+
+	// Sink 通用的日志输出, 由宿主实现
+	Sink interface {
+		Log(record *Record) error
+	}
+
+	// SinkFunc 函数形式的 Sink
+	SinkFunc func(record *Record) error
+
+	// Handler log/slog 风格的处理器: Enabled 过滤级别, Handle 输出
+	Handler interface {
+		Enabled(level logrus.Level) bool
+		Handle(record *Record) error
+	}
+
+	logrusSink struct {
+		logger *logrus.Logger
+	}
+
+	handlerSink struct {
+		handler Handler
+	}
+
+	// sinkHook 将插件 logger 的日志转发给 Sink
+	sinkHook struct {
+		sink Sink
+	}
+
+	discardFormatter struct{}
+)
+
+const (
+	// FieldPlugin 插件名字段, 运行时设置了插件名时附加到每条日志
+	FieldPlugin = "plugin"
+)
+
+var (
+	ErrUnsupportedSink = errors.New("unsupported logger sink")
+
+	// sinkLoggers 各运行时注入 Sink 的 logger, 运行时关闭时移除
+	sinkLoggers sync.Map
+)
+
+// NewSink 转换宿主提供的日志输出: *logrus.Logger, Handler 或 Sink, nil 返回 nil
+func NewSink(v interface{}) (Sink, error) {
+	switch sink := v.(type) {
+	case nil:
+		return nil, nil
+	case Sink:
+		return sink, nil
+	case Handler:
+		return &handlerSink{handler: sink}, nil
+	case *logrus.Logger:
+		return &logrusSink{logger: sink}, nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedSink, v)
+}
+
+func (fn SinkFunc) Log(record *Record) error {
+	return fn(record)
+}
+
+// Log 经宿主 logger 输出, 级别, hooks 与格式均由宿主控制
+func (s *logrusSink) Log(record *Record) error {
+	if !s.logger.IsLevelEnabled(record.Level) {
+		return nil
+	}
+	s.logger.WithFields(record.Fields).WithTime(record.Time).Log(record.Level, record.Message)
+	return nil
+}
+
+func (s *handlerSink) Log(record *Record) error {
+	if !s.handler.Enabled(record.Level) {
+		return nil
+	}
+	return s.handler.Handle(record)
+}
+
+func (h *sinkHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *sinkHook) Fire(entry *logrus.Entry) error {
+	var fields = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = v
+	}
+	return h.sink.Log(&Record{Time: entry.Time, Level: entry.Level, Message: entry.Message, Fields: fields})
+}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// NewSinkLogger 创建输出到 sink 的 logger, 自身不写入 Out; 级别为 trace, 由 sink 按宿主当前的级别过滤
+func NewSinkLogger(sink Sink) *LuaFunctionTable {
+	var logger = NewLogger()
+	logger.logger.Out = ioutil.Discard
+	logger.logger.Formatter = discardFormatter{}
+	logger.logger.SetLevel(logrus.TraceLevel)
+	logger.logger.AddHook(&sinkHook{sink: sink})
+	return logger
+}
+
+// ForRuntime 获取运行时注入 Sink (Runtime.Logger) 的 logger, 未注入或类型不支持时返回 nil
+func ForRuntime(rt *core.Runtime) *LuaFunctionTable {
+	if rt == nil || rt.Logger == nil {
+		return nil
+	}
+	if logger, ok := sinkLoggers.Load(rt); ok {
+		return logger.(*LuaFunctionTable)
+	}
+	var sink, err = NewSink(rt.Logger)
+	if err != nil || sink == nil {
+		return nil
+	}
+	var logger, loaded = sinkLoggers.LoadOrStore(rt, NewSinkLogger(sink))
+	if !loaded {
+		rt.OnClose(func() {
+			sinkLoggers.Delete(rt)
+		})
+	}
+	return logger.(*LuaFunctionTable)
+}
+
+// For 供各模块写日志: 使用宿主注入的 Sink, 未注入时使用默认 logger, 附加 plugin 字段
+func For(L *lua.LState) *logrus.Entry {
+	var logger = defaultLogger
+	if l := ForRuntime(core.GetRuntime(L)); l != nil {
+		logger = l
+	}
+	return logger.entryL(L)
+}
+
+// Entry 供宿主在 lua 调用之外写插件日志 (如 http handler 的错误), 与 For 使用相同的输出与 plugin 字段
+func Entry(rt *core.Runtime) *logrus.Entry {
+	var logger = defaultLogger
+	if l := ForRuntime(rt); l != nil {
+		logger = l
+	}
+	var entry = logger.entry()
+	if rt != nil && rt.Name != "" {
+		entry = entry.WithField(FieldPlugin, rt.Name)
+	}
+	return entry
+}
+
+// pluginEntry 运行时设置了插件名时附加 plugin 字段
+func pluginEntry(L *lua.LState, entry *logrus.Entry) *logrus.Entry {
+	if L == nil {
+		return entry
+	}
+	if name := core.GetRuntime(L).Name; name != "" {
+		return entry.WithField(FieldPlugin, name)
+	}
+	return entry
+}
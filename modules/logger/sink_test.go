@@ -0,0 +1,135 @@
+package logger
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+type levelHandler struct {
+	level   logrus.Level
+	records []*Record
+}
+
+func (h *levelHandler) Enabled(level logrus.Level) bool {
+	return level <= h.level
+}
+
+func (h *levelHandler) Handle(record *Record) error {
+	h.records = append(h.records, record)
+	return nil
+}
+
+func TestHostLogger(t *testing.T) {
+	var (
+		L          = lua.NewState()
+		host, hook = test.NewNullLogger()
+		rt         = core.GetRuntime(L)
+	)
+	defer L.Close()
+	host.SetLevel(logrus.InfoLevel)
+	rt.Name, rt.Logger = "orders", host
+	L.PreloadModule(Name, NewLuaLoggerTables())
+	var err = L.DoString(`
+local log = require("logger")
+log.info("order created", {id = 7})
+log.debug("hidden")
+log.withFields({step = 2}).logErrorLn("failed")
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries = hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Message != "order created" || e.Data[FieldPlugin] != "orders" || e.Data["id"] != float64(7) {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries[1]; e.Level != logrus.ErrorLevel || e.Data["step"] != float64(2) || e.Data[FieldPlugin] != "orders" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	For(L).Warn("from module")
+	if e := hook.LastEntry(); e.Message != "from module" || e.Data[FieldPlugin] != "orders" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	// 宿主之后调低级别, 插件的 debug 日志随之输出
+	host.SetLevel(logrus.DebugLevel)
+	if err = L.DoString(`require("logger").debug("now visible")`); err != nil {
+		t.Fatal(err)
+	}
+	if e := hook.LastEntry(); e.Message != "now visible" || e.Level != logrus.DebugLevel {
+		t.Errorf("host level change not applied, last entry %+v", e)
+	}
+	Entry(rt).Error("from host")
+	if e := hook.LastEntry(); e.Message != "from host" || e.Data[FieldPlugin] != "orders" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	rt.Close()
+	if _, ok := sinkLoggers.Load(rt); ok {
+		t.Error("sink logger not released on close")
+	}
+}
+
+func TestModule_OptionsError(t *testing.T) {
+	var (
+		L          = lua.NewState()
+		host, hook = test.NewNullLogger()
+		rt         = core.GetRuntime(L)
+		parent     = filepath.Join(t.TempDir(), "file")
+	)
+	defer L.Close()
+	if err := ioutil.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 日志文件无法打开: 记录错误并使用宿主的输出
+	rt.Name, rt.Logger = "orders", host
+	rt.Options = map[string]interface{}{Name: &Options{File: filepath.Join(parent, "app.log")}}
+	L.PreloadModule(Name, NewLuaLoggerTables())
+	if err := L.DoString(`require("logger").info("after fallback")`); err != nil {
+		t.Fatal(err)
+	}
+	var entries = hook.AllEntries()
+	if len(entries) != 2 || entries[0].Level != logrus.ErrorLevel || entries[0].Data[logrus.ErrorKey] == nil ||
+		entries[0].Data[FieldPlugin] != "orders" || entries[1].Message != "after fallback" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	var handler = &levelHandler{level: logrus.WarnLevel}
+	var sink, err = NewSink(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logger = NewSinkLogger(sink)
+	logger.entry().Info("dropped")
+	logger.WithFields(logrus.Fields{"a": 1}).entry().Error("kept")
+	if len(handler.records) != 1 || handler.records[0].Message != "kept" || handler.records[0].Fields["a"] != 1 {
+		t.Errorf("unexpected records %+v", handler.records)
+	}
+
+	var messages []string
+	if sink, err = NewSink(SinkFunc(func(record *Record) error {
+		messages = append(messages, record.Message)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	NewSinkLogger(sink).entry().Trace("all levels")
+	if len(messages) != 1 {
+		t.Errorf("unexpected messages %v", messages)
+	}
+
+	if _, err = NewSink("stderr"); !errors.Is(err, ErrUnsupportedSink) {
+		t.Errorf("expected ErrUnsupportedSink, got %v", err)
+	}
+	if sink, err = NewSink(nil); sink != nil || err != nil {
+		t.Errorf("expected nil sink, got %v %v", sink, err)
+	}
+}
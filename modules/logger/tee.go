@@ -0,0 +1,298 @@
+package logger
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// SinkOptions logger 的一个输出, 配置于 Options.Sinks 或 lua create{sinks={...}}
+	SinkOptions struct {
+		// Type stdout, stderr, file 或 memory
+		Type string
+		// Name memory 输出的名称, 供 lua logger.buffer(name) 读取
+		Name string
+		// Size memory 输出保留的条数, 0 使用 DefaultBufferSize
+		Size int
+		// Options 该输出的最低级别, 格式, 文件与轮转配置, 未配置的格式项继承 logger 的配置
+		Options
+	}
+
+	// RingBuffer 保留最近 size 条日志的内存输出
+	RingBuffer struct {
+		safe  sync.Mutex
+		lines []string
+		next  int
+		full  bool
+	}
+
+	// tee 按各输出的级别与格式分发日志
+	tee struct {
+		safe   sync.Mutex
+		sinks  []*teeSink
+		closed bool
+	}
+
+	teeSink struct {
+		name      string
+		level     logrus.Level
+		formatter logrus.Formatter
+		out       io.Writer
+		buffer    *RingBuffer
+	}
+)
+
+const (
+	SinkStdout = "stdout"
+	SinkStderr = "stderr"
+	SinkFile   = "file"
+	SinkMemory = "memory"
+
+	DefaultBufferSize = 1000
+)
+
+// ParseSinkOptions 解析字符串形式的输出配置, 除 type, name, size 外与 ParseOptions 相同
+func ParseSinkOptions(section map[string]string) (*SinkOptions, error) {
+	var (
+		sink = new(SinkOptions)
+		rest = make(map[string]string, len(section))
+	)
+	for key, value := range section {
+		switch key {
+		case "type":
+			sink.Type = value
+		case "name":
+			sink.Name = value
+		case "size":
+			var size, err = strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("logger: invalid sink size %q", value)
+			}
+			sink.Size = size
+		default:
+			rest[key] = value
+		}
+	}
+	var opts, err = ParseOptions(rest)
+	if err != nil {
+		return nil, err
+	}
+	sink.Options = *opts
+	return sink, sink.Validate()
+}
+
+// Validate 校验输出类型与级别
+func (sink *SinkOptions) Validate() error {
+	switch sink.Type {
+	case SinkStdout, SinkStderr, SinkMemory:
+	case SinkFile:
+		if sink.File == "" {
+			return fmt.Errorf("logger: file sink requires file")
+		}
+	default:
+		return fmt.Errorf("logger: unknown sink type %q", sink.Type)
+	}
+	if len(sink.Sinks) > 0 {
+		return fmt.Errorf("logger: nested sinks")
+	}
+	if sink.Level != "" {
+		if _, err := logrus.ParseLevel(sink.Level); err != nil {
+			return fmt.Errorf("logger: invalid sink level %q", sink.Level)
+		}
+	}
+	return sink.Options.Validate()
+}
+
+// formatter 未配置的格式项继承 logger 的配置
+func (sink *SinkOptions) formatter(parent *Options) (logrus.Formatter, error) {
+	var opts = sink.Options
+	if opts.Format == "" {
+		opts.Format = parent.Format
+	}
+	if opts.TimestampFormat == "" {
+		opts.TimestampFormat = parent.TimestampFormat
+	}
+	if opts.Rename == nil {
+		opts.Rename = parent.Rename
+	}
+	var formatter, err = opts.Formatter()
+	if err != nil {
+		return nil, err
+	}
+	if parent.Caller == CallerPrefix {
+		formatter = &callerFormatter{Formatter: formatter}
+	}
+	return formatter, nil
+}
+
+func (sink *SinkOptions) open() (io.Writer, *RingBuffer, error) {
+	switch sink.Type {
+	case SinkStdout:
+		return os.Stdout, nil, nil
+	case SinkStderr:
+		return os.Stderr, nil, nil
+	case SinkMemory:
+		var size = sink.Size
+		if size <= 0 {
+			size = DefaultBufferSize
+		}
+		var buffer = NewRingBuffer(size)
+		return buffer, buffer, nil
+	}
+	var rotate = RotateOptions{Mode: sink.Mode}
+	if r := sink.RotateOptions(); r != nil {
+		rotate = *r
+	}
+	var file, err = NewRotatingFile(sink.File, rotate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, nil, nil
+}
+
+// newTee 打开 opts.Sinks, 返回 logger 应使用的级别: 配置的 level, 否则为最详细的输出级别
+func newTee(opts *Options) (*tee, logrus.Level, error) {
+	var (
+		t     = new(tee)
+		level = logrus.PanicLevel
+	)
+	for _, sink := range opts.Sinks {
+		if err := sink.Validate(); err != nil {
+			_ = t.Close()
+			return nil, 0, err
+		}
+		var formatter, err = sink.formatter(opts)
+		if err != nil {
+			_ = t.Close()
+			return nil, 0, err
+		}
+		var s = &teeSink{name: sink.Name, level: logrus.TraceLevel, formatter: formatter}
+		if sink.Level != "" {
+			s.level, _ = logrus.ParseLevel(sink.Level)
+		}
+		if s.out, s.buffer, err = sink.open(); err != nil {
+			_ = t.Close()
+			return nil, 0, err
+		}
+		if s.level > level {
+			level = s.level
+		}
+		t.sinks = append(t.sinks, s)
+	}
+	if opts.Level != "" {
+		if l, err := logrus.ParseLevel(opts.Level); err == nil {
+			level = l
+		}
+	}
+	return t, level, nil
+}
+
+func (t *tee) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire 写入级别满足的输出, 返回第一个错误
+func (t *tee) Fire(entry *logrus.Entry) error {
+	t.safe.Lock()
+	defer t.safe.Unlock()
+	if t.closed {
+		return nil
+	}
+	var first error
+	for _, s := range t.sinks {
+		if entry.Level > s.level {
+			continue
+		}
+		var data, err = s.formatter.Format(entry)
+		if err == nil {
+			_, err = s.out.Write(data)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// buffer 名为 name 的 memory 输出, name 为空时取第一个
+func (t *tee) buffer(name string) *RingBuffer {
+	for _, s := range t.sinks {
+		if s.buffer != nil && (name == "" || s.name == name) {
+			return s.buffer
+		}
+	}
+	return nil
+}
+
+// Close 关闭文件输出, 之后的日志被丢弃
+func (t *tee) Close() error {
+	t.safe.Lock()
+	defer t.safe.Unlock()
+	t.closed = true
+	var first error
+	for _, s := range t.sinks {
+		if file, ok := s.out.(*RotatingFile); ok {
+			if err := file.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &RingBuffer{lines: make([]string, size)}
+}
+
+// Write 每次写入为一条日志, 去除末尾换行
+func (b *RingBuffer) Write(p []byte) (int, error) {
+	b.safe.Lock()
+	defer b.safe.Unlock()
+	b.lines[b.next] = strings.TrimRight(string(p), "\n")
+	if b.next = (b.next + 1) % len(b.lines); b.next == 0 {
+		b.full = true
+	}
+	return len(p), nil
+}
+
+// Lines 按写入顺序返回保留的日志
+func (b *RingBuffer) Lines() []string {
+	b.safe.Lock()
+	defer b.safe.Unlock()
+	if !b.full {
+		return append([]string(nil), b.lines[:b.next]...)
+	}
+	return append(append([]string(nil), b.lines[b.next:]...), b.lines[:b.next]...)
+}
+
+// Buffer 名为 name 的 memory 输出, 未配置时返回 nil
+func (l *LuaFunctionTable) Buffer(name string) *RingBuffer {
+	if l.tee == nil {
+		return nil
+	}
+	return l.tee.buffer(name)
+}
+
+// logBuffer logger.buffer([name]) lines | nil, 读取 memory 输出保留的日志
+func (l *LuaFunctionTable) logBuffer(L *lua.LState) int {
+	var buffer = l.Buffer(L.OptString(1, ""))
+	if buffer == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	var t = L.NewTable()
+	for _, line := range buffer.Lines() {
+		t.Append(lua.LString(line))
+	}
+	L.Push(t)
+	return 1
+}
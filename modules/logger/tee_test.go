@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	var (
+		L    = lua.NewState()
+		file = filepath.Join(t.TempDir(), "debug.log")
+	)
+	defer L.Close()
+	L.SetGlobal("create", L.NewFunction(Create))
+	L.SetGlobal("file", lua.LString(file))
+	var err = L.DoString(`
+local log = create{
+	format = "json",
+	sinks = {
+		{type = "file", file = file, level = "debug"},
+		{type = "memory", name = "recent", level = "warn", format = "text", size = 2},
+	},
+}
+assert(log.buffer("missing") == nil)
+log.debug("cache miss", {key = "a"})
+log.withFields({order_id = 1}).error("payment failed")
+log.warn("slow query")
+log.logTrace("hidden")
+local lines = log.buffer()
+assert(#lines == 2, #lines)
+assert(lines[1]:find("payment failed", 1, true), lines[1])
+assert(lines[2]:find("slow query", 1, true), lines[2])
+assert(log.getLevel() == "debug", log.getLevel())
+for _, bad in ipairs({
+	{sinks = {{type = "syslog"}}},
+	{sinks = {{type = "file"}}},
+	{sinks = {{type = "memory", level = "loud"}}},
+	{file = file, sinks = {{type = "stderr"}}},
+	{sinks = {"stderr"}},
+}) do
+	assert(not pcall(create, bad))
+end
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data, _ = ioutil.ReadFile(file)
+	var lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", data)
+	}
+	var entry map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "cache miss" || entry["level"] != "debug" || entry["key"] != "a" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	var buffer = NewRingBuffer(3)
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		_, _ = buffer.Write([]byte(line))
+	}
+	if lines := buffer.Lines(); !reflect.DeepEqual(lines, []string{"b", "c", "d"}) {
+		t.Errorf("unexpected lines %v", lines)
+	}
+	if lines := NewRingBuffer(3).Lines(); len(lines) != 0 {
+		t.Errorf("unexpected lines %v", lines)
+	}
+}
+
+func TestSinks_Close(t *testing.T) {
+	var (
+		L    = lua.NewState()
+		file = filepath.Join(t.TempDir(), "debug.log")
+	)
+	defer L.Close()
+	L.SetGlobal("create", L.NewFunction(Create))
+	L.SetGlobal("file", lua.LString(file))
+	if err := L.DoString(`
+log = create{sinks = {{type = "file", file = file}}}
+log.info("before close")
+log.close()
+`); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭之后的日志被丢弃, 不会重新创建文件
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`log.info("after close")`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("file recreated after close: %v", err)
+	}
+	var rf, err = NewRotatingFile(file, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rf.Close()
+	if _, err = rf.Write([]byte("line\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected os.ErrClosed, got %v", err)
+	}
+	if err = rf.Reopen(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected os.ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ContentType Prometheus 文本格式
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Handler 以 Prometheus 文本格式输出 reg 中的全部指标
+func Handler(reg *Registry) nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = reg.WriteText(w)
+	})
+}
+
+// WriteText 写出 Prometheus 文本格式
+func (reg *Registry) WriteText(w io.Writer) error {
+	var out = bufio.NewWriter(w)
+	for _, family := range reg.Families() {
+		var series = family.Series()
+		if len(series) == 0 {
+			continue
+		}
+		if family.Help != "" {
+			out.WriteString("# HELP " + family.Name + " " + helpEscaper.Replace(family.Help) + "\n")
+		}
+		out.WriteString("# TYPE " + family.Name + " " + string(family.Kind) + "\n")
+		for _, s := range series {
+			if family.Kind != KindHistogram {
+				writeSample(out, family.Name, family.Labels, s.values, s.Value())
+				continue
+			}
+			var counts, sum, count = s.Snapshot()
+			var labels = append(append([]string(nil), family.Labels...), "le")
+			for i, bound := range family.Buckets {
+				writeSample(out, family.Name+"_bucket", labels, append(s.LabelValues(), formatFloat(bound)), float64(counts[i]))
+			}
+			writeSample(out, family.Name+"_bucket", labels, append(s.LabelValues(), "+Inf"), float64(count))
+			writeSample(out, family.Name+"_sum", family.Labels, s.values, sum)
+			writeSample(out, family.Name+"_count", family.Labels, s.values, float64(count))
+		}
+	}
+	return out.Flush()
+}
+
+func writeSample(out *bufio.Writer, name string, labels, values []string, value float64) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(label + `="` + labelEscaper.Replace(values[i]) + `"`)
+		}
+		out.WriteByte('}')
+	}
+	out.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
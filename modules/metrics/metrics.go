@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	Funcs = map[string]lua.LGFunction{
+		"counter":   luaCounter,
+		"gauge":     luaGauge,
+		"histogram": luaHistogram,
+	}
+)
+
+const (
+	// PluginLabel 在具名插件中创建的指标自动附加的标签
+	PluginLabel = "plugin"
+)
+
+// GetRegistry 获取 L 所属插件的注册表, 通过 PluginOptions.ModuleOptions["metrics"] 注入 *Registry
+func GetRegistry(L *lua.LState) *Registry {
+	if reg, ok := core.GetRuntime(L).Option(Name).(*Registry); ok && reg != nil {
+		return reg
+	}
+	return DefaultRegistry()
+}
+
+// labelNames 读取标签名数组, 具名插件中追加 plugin 标签
+func labelNames(L *lua.LState, n int) ([]string, string) {
+	var (
+		names  []string
+		plugin = core.GetRuntime(L).Name
+	)
+	if t, ok := L.Get(n).(*lua.LTable); ok {
+		for i := 1; i <= t.Len(); i++ {
+			names = append(names, lua.LVAsString(t.RawGetInt(i)))
+		}
+	} else if L.Get(n) != lua.LNil {
+		L.TypeError(n, lua.LTTable)
+	}
+	if plugin != "" {
+		names = append(names, PluginLabel)
+	}
+	return names, plugin
+}
+
+// series 按 {name = value} 的标签表获取 Series
+func series(L *lua.LState, family *Family, plugin string, n int) *Series {
+	var (
+		values = make([]string, len(family.Labels))
+		labels = L.OptTable(n, L.NewTable())
+	)
+	for i, name := range family.Labels {
+		if name == PluginLabel && plugin != "" {
+			values[i] = plugin
+			continue
+		}
+		var v = labels.RawGetString(name)
+		if v == lua.LNil {
+			L.ArgError(n, "missing label "+name)
+		}
+		values[i] = lua.LVAsString(v)
+	}
+	var s, err = family.With(values...)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	return s
+}
+
+func check(L *lua.LState, err error) {
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+}
+
+func newObject(L *lua.LState, methods map[string]lua.LGFunction) *lua.LTable {
+	var t = L.NewTable()
+	for name, fn := range methods {
+		t.RawSetString(name, L.NewFunction(fn))
+	}
+	return t
+}
+
+// luaCounter metrics.counter(name, help [, labels]) counter; counter:inc([labels]), counter:add(v [, labels])
+func luaCounter(L *lua.LState) int {
+	var names, plugin = labelNames(L, 3)
+	var family, err = GetRegistry(L).Counter(L.CheckString(1), L.OptString(2, ""), names...)
+	check(L, err)
+	L.Push(newObject(L, map[string]lua.LGFunction{
+		"inc": func(L *lua.LState) int {
+			series(L, family, plugin, 2).Inc()
+			return 0
+		},
+		"add": func(L *lua.LState) int {
+			check(L, series(L, family, plugin, 3).Add(float64(L.CheckNumber(2))))
+			return 0
+		},
+	}))
+	return 1
+}
+
+// luaGauge metrics.gauge(name, help [, labels]) gauge; gauge:set(v [, labels]), gauge:add(v [, labels]), gauge:inc([labels]), gauge:dec([labels])
+func luaGauge(L *lua.LState) int {
+	var names, plugin = labelNames(L, 3)
+	var family, err = GetRegistry(L).Gauge(L.CheckString(1), L.OptString(2, ""), names...)
+	check(L, err)
+	L.Push(newObject(L, map[string]lua.LGFunction{
+		"set": func(L *lua.LState) int {
+			check(L, series(L, family, plugin, 3).Set(float64(L.CheckNumber(2))))
+			return 0
+		},
+		"add": func(L *lua.LState) int {
+			check(L, series(L, family, plugin, 3).Add(float64(L.CheckNumber(2))))
+			return 0
+		},
+		"inc": func(L *lua.LState) int {
+			series(L, family, plugin, 2).Inc()
+			return 0
+		},
+		"dec": func(L *lua.LState) int {
+			series(L, family, plugin, 2).Dec()
+			return 0
+		},
+	}))
+	return 1
+}
+
+// luaHistogram metrics.histogram(name, help [, buckets [, labels]]) histogram; histogram:observe(v [, labels])
+func luaHistogram(L *lua.LState) int {
+	var buckets []float64
+	if t, ok := L.Get(3).(*lua.LTable); ok {
+		for i := 1; i <= t.Len(); i++ {
+			var v, isNumber = t.RawGetInt(i).(lua.LNumber)
+			if !isNumber {
+				L.ArgError(3, "buckets must be numbers")
+			}
+			buckets = append(buckets, float64(v))
+		}
+	}
+	var names, plugin = labelNames(L, 4)
+	var family, err = GetRegistry(L).Histogram(L.CheckString(1), L.OptString(2, ""), buckets, names...)
+	check(L, err)
+	L.Push(newObject(L, map[string]lua.LGFunction{
+		"observe": func(L *lua.LState) int {
+			check(L, series(L, family, plugin, 3).Observe(float64(L.CheckNumber(2))))
+			return 0
+		},
+	}))
+	return 1
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	var reg = NewRegistry()
+	var requests, err = reg.Counter("requests_total", "Total requests.\nAll of them.", "method")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := reg.Counter("requests_total", "", "method"); again != requests {
+		t.Error("expected the registered family to be returned")
+	}
+	if _, err = reg.Gauge("requests_total", ""); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	if _, err = reg.Counter("bad-name", ""); err == nil {
+		t.Error("expected invalid name error")
+	}
+	if _, err = requests.With(); !errors.Is(err, ErrLabelValues) {
+		t.Errorf("expected ErrLabelValues, got %v", err)
+	}
+	var get, _ = requests.With(`GET "x"`)
+	get.Inc()
+	if err = get.Add(-1); err != ErrCounterDec {
+		t.Errorf("expected ErrCounterDec, got %v", err)
+	}
+	var latency, _ = reg.Histogram("latency_seconds", "", []float64{1, 0.1})
+	var s, _ = latency.With()
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		_ = s.Observe(v)
+	}
+	var temperature, _ = reg.Gauge("temperature", "")
+	var g, _ = temperature.With()
+	_ = g.Set(21.5)
+	g.Dec()
+
+	var rec = httptest.NewRecorder()
+	Handler(reg).ServeHTTP(rec, httptest.NewRequest(nethttp.MethodGet, "/metrics", nil))
+	if rec.Header().Get("Content-Type") != ContentType {
+		t.Errorf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	var expected = `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP requests_total Total requests.\nAll of them.
+# TYPE requests_total counter
+requests_total{method="GET \"x\""} 1
+# TYPE temperature gauge
+temperature 20.5
+`
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected exposition:\n%s", rec.Body.String())
+	}
+}
+
+func TestLuaMetrics(t *testing.T) {
+	var (
+		L   = lua.NewState()
+		rt  = core.NewRuntime()
+		reg = NewRegistry()
+	)
+	defer L.Close()
+	rt.Name = "orders"
+	rt.Options = map[string]interface{}{Name: reg}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaMetricsTables())
+	var err = L.DoString(`
+local metrics = require("metrics")
+local created = metrics.counter("orders_created_total", "Orders created.", {"status"})
+created:inc({status = "ok"})
+created:add(2, {status = "ok"})
+local queue = metrics.gauge("orders_queue", "Queued orders.")
+queue:set(5)
+queue:dec()
+local size = metrics.histogram("orders_size", "Order size.", {10, 100})
+size:observe(42)
+assert(not pcall(created.inc, created, {}))
+assert(not pcall(created.add, created, -1, {status = "ok"}))
+assert(not pcall(metrics.gauge, "orders_created_total", ""))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	_ = reg.WriteText(&out)
+	for _, line := range []string{
+		`orders_created_total{status="ok",plugin="orders"} 3`,
+		`orders_queue{plugin="orders"} 4`,
+		`orders_size_bucket{plugin="orders",le="100"} 1`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+}
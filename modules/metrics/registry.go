@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	Kind string
+
+	// Registry 指标注册表, 同名指标只能以相同的类型, 标签与分桶注册
+	Registry struct {
+		safe     sync.RWMutex
+		families map[string]*Family
+	}
+
+	// Family 同名指标, 按标签值区分 Series
+	Family struct {
+		Name    string
+		Help    string
+		Kind    Kind
+		Labels  []string
+		Buckets []float64
+		safe    sync.RWMutex
+		series  map[string]*Series
+	}
+
+	// Series 一组标签值对应的指标
+	Series struct {
+		safe   sync.Mutex
+		family *Family
+		values []string
+		value  float64
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+)
+
+const (
+	KindCounter   Kind = "counter"
+	KindGauge     Kind = "gauge"
+	KindHistogram Kind = "histogram"
+)
+
+var (
+	// DefBuckets 默认分桶 (秒)
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	ErrConflict     = errors.New("metric already registered with a different definition")
+	ErrLabelValues  = errors.New("label values do not match label names")
+	ErrCounterDec   = errors.New("counter can not decrease")
+	ErrKindMismatch = errors.New("operation not supported by metric kind")
+
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	defaultRegistry = NewRegistry()
+)
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*Family)}
+}
+
+// DefaultRegistry 未通过 PluginOptions.ModuleOptions["metrics"] 注入 *Registry 时使用的全局注册表
+func DefaultRegistry() *Registry {
+	return defaultRegistry
+}
+
+// Counter 注册 (或获取已注册的) 计数器
+func (reg *Registry) Counter(name, help string, labels ...string) (*Family, error) {
+	return reg.register(&Family{Name: name, Help: help, Kind: KindCounter, Labels: labels})
+}
+
+// Gauge 注册 (或获取已注册的) 仪表
+func (reg *Registry) Gauge(name, help string, labels ...string) (*Family, error) {
+	return reg.register(&Family{Name: name, Help: help, Kind: KindGauge, Labels: labels})
+}
+
+// Histogram 注册 (或获取已注册的) 直方图, buckets 为空时使用 DefBuckets
+func (reg *Registry) Histogram(name, help string, buckets []float64, labels ...string) (*Family, error) {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	if n := len(buckets); math.IsInf(buckets[n-1], 1) {
+		buckets = buckets[:n-1]
+	}
+	return reg.register(&Family{Name: name, Help: help, Kind: KindHistogram, Labels: labels, Buckets: buckets})
+}
+
+// Unregister 移除指标
+func (reg *Registry) Unregister(name string) {
+	reg.safe.Lock()
+	defer reg.safe.Unlock()
+	delete(reg.families, name)
+}
+
+// Families 全部指标, 按名称排序
+func (reg *Registry) Families() []*Family {
+	reg.safe.RLock()
+	defer reg.safe.RUnlock()
+	var list = make([]*Family, 0, len(reg.families))
+	for _, family := range reg.families {
+		list = append(list, family)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (reg *Registry) register(family *Family) (*Family, error) {
+	if !metricName.MatchString(family.Name) {
+		return nil, fmt.Errorf("invalid metric name %q", family.Name)
+	}
+	var seen = make(map[string]bool)
+	for _, label := range family.Labels {
+		if !labelName.MatchString(label) || strings.HasPrefix(label, "__") || label == "le" || seen[label] {
+			return nil, fmt.Errorf("metric %s: invalid label name %q", family.Name, label)
+		}
+		seen[label] = true
+	}
+	reg.safe.Lock()
+	defer reg.safe.Unlock()
+	if exists, ok := reg.families[family.Name]; ok {
+		if !exists.same(family) {
+			return nil, fmt.Errorf("%s: %w", family.Name, ErrConflict)
+		}
+		return exists, nil
+	}
+	family.series = make(map[string]*Series)
+	reg.families[family.Name] = family
+	return family, nil
+}
+
+func (family *Family) same(other *Family) bool {
+	if family.Kind != other.Kind || len(family.Labels) != len(other.Labels) || len(family.Buckets) != len(other.Buckets) {
+		return false
+	}
+	for i := range family.Labels {
+		if family.Labels[i] != other.Labels[i] {
+			return false
+		}
+	}
+	for i := range family.Buckets {
+		if family.Buckets[i] != other.Buckets[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// With 获取 (或创建) 标签值对应的 Series, 标签值按 Labels 的顺序给出
+func (family *Family) With(values ...string) (*Series, error) {
+	if len(values) != len(family.Labels) {
+		return nil, fmt.Errorf("%s: %w: expected %d, got %d", family.Name, ErrLabelValues, len(family.Labels), len(values))
+	}
+	var key = strings.Join(values, "\xff")
+	family.safe.RLock()
+	var series, ok = family.series[key]
+	family.safe.RUnlock()
+	if ok {
+		return series, nil
+	}
+	family.safe.Lock()
+	defer family.safe.Unlock()
+	if series, ok = family.series[key]; !ok {
+		series = &Series{family: family, values: append([]string(nil), values...)}
+		if family.Kind == KindHistogram {
+			series.counts = make([]uint64, len(family.Buckets))
+		}
+		family.series[key] = series
+	}
+	return series, nil
+}
+
+// Delete 移除标签值对应的 Series
+func (family *Family) Delete(values ...string) {
+	family.safe.Lock()
+	defer family.safe.Unlock()
+	delete(family.series, strings.Join(values, "\xff"))
+}
+
+// Series 全部 Series, 按标签值排序
+func (family *Family) Series() []*Series {
+	family.safe.RLock()
+	defer family.safe.RUnlock()
+	var list = make([]*Series, 0, len(family.series))
+	for _, series := range family.series {
+		list = append(list, series)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+	})
+	return list
+}
+
+// Inc counter/gauge 加 1
+func (series *Series) Inc() {
+	_ = series.Add(1)
+}
+
+// Dec gauge 减 1
+func (series *Series) Dec() {
+	_ = series.Add(-1)
+}
+
+// Add counter/gauge 加 v, counter 不接受负数
+func (series *Series) Add(v float64) error {
+	switch series.family.Kind {
+	case KindCounter:
+		if v < 0 {
+			return ErrCounterDec
+		}
+	case KindGauge:
+	default:
+		return ErrKindMismatch
+	}
+	series.safe.Lock()
+	series.value += v
+	series.safe.Unlock()
+	return nil
+}
+
+// Set 设置 gauge 的值
+func (series *Series) Set(v float64) error {
+	if series.family.Kind != KindGauge {
+		return ErrKindMismatch
+	}
+	series.safe.Lock()
+	series.value = v
+	series.safe.Unlock()
+	return nil
+}
+
+// Observe 直方图记录一次观测值
+func (series *Series) Observe(v float64) error {
+	var family = series.family
+	if family.Kind != KindHistogram {
+		return ErrKindMismatch
+	}
+	var i = sort.SearchFloat64s(family.Buckets, v)
+	series.safe.Lock()
+	if i < len(series.counts) {
+		series.counts[i]++
+	}
+	series.sum += v
+	series.count++
+	series.safe.Unlock()
+	return nil
+}
+
+// Value counter/gauge 的当前值
+func (series *Series) Value() float64 {
+	series.safe.Lock()
+	defer series.safe.Unlock()
+	return series.value
+}
+
+// Snapshot 直方图的累计分桶计数, 观测总和与次数
+func (series *Series) Snapshot() ([]uint64, float64, uint64) {
+	series.safe.Lock()
+	defer series.safe.Unlock()
+	var (
+		cumulative = make([]uint64, len(series.counts))
+		total      uint64
+	)
+	for i, n := range series.counts {
+		total += n
+		cumulative[i] = total
+	}
+	return cumulative, series.sum, series.count
+}
+
+// LabelValues 标签值, 与 Family.Labels 顺序一致
+func (series *Series) LabelValues() []string {
+	return append([]string(nil), series.values...)
+}
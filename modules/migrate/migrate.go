@@ -11,6 +11,7 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/github"
 	"github.com/sirupsen/logrus"
 	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/logger"
 	"github.com/weblfe/plugin_lua/query"
 	lua "github.com/yuin/gopher-lua"
 	"sort"
@@ -264,7 +265,7 @@ func (l *LuaMigrateTable) CreateTable(state *lua.LState) int {
 	)
 	if argc < 2 {
 		// @todo lua error
-		logrus.Error("createTable require less 2 params ")
+		l.getLogger(state).Error("createTable require less 2 params ")
 		return 0
 	}
 	var (
@@ -272,12 +273,12 @@ func (l *LuaMigrateTable) CreateTable(state *lua.LState) int {
 		obj        = args.GetTable(1)         // columns
 		reader     = state.GetGlobal(GBuffer) // buffer
 		appendSql  = args.GetString(2)        // append
-		columnsMap = CreateColumnMapByTable(obj)
+		columnsMap = CreateColumnMapByTable(obj, state)
 	)
 	// 执行sql 解析逻辑
 	switch reader.Type() {
 	case lua.LTNil:
-		logrus.Error("global sql buffer is nil")
+		l.getLogger(state).Error("global sql buffer is nil")
 		return 0
 	case lua.LTUserData:
 		var sql = l.createTable(tableName, columnsMap, appendSql)
@@ -323,8 +324,9 @@ func (l *LuaMigrateTable) createTable(table string, columns ColumnMap, append ..
 	return buffer.String()
 }
 
-func (l *LuaMigrateTable) getLogger() *logrus.Logger {
-	return logrus.New()
+// getLogger 经宿主注入的 logger 输出, 附加 module 字段
+func (l *LuaMigrateTable) getLogger(state *lua.LState) *logrus.Entry {
+	return logger.For(state).WithField("module", l.loggerName)
 }
 
 func (l *LuaMigrateTable) getDbOption() *OptionKv {
@@ -385,13 +387,15 @@ func (l *LuaMigrateTable) CreateIndex(state *lua.LState) int {
 	return 0
 }
 
-func CreateColumnMapByTable(t *lua.LTable) ColumnMap {
+// CreateColumnMapByTable 取出字段, 传入 state 时遵循其运行时的确定性遍历顺序
+func CreateColumnMapByTable(t *lua.LTable, state ...*lua.LState) ColumnMap {
 	if t == nil {
 		return nil
 	}
+	state = append(state, nil)
 	var cMap []*Column
 	// 取出column
-	t.ForEach(func(key lua.LValue, v lua.LValue) {
+	core.ForEach(state[0], t, func(key lua.LValue, v lua.LValue) {
 		if key == nil || v == nil {
 			return
 		}
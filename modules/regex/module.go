@@ -0,0 +1,23 @@
+package regex
+
+import (
+	"github.com/weblfe/plugin_lua/query"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	Name = "regex"
+)
+
+func NewLuaRegexTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(Name, Funcs)
+		if t, ok := mod.(*lua.LTable); ok {
+			t.RawSetString("SPLIT_NO_EMPTY", lua.LNumber(query.RegexpSplitNoEmpty))
+			t.RawSetString("SPLIT_DELIM_CAPTURE", lua.LNumber(query.RegexpSplitDelimCapture))
+			t.RawSetString("SPLIT_OFFSET_CAPTURE", lua.LNumber(query.RegexpSplitOffsetCapture))
+		}
+		state.Push(mod)
+		return 1
+	}
+}
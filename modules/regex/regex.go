@@ -0,0 +1,162 @@
+package regex
+
+import (
+	"github.com/weblfe/plugin_lua/query"
+	"github.com/yuin/gopher-lua"
+	"regexp"
+)
+
+var (
+	Funcs = map[string]lua.LGFunction{
+		"test":     luaTest,
+		"match":    luaMatch,
+		"matchAll": luaMatchAll,
+		"replace":  luaReplace,
+		"split":    luaSplit,
+		"quote":    luaQuote,
+	}
+)
+
+// compile 编译第 1 个参数, 错误信息包含该正则
+func compile(L *lua.LState) *regexp.Regexp {
+	var reg, err = query.RegexpCompile(L.CheckString(1))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	return reg
+}
+
+// matchTable {完整匹配, 分组1, ...}, 具名分组同时以名称为 key
+func matchTable(L *lua.LState, reg *regexp.Regexp, matches []string) *lua.LTable {
+	var t = L.CreateTable(len(matches), 0)
+	for _, v := range matches {
+		t.Append(lua.LString(v))
+	}
+	for i, name := range reg.SubexpNames() {
+		if name != "" && i < len(matches) {
+			t.RawSetString(name, lua.LString(matches[i]))
+		}
+	}
+	return t
+}
+
+// luaTest regex.test(pattern, subject) bool
+func luaTest(L *lua.LState) int {
+	var reg = compile(L)
+	L.Push(lua.LBool(reg.MatchString(L.CheckString(2))))
+	return 1
+}
+
+// luaMatch regex.match(pattern, subject) {match, group1, ...} | nil
+func luaMatch(L *lua.LState) int {
+	var (
+		reg     = compile(L)
+		matches = reg.FindStringSubmatch(L.CheckString(2))
+	)
+	if matches == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(matchTable(L, reg, matches))
+	return 1
+}
+
+// luaMatchAll regex.matchAll(pattern, subject [, limit]) {{match, group1, ...}, ...}
+func luaMatchAll(L *lua.LState) int {
+	var (
+		reg = compile(L)
+		t   = L.NewTable()
+	)
+	for _, matches := range reg.FindAllStringSubmatch(L.CheckString(2), L.OptInt(3, -1)) {
+		t.Append(matchTable(L, reg, matches))
+	}
+	L.Push(t)
+	return 1
+}
+
+// luaReplace regex.replace(pattern, replacement, subject [, limit])
+// replacement 为字符串时支持 $1 / ${name}, 为函数时以匹配 table 调用, 返回 nil/false 保留原文
+func luaReplace(L *lua.LState) int {
+	var (
+		reg         = compile(L)
+		pattern     = L.CheckString(1)
+		subject     = L.CheckString(3)
+		limit       = L.OptInt(4, -1)
+		replacement = L.Get(2)
+		fn, isFunc  = replacement.(*lua.LFunction)
+	)
+	if !isFunc && replacement.Type() != lua.LTString {
+		L.ArgError(2, "string or function expected")
+	}
+	if !isFunc && limit < 0 {
+		L.Push(lua.LString(query.RegexpReplace(pattern, lua.LVAsString(replacement), subject)))
+		return 1
+	}
+	var result, err = query.RegexpReplaceFunc(pattern, subject, limit, func(matches []string) string {
+		if !isFunc {
+			return expand(reg, lua.LVAsString(replacement), matches)
+		}
+		L.Push(fn)
+		L.Push(matchTable(L, reg, matches))
+		L.Call(1, 1)
+		var ret = L.Get(-1)
+		L.Pop(1)
+		switch ret.Type() {
+		case lua.LTString, lua.LTNumber:
+			return ret.String()
+		case lua.LTNil:
+			return matches[0]
+		case lua.LTBool:
+			if ret == lua.LFalse {
+				return matches[0]
+			}
+		}
+		L.RaiseError("regex.replace: callback must return a string, got %s", ret.Type().String())
+		return ""
+	})
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	L.Push(lua.LString(result))
+	return 1
+}
+
+// expand 以分组内容展开 $1 / ${name}
+func expand(reg *regexp.Regexp, template string, matches []string) string {
+	var (
+		src    string
+		offset int
+		loc    = make([]int, 0, 2*len(matches))
+	)
+	for _, m := range matches {
+		src += m
+		loc = append(loc, offset, offset+len(m))
+		offset += len(m)
+	}
+	return string(reg.ExpandString(nil, template, src, loc))
+}
+
+// luaSplit regex.split(pattern, subject [, limit [, flags]]) {part, ...}
+// flags 同 query.RegexpSplit, 默认 regex.SPLIT_NO_EMPTY
+func luaSplit(L *lua.LState) int {
+	compile(L)
+	var (
+		parts = query.RegexpSplit(L.CheckString(1), L.CheckString(2), L.OptInt(3, -1), L.OptInt(4, query.RegexpSplitNoEmpty))
+		t     = L.CreateTable(len(parts), 0)
+	)
+	for _, part := range parts {
+		t.Append(lua.LString(part))
+	}
+	L.Push(t)
+	return 1
+}
+
+// luaQuote regex.quote(str [, delimiter]) 转义正则元字符
+func luaQuote(L *lua.LState) int {
+	var delimiter []string
+	if L.GetTop() >= 2 {
+		delimiter = append(delimiter, L.CheckString(2))
+	}
+	L.Push(lua.LString(query.RegexpQuote(L.CheckString(1), delimiter...)))
+	return 1
+}
@@ -0,0 +1,44 @@
+package regex
+
+import (
+	"github.com/yuin/gopher-lua"
+	"testing"
+)
+
+func TestRegex(t *testing.T) {
+	var L = lua.NewState()
+	defer L.Close()
+	L.PreloadModule(Name, NewLuaRegexTables())
+	var script = `
+local regex = require("regex")
+assert(regex.test("/^[a-z]+$/i", "Hello"))
+assert(not regex.test("^[a-z]+$", "Hello"))
+
+local m = regex.match([[(?P<key>\w+)=(\d+)]], "a=1, b=2")
+assert(m[1] == "a=1" and m[2] == "a" and m[3] == "1" and m.key == "a")
+assert(regex.match("x", "abc") == nil)
+
+local all = regex.matchAll([[(\w)=(\d)]], "a=1, b=2, c=3")
+assert(#all == 3 and all[3][2] == "c")
+assert(#regex.matchAll([[\d]], "123", 2) == 2)
+
+assert(regex.replace([[(\w)=(\d)]], "$2=$1", "a=1, b=2") == "1=a, 2=b")
+assert(regex.replace([[(\w)=(\d)]], "${2}", "a=1, b=2", 1) == "1, b=2")
+assert(regex.replace([[\d+]], function(m) return tostring(m[1] * 2) end, "a1 b20") == "a2 b40")
+assert(regex.replace([[^\w]], function(m) return m[1]:upper() end, "ab ab") == "Ab ab")
+assert(regex.replace([[\d]], function(m) if m[1] == "2" then return "x" end end, "123") == "1x3")
+
+local parts = regex.split([[/\s*,\s*/]], "a , b,,c")
+assert(#parts == 3 and parts[3] == "c")
+local parts = regex.split(",", "a,,b", -1, regex.SPLIT_DELIM_CAPTURE)
+assert(#parts == 3 and parts[2] == "")
+
+assert(regex.quote("1.5*2") == [[1\.5\*2]])
+
+local ok, err = pcall(regex.match, "(unclosed", "x")
+assert(not ok and string.find(err, "(unclosed", 1, true), err)
+`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,21 @@
+package shared
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "shared"
+)
+
+// NewLuaSharedTables shared.zone(name) 或 shared[name] 获取共享字典
+func NewLuaSharedTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var (
+			mod  = state.RegisterModule(Name, Funcs)
+			meta = state.NewTable()
+		)
+		meta.RawSetString("__index", state.NewFunction(luaIndex))
+		state.SetMetatable(mod, meta)
+		state.Push(mod)
+		return 1
+	}
+}
@@ -0,0 +1,177 @@
+package shared
+
+import (
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"time"
+)
+
+var (
+	Funcs = map[string]lua.LGFunction{
+		"zone": luaZone,
+	}
+)
+
+// ToValue 转换为可共享的值: nil/bool/number/string 原样保存, table 序列化为 Table
+func ToValue(v lua.LValue) (interface{}, error) {
+	switch value := v.(type) {
+	case lua.LBool:
+		return bool(value), nil
+	case lua.LNumber:
+		return float64(value), nil
+	case lua.LString:
+		return string(value), nil
+	case *lua.LTable:
+		var data, err = core.MarshalValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return Table(data), nil
+	}
+	return nil, errors.New("unsupported value type " + v.Type().String())
+}
+
+// ToLua ToValue 的逆转换, table 每次解码为新的副本
+func ToLua(L *lua.LState, v interface{}) (lua.LValue, error) {
+	switch value := v.(type) {
+	case bool:
+		return lua.LBool(value), nil
+	case float64:
+		return lua.LNumber(value), nil
+	case string:
+		return lua.LString(value), nil
+	case Table:
+		return core.UnmarshalValue(L, value)
+	}
+	return lua.LNil, nil
+}
+
+func ttl(L *lua.LState, n int) time.Duration {
+	return time.Duration(float64(L.OptNumber(n, 0)) * float64(time.Second))
+}
+
+func fail(L *lua.LState, err error) int {
+	L.Push(lua.LFalse)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// luaIndex shared[name]
+func luaIndex(L *lua.LState) int {
+	var zone, ok = GetZone(L.CheckString(2))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(zoneTable(L, zone))
+	return 1
+}
+
+// luaZone shared.zone(name) dict | nil, err
+func luaZone(L *lua.LState) int {
+	var name = L.CheckString(1)
+	var zone, ok = GetZone(name)
+	if !ok {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("zone " + name + " not defined"))
+		return 2
+	}
+	L.Push(zoneTable(L, zone))
+	return 1
+}
+
+// zoneTable 字典方法, 以 dict:method(...) 调用; ttl 单位为秒
+func zoneTable(L *lua.LState, zone *Zone) *lua.LTable {
+	var t = L.NewTable()
+	var methods = map[string]lua.LGFunction{
+		// dict:get(key) value | nil
+		"get": func(L *lua.LState) int {
+			var value, ok = zone.Get(L.CheckString(2))
+			if !ok {
+				L.Push(lua.LNil)
+				return 1
+			}
+			var v, err = ToLua(L, value)
+			if err != nil {
+				L.RaiseError("shared %s: %s", zone.name, err.Error())
+			}
+			L.Push(v)
+			return 1
+		},
+		// dict:set(key, value [, ttl]) true | false, err; value 为 nil 时删除
+		"set": func(L *lua.LState) int {
+			var key = L.CheckString(2)
+			if L.Get(3) == lua.LNil {
+				zone.Delete(key)
+				L.Push(lua.LTrue)
+				return 1
+			}
+			var value, err = ToValue(L.Get(3))
+			if err == nil {
+				err = zone.Set(key, value, ttl(L, 4))
+			}
+			if err != nil {
+				return fail(L, err)
+			}
+			L.Push(lua.LTrue)
+			return 1
+		},
+		// dict:add(key, value [, ttl]) true | false, "exists"
+		"add": func(L *lua.LState) int {
+			var value, err = ToValue(L.CheckAny(3))
+			if err == nil {
+				err = zone.Add(L.CheckString(2), value, ttl(L, 4))
+			}
+			if err != nil {
+				return fail(L, err)
+			}
+			L.Push(lua.LTrue)
+			return 1
+		},
+		// dict:incr(key, delta [, init [, ttl]]) value | nil, err
+		"incr": func(L *lua.LState) int {
+			var init *float64
+			if n, ok := L.Get(4).(lua.LNumber); ok {
+				var v = float64(n)
+				init = &v
+			}
+			var value, err = zone.Incr(L.CheckString(2), float64(L.OptNumber(3, 1)), init, ttl(L, 5))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(value))
+			return 1
+		},
+		// dict:delete(key)
+		"delete": func(L *lua.LState) int {
+			zone.Delete(L.CheckString(2))
+			return 0
+		},
+		// dict:keys([max]) {key, ...}
+		"keys": func(L *lua.LState) int {
+			var t = L.NewTable()
+			for _, key := range zone.Keys(L.OptInt(2, 0)) {
+				t.Append(lua.LString(key))
+			}
+			L.Push(t)
+			return 1
+		},
+		// dict:flush_expired([max]) count
+		"flush_expired": func(L *lua.LState) int {
+			L.Push(lua.LNumber(zone.FlushExpired(L.OptInt(2, 0))))
+			return 1
+		},
+		// dict:flush_all()
+		"flush_all": func(L *lua.LState) int {
+			zone.FlushAll()
+			return 0
+		},
+	}
+	for name, fn := range methods {
+		t.RawSetString(name, L.NewFunction(fn))
+	}
+	return t
+}
@@ -0,0 +1,136 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestZone(t *testing.T) {
+	var clock = core.NewManualClock(time.Unix(0, 0))
+	var zone, err = DefineZone("test_zone", 0, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveZone("test_zone")
+	if _, err = DefineZone("test_zone", 0); !errors.Is(err, ErrZoneExists) {
+		t.Errorf("expected ErrZoneExists, got %v", err)
+	}
+	if err = zone.Set("a", "1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = zone.Add("a", "2", 0); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	clock.Add(time.Second)
+	if _, ok := zone.Get("a"); ok {
+		t.Error("a should be expired")
+	}
+	if err = zone.Add("a", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = zone.Incr("missing", 1, nil, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err = zone.Incr("a", 1, nil, 0); !errors.Is(err, ErrNotNumber) {
+		t.Errorf("expected ErrNotNumber, got %v", err)
+	}
+	var wg sync.WaitGroup
+	var init = 0.0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = zone.Incr("counter", 1, &init, 0)
+		}()
+	}
+	wg.Wait()
+	if v, _ := zone.Get("counter"); v != 50.0 {
+		t.Errorf("expected 50, got %v", v)
+	}
+	_ = zone.Set("b", true, time.Second)
+	clock.Add(time.Second)
+	if n := zone.FlushExpired(0); n != 1 {
+		t.Errorf("expected 1 flushed, got %d", n)
+	}
+	if keys := fmt.Sprint(zone.Keys(0)); keys != "[a counter]" {
+		t.Errorf("unexpected keys %s", keys)
+	}
+}
+
+func TestZoneEviction(t *testing.T) {
+	var item = sizeOf("k0", "v")
+	var zone, err = DefineZone("test_lru", item*3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveZone("test_lru")
+	for i := 0; i < 3; i++ {
+		_ = zone.Set(fmt.Sprintf("k%d", i), "v", 0)
+	}
+	// k0 最近使用, k1 被淘汰
+	zone.Get("k0")
+	if err = zone.Set("k3", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fmt.Sprint(zone.Keys(0)); keys != "[k0 k2 k3]" {
+		t.Errorf("unexpected keys %s", keys)
+	}
+	if zone.Used() != item*3 {
+		t.Errorf("unexpected used %d", zone.Used())
+	}
+	var large = make([]byte, item*3)
+	if err = zone.Set("large", string(large), 0); !errors.Is(err, ErrNoMemory) {
+		t.Errorf("expected ErrNoMemory, got %v", err)
+	}
+}
+
+func TestLuaShared(t *testing.T) {
+	if _, err := DefineZone("test_lua", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveZone("test_lua")
+	var states [2]*lua.LState
+	for i := range states {
+		states[i] = lua.NewState()
+		defer states[i].Close()
+		states[i].PreloadModule(Name, NewLuaSharedTables())
+	}
+	var err = states[0].DoString(`
+local shared = require("shared")
+local dict = shared.test_lua
+assert(dict:set("user", {name = "lua", tags = {"a", "b"}}, 60))
+assert(dict:set("hits", 1))
+local ok, err = dict:add("hits", 2)
+assert(not ok and err == "exists", err)
+assert(dict:incr("hits", 2) == 3)
+assert(dict:incr("new", 1, 10) == 11)
+assert(dict:incr("absent", 1) == nil)
+assert(shared.missing == nil)
+assert(select(2, shared.zone("missing")) == "zone missing not defined")
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = states[1].DoString(`
+local dict = require("shared").zone("test_lua")
+local user = dict:get("user")
+assert(user.name == "lua" and user.tags[2] == "b")
+user.name = "changed"
+assert(dict:get("user").name == "lua")
+assert(dict:get("hits") == 3)
+assert(#dict:keys() == 3)
+dict:delete("hits")
+dict:set("new", nil)
+assert(dict:get("hits") == nil and dict:get("new") == nil)
+dict:flush_all()
+assert(#dict:keys() == 0)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
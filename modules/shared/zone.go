@@ -0,0 +1,280 @@
+package shared
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Zone 命名的共享字典, 所有 vm 共用, 每个操作在锁内原子完成
+	Zone struct {
+		safe     sync.Mutex
+		name     string
+		capacity int64
+		used     int64
+		clock    core.Clock
+		items    map[string]*list.Element
+		lru      *list.List
+	}
+
+	entry struct {
+		key     string
+		value   interface{}
+		size    int64
+		expires time.Time
+	}
+
+	// Table 序列化后的 lua table (core.MarshalValue)
+	Table []byte
+)
+
+const (
+	// entryOverhead 每个条目的估算额外开销 (字节)
+	entryOverhead = 64
+)
+
+var (
+	ErrNoMemory   = errors.New("no memory")
+	ErrExists     = errors.New("exists")
+	ErrNotFound   = errors.New("not found")
+	ErrNotNumber  = errors.New("not a number")
+	ErrZoneExists = errors.New("zone already defined")
+
+	zones = struct {
+		safe  sync.RWMutex
+		items map[string]*Zone
+	}{items: make(map[string]*Zone)}
+)
+
+// DefineZone 定义容量为 capacity 字节的共享字典, clock 为空时使用系统时钟
+func DefineZone(name string, capacity int64, clock ...core.Clock) (*Zone, error) {
+	var zone = &Zone{
+		name:     name,
+		capacity: capacity,
+		clock:    core.SystemClock,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if len(clock) > 0 && clock[0] != nil {
+		zone.clock = clock[0]
+	}
+	zones.safe.Lock()
+	defer zones.safe.Unlock()
+	if _, ok := zones.items[name]; ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrZoneExists)
+	}
+	zones.items[name] = zone
+	return zone, nil
+}
+
+// GetZone 获取已定义的共享字典
+func GetZone(name string) (*Zone, bool) {
+	zones.safe.RLock()
+	defer zones.safe.RUnlock()
+	var zone, ok = zones.items[name]
+	return zone, ok
+}
+
+// RemoveZone 移除共享字典
+func RemoveZone(name string) {
+	zones.safe.Lock()
+	defer zones.safe.Unlock()
+	delete(zones.items, name)
+}
+
+func (zone *Zone) Name() string {
+	return zone.name
+}
+
+// Used 已使用的估算字节数
+func (zone *Zone) Used() int64 {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	return zone.used
+}
+
+// Get 获取未过期的值: float64, string, bool 或 Table
+func (zone *Zone) Get(key string) (interface{}, bool) {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	var item = zone.lookup(key)
+	if item == nil {
+		return nil, false
+	}
+	return item.value, true
+}
+
+// Set 写入值, ttl <= 0 不过期; 空间不足时按 LRU 淘汰
+func (zone *Zone) Set(key string, value interface{}, ttl time.Duration) error {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	return zone.set(key, value, ttl)
+}
+
+// Add 仅在 key 不存在 (或已过期) 时写入
+func (zone *Zone) Add(key string, value interface{}, ttl time.Duration) error {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	if zone.lookup(key) != nil {
+		return ErrExists
+	}
+	return zone.set(key, value, ttl)
+}
+
+// Incr 数值加 delta; key 不存在时以 init 为初值 (init 为 nil 时返回 ErrNotFound), ttl 仅在新建时生效
+func (zone *Zone) Incr(key string, delta float64, init *float64, ttl time.Duration) (float64, error) {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	var item = zone.lookup(key)
+	if item == nil {
+		if init == nil {
+			return 0, ErrNotFound
+		}
+		var value = *init + delta
+		return value, zone.set(key, value, ttl)
+	}
+	var n, ok = item.value.(float64)
+	if !ok {
+		return 0, ErrNotNumber
+	}
+	item.value = n + delta
+	return n + delta, nil
+}
+
+// Delete 删除 key
+func (zone *Zone) Delete(key string) {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	if element, ok := zone.items[key]; ok {
+		zone.remove(element)
+	}
+}
+
+// Keys 未过期的 key (按字典序), max <= 0 返回全部
+func (zone *Zone) Keys(max int) []string {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	var (
+		keys []string
+		now  = zone.clock.Now()
+	)
+	for key, element := range zone.items {
+		if !element.Value.(*entry).expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if max > 0 && len(keys) > max {
+		keys = keys[:max]
+	}
+	return keys
+}
+
+// FlushExpired 清除已过期的条目, max <= 0 不限数量, 返回清除的数量
+func (zone *Zone) FlushExpired(max int) int {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	var (
+		count = 0
+		now   = zone.clock.Now()
+	)
+	for element := zone.lru.Back(); element != nil && (max <= 0 || count < max); {
+		var prev = element.Prev()
+		if element.Value.(*entry).expired(now) {
+			zone.remove(element)
+			count++
+		}
+		element = prev
+	}
+	return count
+}
+
+// FlushAll 清空全部条目
+func (zone *Zone) FlushAll() {
+	zone.safe.Lock()
+	defer zone.safe.Unlock()
+	zone.items = make(map[string]*list.Element)
+	zone.lru.Init()
+	zone.used = 0
+}
+
+// lookup 获取未过期的条目并标记为最近使用, 过期的条目顺便删除
+func (zone *Zone) lookup(key string) *entry {
+	var element, ok = zone.items[key]
+	if !ok {
+		return nil
+	}
+	var item = element.Value.(*entry)
+	if item.expired(zone.clock.Now()) {
+		zone.remove(element)
+		return nil
+	}
+	zone.lru.MoveToFront(element)
+	return item
+}
+
+func (zone *Zone) set(key string, value interface{}, ttl time.Duration) error {
+	var item = &entry{key: key, value: value, size: sizeOf(key, value)}
+	if ttl > 0 {
+		item.expires = zone.clock.Now().Add(ttl)
+	}
+	if zone.capacity > 0 && item.size > zone.capacity {
+		return fmt.Errorf("%s: %w: %d bytes exceeds capacity %d", zone.name, ErrNoMemory, item.size, zone.capacity)
+	}
+	if element, ok := zone.items[key]; ok {
+		zone.remove(element)
+	}
+	if zone.capacity > 0 && zone.used+item.size > zone.capacity {
+		zone.evict(item.size)
+	}
+	zone.items[key] = zone.lru.PushFront(item)
+	zone.used += item.size
+	return nil
+}
+
+// evict 先清除过期条目, 仍不足时从最久未使用的一端淘汰
+func (zone *Zone) evict(need int64) {
+	var now = zone.clock.Now()
+	for element := zone.lru.Back(); element != nil; {
+		var prev = element.Prev()
+		if element.Value.(*entry).expired(now) {
+			zone.remove(element)
+		}
+		element = prev
+	}
+	for zone.used+need > zone.capacity {
+		var element = zone.lru.Back()
+		if element == nil {
+			return
+		}
+		zone.remove(element)
+	}
+}
+
+func (zone *Zone) remove(element *list.Element) {
+	var item = zone.lru.Remove(element).(*entry)
+	delete(zone.items, item.key)
+	zone.used -= item.size
+}
+
+func (item *entry) expired(now time.Time) bool {
+	return !item.expires.IsZero() && !now.Before(item.expires)
+}
+
+func sizeOf(key string, value interface{}) int64 {
+	var size = int64(len(key)) + entryOverhead
+	switch v := value.(type) {
+	case string:
+		size += int64(len(v))
+	case Table:
+		size += int64(len(v))
+	default:
+		size += 8
+	}
+	return size
+}
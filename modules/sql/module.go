@@ -0,0 +1,18 @@
+package sql
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "sql"
+)
+
+func NewLuaSqlTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(Name, Funcs)
+		if t, ok := mod.(*lua.LTable); ok {
+			t.RawSetString("null", Null)
+		}
+		state.Push(mod)
+		return 1
+	}
+}
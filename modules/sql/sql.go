@@ -0,0 +1,382 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/migrate"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"github.com/yuin/gopher-lua"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// queryer *sql.DB 与 *sql.Tx 共有的方法
+	queryer interface {
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*dbsql.Rows, error)
+		ExecContext(ctx context.Context, query string, args ...interface{}) (dbsql.Result, error)
+	}
+
+	// Options 插件级配置, 通过 PluginOptions.ModuleOptions["sql"] 注入, 插件只能打开其中配置的连接
+	Options struct {
+		// DBs 已打开的连接, lua 中通过 sql.open(name) 使用, 由调用方关闭
+		DBs map[string]*dbsql.DB
+		// Connections 连接配置, 首次 sql.open(name) 时打开, 由 Close 关闭
+		// 驱动取 Properties["driver"], 否则取 ConnUrl 的 scheme; dsn 取 Properties["dsn"], 否则由 ConnUrl 推导
+		Connections map[string]*migrate.OptionKv
+
+		safe   sync.Mutex
+		opened map[string]*dbsql.DB
+	}
+
+	// txSet 运行时中未提交的事务, 运行时关闭时回滚
+	txSet struct {
+		safe sync.Mutex
+		txs  map[*dbsql.Tx]bool
+	}
+
+	nullValue struct{}
+)
+
+var (
+	ErrConnectionNotFound = errors.New("connection not configured")
+	ErrTxDone             = errors.New("transaction already committed or rolled back")
+
+	// Null sql.null 哨兵, 位置参数中代替 nil 绑定 NULL (nil 会使数组 table 出现空洞)
+	Null = &lua.LUserData{Value: nullValue{}}
+
+	// codec 参数的转换规则, sql.null 对应 nil
+	codec = &core.Codec{Null: Null}
+
+	openTxs sync.Map
+
+	Funcs = map[string]lua.LGFunction{
+		"open": luaOpen,
+	}
+)
+
+// GetOptions 获取 L 所属插件的 sql 配置
+func GetOptions(L *lua.LState) *Options {
+	if opts, ok := core.GetRuntime(L).Option(Name).(*Options); ok && opts != nil {
+		return opts
+	}
+	return &Options{}
+}
+
+// Open 获取 name 对应的连接, 未在 DBs 或 Connections 中配置时返回 ErrConnectionNotFound
+func (opts *Options) Open(name string) (*dbsql.DB, error) {
+	if db, ok := opts.DBs[name]; ok {
+		return db, nil
+	}
+	var opt = opts.Connections[name]
+	if opt == nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrConnectionNotFound)
+	}
+	opts.safe.Lock()
+	defer opts.safe.Unlock()
+	if db, ok := opts.opened[name]; ok {
+		return db, nil
+	}
+	var driver, dsn, err = DataSource(opt)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	db, err := dbsql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if opts.opened == nil {
+		opts.opened = make(map[string]*dbsql.DB)
+	}
+	opts.opened[name] = db
+	return db, nil
+}
+
+// Close 关闭由 Connections 打开的连接, DBs 中的连接不受影响
+func (opts *Options) Close() error {
+	opts.safe.Lock()
+	defer opts.safe.Unlock()
+	var errs []string
+	for name, db := range opts.opened {
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+		delete(opts.opened, name)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// txsOf rt 的未提交事务, 首次使用时注册关闭回调
+func txsOf(rt *core.Runtime) *txSet {
+	if set, ok := openTxs.Load(rt); ok {
+		return set.(*txSet)
+	}
+	var set, loaded = openTxs.LoadOrStore(rt, &txSet{txs: make(map[*dbsql.Tx]bool)})
+	if !loaded {
+		rt.OnClose(func() {
+			openTxs.Delete(rt)
+			set.(*txSet).rollback()
+		})
+	}
+	return set.(*txSet)
+}
+
+func (set *txSet) add(tx *dbsql.Tx) {
+	set.safe.Lock()
+	defer set.safe.Unlock()
+	set.txs[tx] = true
+}
+
+func (set *txSet) remove(tx *dbsql.Tx) {
+	set.safe.Lock()
+	defer set.safe.Unlock()
+	delete(set.txs, tx)
+}
+
+// rollback 回滚全部未提交的事务
+func (set *txSet) rollback() {
+	set.safe.Lock()
+	var txs = set.txs
+	set.txs = make(map[*dbsql.Tx]bool)
+	set.safe.Unlock()
+	for tx := range txs {
+		_ = tx.Rollback()
+	}
+}
+
+// DataSource 由 OptionKv 推导 database/sql 的驱动名与 dsn
+func DataSource(opt *migrate.OptionKv) (string, string, error) {
+	var (
+		driver = opt.Properties["driver"]
+		dsn    = opt.Properties["dsn"]
+	)
+	if driver != "" && dsn != "" {
+		return driver, dsn, nil
+	}
+	var i = strings.Index(opt.ConnUrl, "://")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid connection url %q", opt.ConnUrl)
+	}
+	var scheme = opt.ConnUrl[:i]
+	if driver == "" {
+		driver = scheme
+	}
+	if dsn == "" {
+		switch scheme {
+		// postgres 驱动直接接受 url
+		case "postgres", "postgresql":
+			dsn = opt.ConnUrl
+		default:
+			dsn = opt.ConnUrl[i+3:]
+		}
+	}
+	return driver, dsn, nil
+}
+
+// Args 将 lua 参数转换为绑定参数: 数组 table 为位置参数, 其他 table 为命名参数 (sql.Named), sql.null 为 NULL
+func Args(L *lua.LState, params lua.LValue) ([]interface{}, error) {
+	var t, ok = params.(*lua.LTable)
+	if params == lua.LNil {
+		return nil, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("params must be a table, got %s", params.Type().String())
+	}
+	var value, err = codec.ToGo(t)
+	if err != nil {
+		return nil, err
+	}
+	var args []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		args = v
+	case map[string]interface{}:
+		for _, key := range core.SortedKeys(t) {
+			args = append(args, dbsql.Named(key.String(), v[key.String()]))
+		}
+	}
+	for i, arg := range args {
+		if named, ok := arg.(dbsql.NamedArg); ok {
+			named.Value = integer(named.Value)
+			args[i] = named
+		} else {
+			args[i] = integer(arg)
+		}
+	}
+	return args, nil
+}
+
+// integer int64 范围内的整数值的 float64 转换为 int64
+func integer(v interface{}) interface{} {
+	if f, ok := v.(float64); ok && f >= math.MinInt64 && f < math.MaxInt64 && f == math.Trunc(f) {
+		return int64(f)
+	}
+	return v
+}
+
+// Query 执行查询, 每行转换为以列名为 key 的 table
+func Query(L *lua.LState, q queryer, query string, args ...interface{}) (result *lua.LTable, err error) {
+	var ctx, span = trace.StartL(L, "sql.query")
+	span.SetAttribute("db.statement", query)
+	defer func() {
+		span.Finish(err)
+	}()
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result = L.NewTable()
+	for rows.Next() {
+		var (
+			values = make([]interface{}, len(columns))
+			ptrs   = make([]interface{}, len(columns))
+			row    = L.CreateTable(0, len(columns))
+		)
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, column := range columns {
+			row.RawSetString(column, toLua(L, values[i]))
+		}
+		result.Append(row)
+	}
+	return result, rows.Err()
+}
+
+// Exec 执行语句, 返回 {rowsAffected, lastInsertId} (驱动不支持的字段省略)
+func Exec(L *lua.LState, q queryer, query string, args ...interface{}) (t *lua.LTable, err error) {
+	var ctx, span = trace.StartL(L, "sql.exec")
+	span.SetAttribute("db.statement", query)
+	defer func() {
+		span.Finish(err)
+	}()
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	t = L.NewTable()
+	if n, err := result.RowsAffected(); err == nil {
+		t.RawSetString("rowsAffected", lua.LNumber(n))
+	}
+	if id, err := result.LastInsertId(); err == nil {
+		t.RawSetString("lastInsertId", lua.LNumber(id))
+	}
+	return t, nil
+}
+
+func contextOf(L *lua.LState) context.Context {
+	if ctx := L.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch value := v.(type) {
+	case []byte:
+		return lua.LString(value)
+	case time.Time:
+		return lua.LString(value.Format(time.RFC3339Nano))
+	}
+	return core.ToLua(L, v)
+}
+
+func fail(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// luaOpen sql.open(name) db | nil, err
+func luaOpen(L *lua.LState) int {
+	var db, err = GetOptions(L).Open(L.CheckString(1))
+	if err != nil {
+		return fail(L, err)
+	}
+	var t = methods(L, db)
+	t.RawSetString("begin", L.NewFunction(func(L *lua.LState) int {
+		var tx, err = db.BeginTx(contextOf(L), nil)
+		if err != nil {
+			return fail(L, err)
+		}
+		var txs = txsOf(core.GetRuntime(L))
+		txs.add(tx)
+		L.Push(txMethods(L, tx, txs))
+		return 1
+	}))
+	L.Push(t)
+	return 1
+}
+
+// methods db:query(sql, params) rows | nil, err 与 db:exec(sql, params) result | nil, err
+func methods(L *lua.LState, q queryer) *lua.LTable {
+	var t = L.NewTable()
+	t.RawSetString("query", L.NewFunction(func(L *lua.LState) int {
+		var args, err = Args(L, L.Get(3))
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		rows, err := Query(L, q, L.CheckString(2), args...)
+		if err != nil {
+			return fail(L, err)
+		}
+		L.Push(rows)
+		return 1
+	}))
+	t.RawSetString("exec", L.NewFunction(func(L *lua.LState) int {
+		var args, err = Args(L, L.Get(3))
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		result, err := Exec(L, q, L.CheckString(2), args...)
+		if err != nil {
+			return fail(L, err)
+		}
+		L.Push(result)
+		return 1
+	}))
+	return t
+}
+
+// txMethods tx:query, tx:exec, tx:commit(), tx:rollback(), 未提交的事务在运行时关闭时回滚
+func txMethods(L *lua.LState, tx *dbsql.Tx, txs *txSet) *lua.LTable {
+	var (
+		t    = methods(L, tx)
+		done = func(L *lua.LState, fn func() error) int {
+			txs.remove(tx)
+			if err := fn(); err != nil {
+				if errors.Is(err, dbsql.ErrTxDone) {
+					err = ErrTxDone
+				}
+				return fail(L, err)
+			}
+			L.Push(lua.LTrue)
+			return 1
+		}
+	)
+	t.RawSetString("commit", L.NewFunction(func(L *lua.LState) int {
+		return done(L, tx.Commit)
+	}))
+	t.RawSetString("rollback", L.NewFunction(func(L *lua.LState) int {
+		return done(L, tx.Rollback)
+	}))
+	return t
+}
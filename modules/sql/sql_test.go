@@ -0,0 +1,127 @@
+package sql
+
+import (
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/migrate"
+	"github.com/yuin/gopher-lua"
+	"math"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSql(t *testing.T) {
+	var opts = &Options{Connections: map[string]*migrate.OptionKv{
+		"main": {ConnUrl: "sqlite://" + filepath.Join(t.TempDir(), "test.db")},
+	}}
+	defer func() {
+		_ = opts.Close()
+	}()
+	var L = lua.NewState()
+	defer L.Close()
+	core.GetRuntime(L).Options = map[string]interface{}{Name: opts}
+	L.PreloadModule(Name, NewLuaSqlTables())
+	var script = `
+local sql = require("sql")
+local db = assert(sql.open("main"))
+assert(db:exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL)"))
+
+local result = assert(db:exec("INSERT INTO users (name, score) VALUES (?, ?)", {"alice", 1.5}))
+assert(result.rowsAffected == 1 and result.lastInsertId == 1)
+assert(db:exec("INSERT INTO users (name, score) VALUES (:name, :score)", {name = "bob", score = 2}))
+
+-- 参数绑定而非拼接, 注入内容按字面量保存
+local evil = "x'); DROP TABLE users; --"
+assert(db:exec("INSERT INTO users (name) VALUES (?)", {evil}))
+local rows = assert(db:query("SELECT name FROM users WHERE name = ?", {evil}))
+assert(#rows == 1 and rows[1].name == evil)
+
+local rows = assert(db:query("SELECT id, name, score FROM users WHERE score > ? ORDER BY id", {1}))
+assert(#rows == 2 and rows[1].name == "alice" and rows[2].score == 2)
+
+local tx = assert(db:begin())
+assert(tx:exec("DELETE FROM users WHERE name = ?", {"alice"}))
+assert(tx:rollback())
+local _, err = tx:commit()
+assert(string.find(err, "already"), err)
+assert(#db:query("SELECT id FROM users WHERE name = ?", {"alice"}) == 1)
+
+tx = assert(db:begin())
+assert(tx:exec("DELETE FROM users WHERE name = ?", {"alice"}))
+assert(tx:commit())
+assert(#db:query("SELECT id FROM users") == 2)
+
+local _, err = db:query("SELECT * FROM missing")
+assert(err ~= nil)
+local _, err = sql.open("unknown")
+assert(string.find(err, "not configured"), err)
+
+-- 位置参数中以 sql.null 绑定 NULL
+assert(db:exec("INSERT INTO users (name, score, id) VALUES (?, ?, ?)", {"carol", sql.null, 10}))
+local rows = assert(db:query("SELECT id FROM users WHERE score IS NULL AND name = ?", {"carol"}))
+assert(#rows == 1 and rows[1].id == 10)
+`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	var L = lua.NewState()
+	defer L.Close()
+	L.PreloadModule(Name, NewLuaSqlTables())
+	if err := L.DoString(`params = {1, require("sql").null, 2^63, -2^63, 1.5}`); err != nil {
+		t.Fatal(err)
+	}
+	var args, err = Args(L, L.GetGlobal("params"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []interface{}{int64(1), nil, float64(1 << 63), int64(math.MinInt64), 1.5}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected args %#v", args)
+	}
+}
+
+func TestSql_RollbackOnClose(t *testing.T) {
+	var opts = &Options{Connections: map[string]*migrate.OptionKv{
+		"main": {ConnUrl: "sqlite://" + filepath.Join(t.TempDir(), "test.db")},
+	}}
+	defer func() {
+		_ = opts.Close()
+	}()
+	var L = lua.NewState()
+	var rt = core.GetRuntime(L)
+	rt.Options = map[string]interface{}{Name: opts}
+	L.PreloadModule(Name, NewLuaSqlTables())
+	var err = L.DoString(`
+local db = assert(require("sql").open("main"))
+assert(db:exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)"))
+local tx = assert(db:begin())
+assert(tx:exec("INSERT INTO users (name) VALUES (?)", {"abandoned"}))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.Close()
+	L.Close()
+
+	if _, err = (&Options{}).Open("main"); err == nil {
+		t.Error("expected unconfigured connection to fail")
+	}
+	db, err := opts.Open("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Errorf("abandoned transaction not rolled back, %d connections in use", inUse)
+	}
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected 0 rows, got %d", count)
+	}
+}
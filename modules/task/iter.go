@@ -0,0 +1,45 @@
+package task
+
+import (
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"reflect"
+)
+
+var (
+	ErrNotChannel = errors.New("not a receivable channel")
+)
+
+// Iterator 将 Go chan 包装为 lua 迭代器: for i, v in iter do ... end,
+// chan 关闭时结束, L 的 context 结束时抛出错误; 元素为 lua.LValue 时原样返回, 否则经 core.Codec 转换
+func Iterator(L *lua.LState, ch interface{}) (*lua.LFunction, error) {
+	var rv = reflect.ValueOf(ch)
+	if rv.Kind() != reflect.Chan || rv.Type().ChanDir()&reflect.RecvDir == 0 {
+		return nil, ErrNotChannel
+	}
+	var n = 0
+	return L.NewFunction(func(L *lua.LState) int {
+		var cases = []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: rv}}
+		var ctx = L.Context()
+		if ctx != nil {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+		}
+		var chosen, v, ok = reflect.Select(cases)
+		if chosen == 1 {
+			L.RaiseError("%s", ctx.Err().Error())
+		}
+		if !ok {
+			L.Push(lua.LNil)
+			return 1
+		}
+		n++
+		L.Push(lua.LNumber(n))
+		if value, ok := v.Interface().(lua.LValue); ok {
+			L.Push(value)
+		} else {
+			L.Push(core.ToLua(L, v.Interface()))
+		}
+		return 2
+	}), nil
+}
@@ -0,0 +1,21 @@
+package task
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "task"
+	// TypeName task 对象的 userdata 元表名
+	TypeName = "task"
+)
+
+func NewLuaTaskTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var (
+			mod  = state.RegisterModule(Name, Funcs)
+			meta = state.NewTypeMetatable(TypeName)
+		)
+		state.SetField(meta, "__index", state.SetFuncs(state.NewTable(), methods))
+		state.Push(mod)
+		return 1
+	}
+}
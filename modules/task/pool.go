@@ -0,0 +1,165 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"sync"
+)
+
+type (
+	// Pool 执行 task 的 vm 池, 最多同时运行 size 个 task
+	Pool struct {
+		// New 创建 vm, 为空时使用 SetStateFactory 设置的工厂
+		New    func() *lua.LState
+		safe   sync.Mutex
+		idle   chan *lua.LState
+		slots  chan struct{}
+		closed bool
+	}
+)
+
+const (
+	DefaultPoolSize = 8
+)
+
+var (
+	ErrPoolClosed = errors.New("task pool closed")
+
+	stateFactory = func() *lua.LState {
+		return lua.NewState()
+	}
+	defaultPool struct {
+		once sync.Once
+		pool *Pool
+	}
+
+	// pools 各插件专用的池, 插件之间不共享 vm (package.loaded 等状态), 插件关闭时关闭
+	pools = struct {
+		safe  sync.Mutex
+		items map[*core.Runtime]*Pool
+	}{items: make(map[*core.Runtime]*Pool)}
+)
+
+// SetStateFactory 设置默认的 vm 工厂 (如预加载全部模块), 需在创建 task 之前调用
+func SetStateFactory(fn func() *lua.LState) {
+	if fn != nil {
+		stateFactory = fn
+	}
+}
+
+// DefaultPool 全局池, 供 go 侧直接调用 Spawn; lua 中的 task 使用所属插件专用的池
+func DefaultPool() *Pool {
+	defaultPool.once.Do(func() {
+		defaultPool.pool = NewPool(DefaultPoolSize, nil)
+	})
+	return defaultPool.pool
+}
+
+// PoolOf owner 专用的池, 首次调用时创建, owner 关闭时关闭; vm 由 SetStateFactory 的工厂创建后经 owner.Prepare 配置
+func PoolOf(owner *core.Runtime) *Pool {
+	pools.safe.Lock()
+	var pool, ok = pools.items[owner]
+	if !ok {
+		pool = NewPool(DefaultPoolSize, func() *lua.LState {
+			var L = stateFactory()
+			if owner.Prepare != nil {
+				owner.Prepare(L)
+			}
+			return L
+		})
+		pools.items[owner] = pool
+	}
+	pools.safe.Unlock()
+	if !ok {
+		owner.OnClose(func() {
+			pools.safe.Lock()
+			delete(pools.items, owner)
+			pools.safe.Unlock()
+			pool.Close()
+		})
+	}
+	return pool
+}
+
+func NewPool(size int, newState func() *lua.LState) *Pool {
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+	return &Pool{
+		New:   newState,
+		idle:  make(chan *lua.LState, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Get 获取空闲 vm, 池满时等待直到 ctx 结束
+func (pool *Pool) Get(ctx context.Context) (*lua.LState, error) {
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if pool.Closed() {
+		<-pool.slots
+		return nil, ErrPoolClosed
+	}
+	select {
+	case L := <-pool.idle:
+		return L, nil
+	default:
+	}
+	if pool.New != nil {
+		return pool.New(), nil
+	}
+	return stateFactory(), nil
+}
+
+// Put 归还 vm
+func (pool *Pool) Put(L *lua.LState) {
+	L.SetTop(0)
+	L.RemoveContext()
+	pool.safe.Lock()
+	if pool.closed {
+		L.Close()
+	} else {
+		select {
+		case pool.idle <- L:
+		default:
+			L.Close()
+		}
+	}
+	pool.safe.Unlock()
+	<-pool.slots
+}
+
+// Discard 关闭出错的 vm 而不归还
+func (pool *Pool) Discard(L *lua.LState) {
+	L.Close()
+	<-pool.slots
+}
+
+func (pool *Pool) Closed() bool {
+	pool.safe.Lock()
+	defer pool.safe.Unlock()
+	return pool.closed
+}
+
+// Close 关闭空闲的 vm, 运行中的 vm 在归还时关闭
+func (pool *Pool) Close() {
+	pool.safe.Lock()
+	defer pool.safe.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	for {
+		select {
+		case L := <-pool.idle:
+			L.Close()
+		default:
+			return
+		}
+	}
+}
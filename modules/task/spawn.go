@@ -0,0 +1,401 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"sync"
+)
+
+type (
+	// Task 在池中独立 vm 上运行的 lua 函数, 参数与返回值经 core.Codec 复制
+	Task struct {
+		ctx     context.Context
+		cancel  context.CancelFunc
+		done    chan struct{}
+		owner   *core.Runtime
+		fn      *closure
+		args    []interface{}
+		results []interface{}
+		err     error
+	}
+
+	// closure 可跨 vm 重建的函数: 原型与复制后的 upvalue
+	closure struct {
+		proto    *lua.FunctionProto
+		upvalues []interface{}
+		// modules 引用已加载模块 (或模块字段) 的 upvalue, key 为 upvalue 下标
+		modules map[int]moduleRef
+		// path 创建时的 package.path, 在 task 的 vm 中按相同的路径查找模块
+		path string
+	}
+
+	// moduleRef package.loaded[name][field], field 为空时为模块本身, 在 task 的 vm 中重新 require
+	moduleRef struct {
+		name  string
+		field string
+	}
+)
+
+var (
+	ErrGoFunction = errors.New("go function can not be spawned")
+
+	// owners 各插件运行中的 task, 插件关闭时取消
+	owners = struct {
+		safe  sync.Mutex
+		tasks map[*core.Runtime]map[*Task]bool
+	}{tasks: make(map[*core.Runtime]map[*Task]bool)}
+)
+
+// Spawn 在 pool 的 vm 中执行 fn, parent 结束或 owner 关闭时取消
+// fn 的 upvalue 必须可序列化或为已加载的模块 (及其字段), 模块在 task 的 vm 中重新 require
+func Spawn(parent context.Context, pool *Pool, owner *core.Runtime, fn *lua.LFunction, args ...interface{}) (*Task, error) {
+	var c, err = capture(fn)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		parent = context.Background()
+	}
+	var t = &Task{done: make(chan struct{}), owner: owner, fn: c, args: args}
+	t.ctx, t.cancel = context.WithCancel(parent)
+	if owner != nil && !track(owner, t) {
+		t.cancel()
+		return nil, context.Canceled
+	}
+	go t.run(pool)
+	return t, nil
+}
+
+func capture(fn *lua.LFunction) (*closure, error) {
+	if fn.IsG {
+		return nil, ErrGoFunction
+	}
+	var c = &closure{proto: fn.Proto, upvalues: make([]interface{}, len(fn.Upvalues)), path: packagePath(fn.Env)}
+	for i, uv := range fn.Upvalues {
+		var name = fmt.Sprintf("#%d", i+1)
+		if i < len(fn.Proto.DbgUpvalues) {
+			name = fn.Proto.DbgUpvalues[i]
+		}
+		if ref, ok := findModule(fn.Env, uv.Value()); ok {
+			if c.modules == nil {
+				c.modules = make(map[int]moduleRef)
+			}
+			c.modules[i] = ref
+			continue
+		}
+		var v, err = core.ToGo(uv.Value())
+		if err != nil {
+			return nil, fmt.Errorf("upvalue %s: %w (only serializable values and loaded modules can be captured, pass others as arguments)", name, err)
+		}
+		c.upvalues[i] = v
+	}
+	return c, nil
+}
+
+// findModule 在 env 的 package.loaded 中查找模块本身或模块的字段 v; _G 不在其列, 脚本定义的全局函数在 task 的 vm 中不存在
+func findModule(env *lua.LTable, v lua.LValue) (moduleRef, bool) {
+	switch v.(type) {
+	case *lua.LTable, *lua.LFunction:
+	default:
+		return moduleRef{}, false
+	}
+	if env == nil {
+		return moduleRef{}, false
+	}
+	var pkg, _ = env.RawGetString("package").(*lua.LTable)
+	if pkg == nil {
+		return moduleRef{}, false
+	}
+	var loaded, _ = pkg.RawGetString("loaded").(*lua.LTable)
+	if loaded == nil {
+		return moduleRef{}, false
+	}
+	var (
+		ref   moduleRef
+		found bool
+	)
+	for _, key := range core.SortedKeys(loaded) {
+		if found {
+			break
+		}
+		var name, ok = key.(lua.LString)
+		if !ok || name == "_G" {
+			continue
+		}
+		var mod, _ = loaded.RawGet(key).(*lua.LTable)
+		if mod == nil {
+			continue
+		}
+		if mod == v {
+			ref, found = moduleRef{name: string(name)}, true
+			continue
+		}
+		mod.ForEach(func(field, value lua.LValue) {
+			if s, ok := field.(lua.LString); ok && !found && value == v {
+				ref, found = moduleRef{name: string(name), field: string(s)}, true
+			}
+		})
+	}
+	return ref, found
+}
+
+// packagePath env 中的 package.path
+func packagePath(env *lua.LTable) string {
+	if env == nil {
+		return ""
+	}
+	if pkg, ok := env.RawGetString(lua.LoadLibName).(*lua.LTable); ok {
+		return lua.LVAsString(pkg.RawGetString("path"))
+	}
+	return ""
+}
+
+// build 在 L 中重建函数, 全局变量写入独立的环境表, 不影响池中 vm 的后续 task
+// 模块经 L 的 require 加载, 插件配置的脚本加载器与签名校验由池创建 vm 时安装 (Runtime.Prepare)
+func (c *closure) build(L *lua.LState) (*lua.LFunction, error) {
+	var (
+		fn   = L.NewFunctionFromProto(c.proto)
+		env  = L.NewTable()
+		meta = L.NewTable()
+	)
+	if pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable); ok && c.path != "" {
+		pkg.RawSetString("path", lua.LString(c.path))
+	}
+	for i, v := range c.upvalues {
+		var uv = &lua.Upvalue{}
+		if ref, ok := c.modules[i]; ok {
+			var value, err = ref.require(L)
+			if err != nil {
+				return nil, err
+			}
+			uv.SetValue(value)
+		} else {
+			uv.SetValue(core.ToLua(L, v))
+		}
+		fn.Upvalues[i] = uv
+	}
+	meta.RawSetString("__index", L.G.Global)
+	L.SetMetatable(env, meta)
+	fn.Env = env
+	return fn, nil
+}
+
+// require 在 L 中加载模块并取出字段
+func (ref moduleRef) require(L *lua.LState) (lua.LValue, error) {
+	var top = L.GetTop()
+	defer L.SetTop(top)
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("require"), NRet: 1, Protect: true}, lua.LString(ref.name)); err != nil {
+		return nil, fmt.Errorf("require %q: %w", ref.name, err)
+	}
+	var value = L.Get(-1)
+	if ref.field == "" {
+		return value, nil
+	}
+	if mod, ok := value.(*lua.LTable); ok {
+		return mod.RawGetString(ref.field), nil
+	}
+	return nil, fmt.Errorf("require %q: module is not a table", ref.name)
+}
+
+func (t *Task) run(pool *Pool) {
+	defer close(t.done)
+	defer t.cancel()
+	defer untrack(t.owner, t)
+	var L, err = pool.Get(t.ctx)
+	if err != nil {
+		t.err = err
+		return
+	}
+	var rt = core.NewRuntime()
+	if t.owner != nil {
+		rt.Name, rt.Clock, rt.Options, rt.Logger, rt.CallTimeout = t.owner.Name, t.owner.Clock, t.owner.Options, t.owner.Logger, t.owner.CallTimeout
+		rt.Prepare = t.owner.Prepare
+	}
+	core.SetRuntime(L, rt)
+	_ = rt.Acquire(context.Background())
+	L.SetContext(t.ctx)
+	t.results, t.err = t.call(L)
+	rt.Release()
+	rt.Close()
+	if t.err != nil {
+		if t.ctx.Err() != nil {
+			t.err = t.ctx.Err()
+		}
+		pool.Discard(L)
+		return
+	}
+	pool.Put(L)
+}
+
+func (t *Task) call(L *lua.LState) ([]interface{}, error) {
+	var params []lua.LValue
+	for _, v := range t.args {
+		params = append(params, core.ToLua(L, v))
+	}
+	var fn, err = t.fn.build(L)
+	if err != nil {
+		return nil, err
+	}
+	if err = L.CallByParam(lua.P{Fn: fn, NRet: lua.MultRet, Protect: true}, params...); err != nil {
+		return nil, err
+	}
+	var results []interface{}
+	for i := 1; i <= L.GetTop(); i++ {
+		var v, err = core.ToGo(L.Get(i))
+		if err != nil {
+			return nil, fmt.Errorf("result #%d: %w", i, err)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
+
+// Await 等待 task 结束, ctx 结束时返回 ctx.Err() 而不取消 task
+func (t *Task) Await(ctx context.Context) ([]interface{}, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case <-t.done:
+		return t.results, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Cancel 取消 task, 运行中的 vm 在下一条指令处中止
+func (t *Task) Cancel() {
+	t.cancel()
+}
+
+// Done task 结束时关闭
+func (t *Task) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *Task) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// All 等待全部 task, 任一失败或 ctx 结束时取消其余 task 并返回错误
+func All(ctx context.Context, tasks []*Task) ([][]interface{}, error) {
+	var (
+		results = make([][]interface{}, len(tasks))
+		index   = make(map[*Task]int, len(tasks))
+	)
+	for i, t := range tasks {
+		index[t] = i
+	}
+	for range tasks {
+		var t, err = next(ctx, tasks)
+		if err == nil {
+			err = t.err
+		}
+		if err != nil {
+			cancelAll(tasks)
+			return nil, err
+		}
+		results[index[t]] = t.results
+		tasks = remove(tasks, t)
+	}
+	return results, nil
+}
+
+// Race 返回最先结束的 task (成功或失败), 并取消其余 task
+func Race(ctx context.Context, tasks []*Task) (*Task, error) {
+	var t, err = next(ctx, tasks)
+	cancelAll(tasks)
+	return t, err
+}
+
+// next 等待 tasks 中任一结束
+func next(ctx context.Context, tasks []*Task) (*Task, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New("no tasks")
+	}
+	var (
+		first = make(chan *Task, len(tasks))
+		stop  = make(chan struct{})
+	)
+	defer close(stop)
+	for _, t := range tasks {
+		go func(t *Task) {
+			select {
+			case <-t.done:
+				first <- t
+			case <-stop:
+			}
+		}(t)
+	}
+	select {
+	case t := <-first:
+		return t, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func remove(tasks []*Task, t *Task) []*Task {
+	var rest = make([]*Task, 0, len(tasks))
+	for _, v := range tasks {
+		if v != t {
+			rest = append(rest, v)
+		}
+	}
+	return rest
+}
+
+func cancelAll(tasks []*Task) {
+	for _, t := range tasks {
+		t.Cancel()
+	}
+}
+
+// track 登记 owner 的 task, owner 首次登记时注册关闭回调; owner 已关闭时返回 false
+func track(owner *core.Runtime, t *Task) bool {
+	if owner.Closed() {
+		return false
+	}
+	owners.safe.Lock()
+	var tasks, ok = owners.tasks[owner]
+	if !ok {
+		tasks = make(map[*Task]bool)
+		owners.tasks[owner] = tasks
+	}
+	tasks[t] = true
+	owners.safe.Unlock()
+	if !ok {
+		owner.OnClose(func() {
+			owners.safe.Lock()
+			var running = owners.tasks[owner]
+			delete(owners.tasks, owner)
+			owners.safe.Unlock()
+			for t := range running {
+				t.Cancel()
+			}
+		})
+	}
+	return true
+}
+
+func untrack(owner *core.Runtime, t *Task) {
+	if owner == nil {
+		return
+	}
+	owners.safe.Lock()
+	defer owners.safe.Unlock()
+	if tasks, ok := owners.tasks[owner]; ok {
+		delete(tasks, t)
+	}
+}
@@ -0,0 +1,186 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"time"
+)
+
+var (
+	Funcs = map[string]lua.LGFunction{
+		"spawn": luaSpawn,
+		"await": luaAwait,
+		"all":   luaAll,
+		"race":  luaRace,
+		"iter":  luaIter,
+	}
+
+	// methods task 对象的方法, 以 t:method(...) 调用
+	methods = map[string]lua.LGFunction{
+		"await":  luaAwait,
+		"cancel": luaCancel,
+		"done":   luaDone,
+	}
+)
+
+// GetPool 获取 L 所属插件的 vm 池, 可通过 PluginOptions.ModuleOptions["task"] 注入 *Pool (不应在插件之间共享), 否则为插件专用的池
+func GetPool(L *lua.LState) *Pool {
+	var rt = core.GetRuntime(L)
+	if pool, ok := rt.Option(Name).(*Pool); ok && pool != nil {
+		return pool
+	}
+	return PoolOf(rt)
+}
+
+// parentContext 调用方的 context, 可选的超时参数单位为毫秒
+func parentContext(L *lua.LState, n int) (context.Context, context.CancelFunc) {
+	var ctx = L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout := L.OptInt64(n, 0); timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
+
+func checkTask(L *lua.LState, n int) *Task {
+	var ud = L.CheckUserData(n)
+	if t, ok := ud.Value.(*Task); ok {
+		return t
+	}
+	L.ArgError(n, "task expected")
+	return nil
+}
+
+func checkTasks(L *lua.LState, n int) []*Task {
+	var (
+		tasks []*Task
+		table = L.CheckTable(n)
+	)
+	for i := 1; i <= table.Len(); i++ {
+		var ud, ok = table.RawGetInt(i).(*lua.LUserData)
+		if !ok {
+			L.ArgError(n, "array of tasks expected")
+		}
+		var t, isTask = ud.Value.(*Task)
+		if !isTask {
+			L.ArgError(n, "array of tasks expected")
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+func pushResults(L *lua.LState, results []interface{}, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	for _, v := range results {
+		L.Push(core.ToLua(L, v))
+	}
+	return len(results)
+}
+
+// luaSpawn task.spawn(fn, ...) task | nil, err; fn 在独立 vm 中运行, 参数与 upvalue 被复制, 引用已加载模块的 upvalue 在该 vm 中重新 require
+func luaSpawn(L *lua.LState) int {
+	var (
+		fn   = L.CheckFunction(1)
+		args []interface{}
+	)
+	for i := 2; i <= L.GetTop(); i++ {
+		var v, err = core.ToGo(L.Get(i))
+		if err != nil {
+			L.ArgError(i, err.Error())
+		}
+		args = append(args, v)
+	}
+	var t, err = Spawn(L.Context(), GetPool(L), core.GetRuntime(L), fn, args...)
+	if err != nil {
+		var codecErr *core.CodecError
+		if errors.As(err, &codecErr) || err == ErrGoFunction {
+			L.ArgError(1, err.Error())
+		}
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	var ud = L.NewUserData()
+	ud.Value = t
+	L.SetMetatable(ud, L.GetTypeMetatable(TypeName))
+	L.Push(ud)
+	return 1
+}
+
+// luaAwait task.await(t [, timeout]) / t:await([timeout]) ... | nil, err; 超时不取消 task
+func luaAwait(L *lua.LState) int {
+	var t = checkTask(L, 1)
+	var ctx, cancel = parentContext(L, 2)
+	defer cancel()
+	var results, err = t.Await(ctx)
+	return pushResults(L, results, err)
+}
+
+// luaAll task.all({t1, t2, ...} [, timeout]) {r1, r2, ...} | nil, err; 结果为各 task 的第一个返回值
+func luaAll(L *lua.LState) int {
+	var tasks = checkTasks(L, 1)
+	var ctx, cancel = parentContext(L, 2)
+	defer cancel()
+	var results, err = All(ctx, tasks)
+	if err != nil {
+		return pushResults(L, nil, err)
+	}
+	var t = L.CreateTable(len(results), 0)
+	for _, values := range results {
+		var v lua.LValue = lua.LNil
+		if len(values) > 0 {
+			v = core.ToLua(L, values[0])
+		}
+		t.Append(v)
+	}
+	L.Push(t)
+	return 1
+}
+
+// luaRace task.race({t1, t2, ...} [, timeout]) ... | nil, err; 返回最先结束的 task 的结果
+func luaRace(L *lua.LState) int {
+	var tasks = checkTasks(L, 1)
+	var ctx, cancel = parentContext(L, 2)
+	defer cancel()
+	var t, err = Race(ctx, tasks)
+	if err != nil {
+		return pushResults(L, nil, err)
+	}
+	return pushResults(L, t.results, t.err)
+}
+
+// luaIter task.iter(channel) 迭代 lua channel (由 host 传入)
+func luaIter(L *lua.LState) int {
+	var fn, err = Iterator(L, (chan lua.LValue)(L.CheckChannel(1)))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	L.Push(fn)
+	return 1
+}
+
+// luaCancel t:cancel()
+func luaCancel(L *lua.LState) int {
+	checkTask(L, 1).Cancel()
+	return 0
+}
+
+// luaDone t:done() bool
+func luaDone(L *lua.LState) int {
+	select {
+	case <-checkTask(L, 1).Done():
+		L.Push(lua.LTrue)
+	default:
+		L.Push(lua.LFalse)
+	}
+	return 1
+}
@@ -0,0 +1,194 @@
+package task
+
+import (
+	"context"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newState(t *testing.T, pool *Pool) (*lua.LState, *core.Runtime) {
+	var (
+		L  = lua.NewState()
+		rt = core.NewRuntime()
+	)
+	rt.Options = map[string]interface{}{Name: pool}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaTaskTables())
+	t.Cleanup(L.Close)
+	return L, rt
+}
+
+func TestLuaTask(t *testing.T) {
+	var pool = NewPool(2, nil)
+	defer pool.Close()
+	var L, _ = newState(t, pool)
+	var err = L.DoString(`
+local task = require("task")
+local base = 10
+local t = task.spawn(function(a, b)
+	leaked = true
+	return a + b + base, {sum = a + b}
+end, 1, 2)
+local n, info = t:await()
+assert(n == 13 and info.sum == 3, tostring(n))
+assert(t:done())
+assert(leaked == nil)
+
+local results = task.all({
+	task.spawn(function(x) return x * 2 end, 1),
+	task.spawn(function(x) return x * 2 end, 2),
+	task.spawn(function(x) return x * 2 end, 3),
+})
+assert(#results == 3 and results[1] == 2 and results[3] == 6)
+
+local failed, msg = task.all({
+	task.spawn(function() error("boom") end),
+	task.spawn(function() while true do end end),
+})
+assert(failed == nil and msg:find("boom"), msg)
+
+local slow = task.spawn(function() while true do end end)
+local winner = task.race({slow, task.spawn(function() return "fast" end)})
+assert(winner == "fast")
+local _, err = slow:await()
+assert(err:find("canceled"), err)
+
+local ok, spawnErr = pcall(task.spawn, function() return print end)
+assert(ok)
+local _, resultErr = task.await(task.spawn(function() return print end))
+assert(resultErr:find("result #1"), resultErr)
+local helper = function() end
+local ok2, argErr = pcall(task.spawn, function() return helper() end)
+assert(not ok2 and argErr:find("upvalue helper") and argErr:find("loaded modules"), argErr)
+local str, upper = require("string"), string.upper
+assert(task.await(task.spawn(function() return str.rep(upper("a"), 2) end)) == "AA")
+
+local pending = task.spawn(function() while true do end end)
+local _, timeout = task.await(pending, 10)
+assert(timeout:find("deadline"), timeout)
+assert(not pending:done())
+pending:cancel()
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOwnerClose(t *testing.T) {
+	var pool = NewPool(1, nil)
+	defer pool.Close()
+	var L, rt = newState(t, pool)
+	var err = L.DoString(`
+running = require("task").spawn(function() while true do end end)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var task = L.GetGlobal("running").(*lua.LUserData).Value.(*Task)
+	rt.Close()
+	select {
+	case <-task.Done():
+	case <-time.After(time.Second):
+		t.Fatal("task not cancelled on owner close")
+	}
+	if task.Err() != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", task.Err())
+	}
+	if _, err = Spawn(nil, pool, rt, L.NewFunctionFromProto(task.fn.proto)); err != context.Canceled {
+		t.Errorf("expected spawn on closed owner to fail, got %v", err)
+	}
+}
+
+func TestPoolOf(t *testing.T) {
+	var (
+		a, b     = lua.NewState(), lua.NewState()
+		rtA, rtB = core.NewRuntime(), core.NewRuntime()
+		prepared = 0
+	)
+	defer a.Close()
+	defer b.Close()
+	rtA.Prepare = func(L *lua.LState) {
+		prepared++
+		L.SetGlobal("prepared", lua.LTrue)
+	}
+	for L, rt := range map[*lua.LState]*core.Runtime{a: rtA, b: rtB} {
+		core.SetRuntime(L, rt)
+		L.PreloadModule(Name, NewLuaTaskTables())
+		// probe(v) 返回 task 的 vm 中上一次写入的 package.loaded.tenant
+		if err := L.DoString(`
+function probe(v)
+	return require("task").spawn(function(v)
+		local old = package.loaded.tenant
+		package.loaded.tenant = v
+		return old, prepared
+	end, v):await()
+end`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if PoolOf(rtA) == PoolOf(rtB) || PoolOf(rtA) != PoolOf(rtA) {
+		t.Fatal("pools should be per runtime")
+	}
+	// 插件之间不共享 vm, 插件的 vm 经 Prepare 配置
+	if err := a.DoString(`probe("a")`); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DoString(`probe("b")`); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DoString(`local old, prepared = probe("a"); assert(old == "a" and prepared == true, tostring(old))`); err != nil {
+		t.Error(err)
+	}
+	if err := b.DoString(`local old, prepared = probe("b"); assert(old == "b" and prepared == nil, tostring(old))`); err != nil {
+		t.Error(err)
+	}
+	if prepared != 1 {
+		t.Errorf("expected one prepared vm, got %d", prepared)
+	}
+	var pool = PoolOf(rtA)
+	rtA.Close()
+	if !pool.Closed() {
+		t.Error("pool not closed with its runtime")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	var (
+		L           = lua.NewState()
+		ch          = make(chan map[string]interface{}, 2)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	defer L.Close()
+	defer cancel()
+	var iter, err = Iterator(L, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Iterator(L, make(chan<- int)); err != ErrNotChannel {
+		t.Errorf("expected ErrNotChannel, got %v", err)
+	}
+	L.SetGlobal("events", iter)
+	ch <- map[string]interface{}{"name": "a"}
+	ch <- map[string]interface{}{"name": "b"}
+	close(ch)
+	err = L.DoString(`
+names = ""
+for i, event in events do names = names .. i .. event.name end
+assert(names == "1a2b", names)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocked = make(chan int)
+	iter, _ = Iterator(L, blocked)
+	L.SetGlobal("blocked", iter)
+	L.SetContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = L.DoString(`for _ in blocked do end`)
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Errorf("expected cancellation error, got %v", err)
+	}
+}
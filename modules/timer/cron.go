@@ -0,0 +1,143 @@
+package timer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Schedule 5 段 cron 表达式: 分 时 日 月 周
+	Schedule struct {
+		expr   string
+		minute uint64
+		hour   uint64
+		dom    uint64
+		month  uint64
+		dow    uint64
+		anyDom bool
+		anyDow bool
+	}
+
+	cronField struct {
+		name     string
+		min, max int
+	}
+)
+
+var (
+	cronFields = []cronField{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+)
+
+// ParseCron 解析 cron 表达式, 每段支持 *, */n, a-b, a-b/n, a,b; 周的 0 与 7 均为周日
+func ParseCron(expr string) (*Schedule, error) {
+	var fields = strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	var (
+		bits     = make([]uint64, len(fields))
+		schedule = &Schedule{expr: expr}
+	)
+	for i, field := range fields {
+		var v, err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+		bits[i] = v
+	}
+	schedule.minute, schedule.hour, schedule.dom, schedule.month, schedule.dow = bits[0], bits[1], bits[2], bits[3], bits[4]
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.anyDom = strings.HasPrefix(fields[2], "*")
+	schedule.anyDow = strings.HasPrefix(fields[4], "*")
+	return schedule, nil
+}
+
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		var (
+			step     = 1
+			min, max = spec.min, spec.max
+			err      error
+		)
+		if i := strings.Index(part, "/"); i >= 0 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%s: invalid step %q", spec.name, part)
+			}
+			part = part[:i]
+		}
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			var bounds = strings.SplitN(part, "-", 2)
+			if min, err = strconv.Atoi(bounds[0]); err == nil {
+				max, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil {
+				return 0, fmt.Errorf("%s: invalid range %q", spec.name, part)
+			}
+		default:
+			if min, err = strconv.Atoi(part); err != nil {
+				return 0, fmt.Errorf("%s: invalid value %q", spec.name, part)
+			}
+			max = min
+			if step > 1 {
+				max = spec.max
+			}
+		}
+		if min < spec.min || max > spec.max || min > max {
+			return 0, fmt.Errorf("%s: %q out of range %d-%d", spec.name, part, spec.min, spec.max)
+		}
+		for v := min; v <= max; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Next t 之后 (不含) 的下一个触发时间, 5 年内无匹配时返回零值
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	var limit = t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches 日与周同时受限时满足其一即可 (与 vixie cron 一致)
+func (s *Schedule) dayMatches(t time.Time) bool {
+	var (
+		dom = s.dom&(1<<uint(t.Day())) != 0
+		dow = s.dow&(1<<uint(t.Weekday())) != 0
+	)
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,389 @@
+package timer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/weblfe/plugin_lua/core"
+	"sync"
+	"time"
+)
+
+type (
+	// Loop 宿主持有的事件循环, 回调在所属插件的 vm 上串行执行
+	Loop struct {
+		safe   sync.Mutex
+		clock  core.Clock
+		seq    uint64
+		timers map[uint64]*Timer
+		owners map[*core.Runtime]bool
+		queue  timerQueue
+		// pending 后台循环中各插件待执行的定时器, 每个插件一个 goroutine 依次执行
+		pending map[*core.Runtime][]*Timer
+		wake    chan struct{}
+		stop    chan struct{}
+		running bool
+		// OnError 回调返回错误时调用, 为空时忽略
+		OnError func(owner string, err error)
+	}
+
+	// Timer 一次性, 固定间隔或 cron 定时器
+	Timer struct {
+		ID       uint64
+		due      time.Time
+		interval time.Duration
+		schedule *Schedule
+		owner    *core.Runtime
+		fn       func(ctx context.Context) error
+		index    int
+		queued   bool
+		// cancelled 已取消, 已到期等待执行的不再执行
+		cancelled bool
+	}
+
+	timerQueue []*Timer
+)
+
+var (
+	ErrLoopStopped = errors.New("timer loop stopped")
+	ErrOwnerBusy   = errors.New("timer owner busy")
+
+	// CallbackTimeout 插件未配置 CallTimeout 时, 等待 vm 空闲与执行回调各自的超时
+	CallbackTimeout = 30 * time.Second
+
+	defaultLoop     *Loop
+	defaultLoopOnce sync.Once
+)
+
+func NewLoop(clock core.Clock) *Loop {
+	if clock == nil {
+		clock = core.SystemClock
+	}
+	return &Loop{
+		clock:   clock,
+		timers:  make(map[uint64]*Timer),
+		owners:  make(map[*core.Runtime]bool),
+		pending: make(map[*core.Runtime][]*Timer),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// DefaultLoop 未通过 ModuleOptions["timer"] 注入时使用的系统时钟事件循环
+func DefaultLoop() *Loop {
+	defaultLoopOnce.Do(func() {
+		defaultLoop = NewLoop(core.SystemClock)
+		defaultLoop.Start()
+	})
+	return defaultLoop
+}
+
+func (loop *Loop) Clock() core.Clock {
+	return loop.clock
+}
+
+// After 在 delay 后执行 fn, ctx 在超时后取消, interval > 0 时之后每隔 interval 重复执行
+func (loop *Loop) After(owner *core.Runtime, delay, interval time.Duration, fn func(ctx context.Context) error) uint64 {
+	return loop.add(&Timer{
+		due:      loop.clock.Now().Add(delay),
+		interval: interval,
+		owner:    owner,
+		fn:       fn,
+	})
+}
+
+// Cron 按 schedule 重复执行 fn
+func (loop *Loop) Cron(owner *core.Runtime, schedule *Schedule, fn func(ctx context.Context) error) uint64 {
+	return loop.add(&Timer{
+		due:      schedule.Next(loop.clock.Now()),
+		schedule: schedule,
+		owner:    owner,
+		fn:       fn,
+	})
+}
+
+func (loop *Loop) add(timer *Timer) uint64 {
+	loop.safe.Lock()
+	loop.seq++
+	timer.ID = loop.seq
+	loop.timers[timer.ID] = timer
+	heap.Push(&loop.queue, timer)
+	var owner = timer.owner
+	var watch = owner != nil && !loop.owners[owner]
+	if watch {
+		loop.owners[owner] = true
+	}
+	loop.safe.Unlock()
+	// 插件关闭 (Close/Reload) 时取消其全部定时器
+	if watch {
+		owner.OnClose(func() {
+			loop.clearOwner(owner)
+		})
+	}
+	loop.notify()
+	return timer.ID
+}
+
+func (loop *Loop) clearOwner(owner *core.Runtime) {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	delete(loop.owners, owner)
+	delete(loop.pending, owner)
+	for id, timer := range loop.timers {
+		if timer.owner != owner {
+			continue
+		}
+		delete(loop.timers, id)
+		timer.cancelled = true
+		if timer.index >= 0 {
+			heap.Remove(&loop.queue, timer.index)
+		}
+	}
+}
+
+// Clear 取消 owner 的定时器, 返回是否存在; 其他插件的定时器视为不存在
+func (loop *Loop) Clear(owner *core.Runtime, id uint64) bool {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	var timer, ok = loop.timers[id]
+	if !ok || timer.owner != owner {
+		return false
+	}
+	delete(loop.timers, id)
+	timer.cancelled = true
+	if timer.index >= 0 {
+		heap.Remove(&loop.queue, timer.index)
+	}
+	return true
+}
+
+// Len 未取消的定时器数量
+func (loop *Loop) Len() int {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	return len(loop.timers)
+}
+
+// RunDue 依次执行已到期的定时器, 返回执行的数量; 手动时钟下由测试推进时间后调用
+func (loop *Loop) RunDue() int {
+	var count = 0
+	for {
+		var timer = loop.pop()
+		if timer == nil {
+			return count
+		}
+		count++
+		loop.run(timer)
+	}
+}
+
+// pop 取出一个到期的定时器, 重复执行的定时器重新入队
+func (loop *Loop) pop() *Timer {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	var now = loop.clock.Now()
+	if len(loop.queue) == 0 || loop.queue[0].due.After(now) {
+		return nil
+	}
+	var timer = heap.Pop(&loop.queue).(*Timer)
+	switch {
+	case timer.interval > 0:
+		if timer.due = timer.due.Add(timer.interval); !timer.due.After(now) {
+			timer.due = now.Add(timer.interval)
+		}
+	case timer.schedule != nil:
+		timer.due = timer.schedule.Next(now)
+	default:
+		delete(loop.timers, timer.ID)
+		return timer
+	}
+	if timer.due.IsZero() {
+		delete(loop.timers, timer.ID)
+	} else {
+		heap.Push(&loop.queue, timer)
+	}
+	return timer
+}
+
+// dispatch 将到期的定时器交给所属插件的 goroutine, 不阻塞事件循环; 上一次尚未执行的定时器不重复入队
+func (loop *Loop) dispatch(timer *Timer) {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	if timer.queued {
+		return
+	}
+	timer.queued = true
+	var owner = timer.owner
+	var queue, working = loop.pending[owner]
+	loop.pending[owner] = append(queue, timer)
+	if !working {
+		go loop.work(owner)
+	}
+}
+
+// work 依次执行 owner 待执行的定时器, 队列为空时退出
+func (loop *Loop) work(owner *core.Runtime) {
+	for {
+		loop.safe.Lock()
+		var queue = loop.pending[owner]
+		if len(queue) == 0 {
+			delete(loop.pending, owner)
+			loop.safe.Unlock()
+			return
+		}
+		var timer = queue[0]
+		loop.pending[owner] = queue[1:]
+		timer.queued = false
+		loop.safe.Unlock()
+		loop.run(timer)
+	}
+}
+
+// run 在超时内获取 vm 执行权后执行, 插件已关闭或定时器已取消时跳过
+func (loop *Loop) run(timer *Timer) {
+	var (
+		owner   = timer.owner
+		timeout = CallbackTimeout
+	)
+	if owner != nil && owner.CallTimeout > 0 {
+		timeout = owner.CallTimeout
+	}
+	if owner != nil {
+		var ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		var err = owner.Acquire(ctx)
+		cancel()
+		if err != nil {
+			loop.fail(owner, fmt.Errorf("%w: timer %d: %v", ErrOwnerBusy, timer.ID, err))
+			return
+		}
+		defer owner.Release()
+		if owner.Closed() {
+			return
+		}
+	}
+	// 到期后等待执行期间可能已被取消 (如被同一插件的其他回调 clear)
+	loop.safe.Lock()
+	var cancelled = timer.cancelled
+	loop.safe.Unlock()
+	if cancelled {
+		return
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := timer.fn(ctx); err != nil {
+		loop.fail(owner, err)
+	}
+}
+
+func (loop *Loop) fail(owner *core.Runtime, err error) {
+	if loop.OnError == nil {
+		return
+	}
+	var name string
+	if owner != nil {
+		name = owner.Name
+	}
+	loop.OnError(name, err)
+}
+
+func (loop *Loop) notify() {
+	select {
+	case loop.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start 在后台 goroutine 中按时钟驱动事件循环
+func (loop *Loop) Start() {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	if loop.running {
+		return
+	}
+	loop.running = true
+	loop.stop = make(chan struct{})
+	go loop.serve(loop.stop)
+}
+
+// Stop 停止后台 goroutine 并取消全部定时器
+func (loop *Loop) Stop() {
+	loop.safe.Lock()
+	defer loop.safe.Unlock()
+	if loop.running {
+		loop.running = false
+		close(loop.stop)
+	}
+	for _, timer := range loop.timers {
+		timer.cancelled = true
+	}
+	loop.timers = make(map[uint64]*Timer)
+	loop.owners = make(map[*core.Runtime]bool)
+	loop.pending = make(map[*core.Runtime][]*Timer)
+	loop.queue = nil
+}
+
+func (loop *Loop) serve(stop chan struct{}) {
+	for {
+		var (
+			wait  <-chan time.Time
+			timer *time.Timer
+		)
+		loop.safe.Lock()
+		if len(loop.queue) > 0 {
+			timer = time.NewTimer(loop.queue[0].due.Sub(loop.clock.Now()))
+			wait = timer.C
+		}
+		loop.safe.Unlock()
+		select {
+		case <-stop:
+		case <-loop.wake:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		for timer := loop.pop(); timer != nil; timer = loop.pop() {
+			loop.dispatch(timer)
+		}
+	}
+}
+
+func (q timerQueue) Len() int {
+	return len(q)
+}
+
+func (q timerQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].ID < q[j].ID
+	}
+	return q[i].due.Before(q[j].due)
+}
+
+func (q timerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *timerQueue) Push(x interface{}) {
+	var timer = x.(*Timer)
+	timer.index = len(*q)
+	*q = append(*q, timer)
+}
+
+func (q *timerQueue) Pop() interface{} {
+	var (
+		old   = *q
+		n     = len(old)
+		timer = old[n-1]
+	)
+	old[n-1] = nil
+	timer.index = -1
+	*q = old[:n-1]
+	return timer
+}
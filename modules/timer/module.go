@@ -0,0 +1,15 @@
+package timer
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "timer"
+)
+
+func NewLuaTimerTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(Name, Funcs)
+		state.Push(mod)
+		return 1
+	}
+}
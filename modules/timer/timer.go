@@ -0,0 +1,119 @@
+package timer
+
+import (
+	"context"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"github.com/yuin/gopher-lua"
+	"time"
+)
+
+var (
+	Funcs = map[string]lua.LGFunction{
+		"setTimeout":  luaSetTimeout,
+		"setInterval": luaSetInterval,
+		"clear":       luaClear,
+		"cron":        luaCron,
+		"now":         luaNow,
+	}
+)
+
+// GetLoop 获取 L 所属插件的事件循环, 通过 PluginOptions.ModuleOptions["timer"] 注入 *Loop
+func GetLoop(L *lua.LState) *Loop {
+	if loop, ok := core.GetRuntime(L).Option(Name).(*Loop); ok && loop != nil {
+		return loop
+	}
+	return DefaultLoop()
+}
+
+// callback 回调在主线程上以保护模式执行 (调度时所在的协程可能已结束), 额外的参数原样传入, ctx 取消时中止
+// 每次执行记录 timer.callback span
+func callback(L *lua.LState, fn *lua.LFunction, args []lua.LValue) func(ctx context.Context) error {
+	L = L.G.MainThread
+	return func(ctx context.Context) (err error) {
+		var rt = core.GetRuntime(L)
+		ctx, span := trace.Of(rt).Start(ctx, "timer.callback")
+		span.SetAttribute("plugin", rt.Name)
+		var (
+			top      = L.GetTop()
+			previous = L.RemoveContext()
+		)
+		L.SetContext(ctx)
+		defer func() {
+			L.SetTop(top)
+			L.RemoveContext()
+			if previous != nil {
+				L.SetContext(previous)
+			}
+			span.Finish(err)
+		}()
+		return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, args...)
+	}
+}
+
+func extraArgs(L *lua.LState, from int) []lua.LValue {
+	var args []lua.LValue
+	for i := from; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+	return args
+}
+
+func duration(L *lua.LState, n int) time.Duration {
+	var ms = L.CheckNumber(n)
+	if ms < 0 {
+		L.ArgError(n, "delay must be >= 0")
+	}
+	return time.Duration(float64(ms) * float64(time.Millisecond))
+}
+
+// luaSetTimeout timer.setTimeout(fn, ms, ...) id
+func luaSetTimeout(L *lua.LState) int {
+	var (
+		fn    = L.CheckFunction(1)
+		delay = duration(L, 2)
+		id    = GetLoop(L).After(core.GetRuntime(L), delay, 0, callback(L, fn, extraArgs(L, 3)))
+	)
+	L.Push(lua.LNumber(id))
+	return 1
+}
+
+// luaSetInterval timer.setInterval(fn, ms, ...) id
+func luaSetInterval(L *lua.LState) int {
+	var (
+		fn       = L.CheckFunction(1)
+		interval = duration(L, 2)
+	)
+	if interval <= 0 {
+		L.ArgError(2, "interval must be > 0")
+	}
+	var id = GetLoop(L).After(core.GetRuntime(L), interval, interval, callback(L, fn, extraArgs(L, 3)))
+	L.Push(lua.LNumber(id))
+	return 1
+}
+
+// luaClear timer.clear(id) bool, 只能取消本插件的定时器
+func luaClear(L *lua.LState) int {
+	L.Push(lua.LBool(GetLoop(L).Clear(core.GetRuntime(L), uint64(L.CheckNumber(1)))))
+	return 1
+}
+
+// luaCron timer.cron("*/5 * * * *", fn, ...) id
+func luaCron(L *lua.LState) int {
+	var schedule, err = ParseCron(L.CheckString(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	var (
+		fn = L.CheckFunction(2)
+		id = GetLoop(L).Cron(core.GetRuntime(L), schedule, callback(L, fn, extraArgs(L, 3)))
+	)
+	L.Push(lua.LNumber(id))
+	return 1
+}
+
+// luaNow timer.now() 事件循环时钟的毫秒时间戳
+func luaNow(L *lua.LState) int {
+	L.Push(lua.LNumber(GetLoop(L).Clock().Now().UnixNano() / int64(time.Millisecond)))
+	return 1
+}
@@ -0,0 +1,224 @@
+package timer
+
+import (
+	"context"
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/weblfe/plugin_lua/modules/trace"
+	"github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoop(t *testing.T) {
+	var (
+		clock = core.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		loop  = NewLoop(clock)
+		L     = lua.NewState()
+		rt    = core.NewRuntime()
+	)
+	defer L.Close()
+	var failures []string
+	loop.OnError = func(owner string, err error) {
+		failures = append(failures, err.Error())
+	}
+	rt.Options = map[string]interface{}{Name: loop}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaTimerTables())
+	var err = L.DoString(`
+timer = require("timer")
+events = {}
+timer.setTimeout(function(tag) table.insert(events, tag) end, 1000, "timeout")
+interval = timer.setInterval(function() table.insert(events, "interval") end, 400)
+timer.cron("*/5 * * * *", function() table.insert(events, "cron") end)
+local cancelled = timer.setTimeout(function() table.insert(events, "cancelled") end, 10)
+assert(timer.clear(cancelled))
+timer.setTimeout(function() error("callback failed") end, 500)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events = func() string {
+		var values []string
+		L.GetGlobal("events").(*lua.LTable).ForEach(func(_ lua.LValue, v lua.LValue) {
+			values = append(values, v.String())
+		})
+		return strings.Join(values, ",")
+	}
+	if n := loop.RunDue(); n != 0 {
+		t.Errorf("nothing should be due, ran %d", n)
+	}
+	clock.Add(1 * time.Second)
+	loop.RunDue()
+	if got := events(); got != "interval,timeout" {
+		t.Errorf("unexpected events %q", got)
+	}
+	if len(failures) != 1 || !strings.Contains(failures[0], "callback failed") {
+		t.Errorf("unexpected failures %v", failures)
+	}
+	clock.Add(5 * time.Minute)
+	loop.RunDue()
+	if got := events(); got != "interval,timeout,interval,cron" {
+		t.Errorf("unexpected events %q", got)
+	}
+	if err = L.DoString(`assert(timer.clear(interval))`); err != nil {
+		t.Fatal(err)
+	}
+	// 插件关闭时取消剩余的定时器
+	rt.Close()
+	if loop.Len() != 0 {
+		t.Errorf("timers should be cleared on close, left %d", loop.Len())
+	}
+}
+
+func TestLoop_ClearOwner(t *testing.T) {
+	var (
+		loop             = NewLoop(core.NewManualClock(time.Unix(0, 0)))
+		owner, other     = lua.NewState(), lua.NewState()
+		ownerRt, otherRt = core.NewRuntime(), core.NewRuntime()
+	)
+	defer owner.Close()
+	defer other.Close()
+	for L, rt := range map[*lua.LState]*core.Runtime{owner: ownerRt, other: otherRt} {
+		rt.Options = map[string]interface{}{Name: loop}
+		core.SetRuntime(L, rt)
+		L.PreloadModule(Name, NewLuaTimerTables())
+	}
+	if err := owner.DoString(`id = require("timer").setInterval(function() end, 100)`); err != nil {
+		t.Fatal(err)
+	}
+	// 其他插件不能取消不属于自己的定时器
+	other.SetGlobal("id", owner.GetGlobal("id"))
+	if err := other.DoString(`assert(not require("timer").clear(id))`); err != nil {
+		t.Error(err)
+	}
+	if loop.Len() != 1 {
+		t.Errorf("timer of another plugin cleared")
+	}
+	if err := owner.DoString(`assert(require("timer").clear(id))`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoop_Trace(t *testing.T) {
+	var (
+		loop     = NewLoop(core.NewManualClock(time.Unix(0, 0)))
+		exporter = trace.NewMemoryExporter()
+		L        = lua.NewState()
+		rt       = core.NewRuntime()
+	)
+	defer L.Close()
+	rt.Name = "orders"
+	rt.Options = map[string]interface{}{Name: loop, trace.Name: trace.NewTracer(exporter)}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaTimerTables())
+	if err := L.DoString(`require("timer").setTimeout(function() end, 0)`); err != nil {
+		t.Fatal(err)
+	}
+	loop.RunDue()
+	var spans = exporter.Spans()
+	if len(spans) != 1 || spans[0].Name != "timer.callback" || spans[0].Attributes["plugin"] != "orders" {
+		t.Errorf("unexpected spans %v", spans)
+	}
+}
+
+func TestLoop_BusyOwner(t *testing.T) {
+	var (
+		loop  = NewLoop(core.SystemClock)
+		busy  = core.NewRuntime()
+		slow  = core.NewRuntime()
+		other = core.NewRuntime()
+		ran   = make(chan string, 4)
+		errs  = make(chan error, 4)
+	)
+	busy.CallTimeout, slow.CallTimeout = 50*time.Millisecond, 50*time.Millisecond
+	loop.OnError = func(owner string, err error) {
+		errs <- err
+	}
+	loop.Start()
+	defer loop.Stop()
+	_ = busy.Acquire(context.Background())
+	defer busy.Release()
+	loop.After(busy, 0, 0, func(ctx context.Context) error {
+		ran <- "busy"
+		return nil
+	})
+	loop.After(slow, 0, 0, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	loop.After(other, 10*time.Millisecond, 0, func(ctx context.Context) error {
+		ran <- "other"
+		return nil
+	})
+	select {
+	case name := <-ran:
+		if name != "other" {
+			t.Errorf("unexpected callback %s", name)
+		}
+	case <-time.After(40 * time.Millisecond):
+		t.Fatal("other plugin's timer blocked by a busy owner")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrOwnerBusy) && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("unexpected error %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("busy owner and slow callback should time out")
+		}
+	}
+}
+
+func TestLoop_ClearPending(t *testing.T) {
+	var (
+		loop  = NewLoop(core.SystemClock)
+		owner = core.NewRuntime()
+		ran   = make(chan struct{}, 4)
+	)
+	loop.Start()
+	defer loop.Stop()
+	_ = owner.Acquire(context.Background())
+	var id = loop.After(owner, 0, 5*time.Millisecond, func(ctx context.Context) error {
+		ran <- struct{}{}
+		return nil
+	})
+	// 到期后等待 vm 空闲期间被取消, 不再执行
+	time.Sleep(20 * time.Millisecond)
+	if !loop.Clear(owner, id) {
+		t.Fatal("timer not found")
+	}
+	owner.Release()
+	select {
+	case <-ran:
+		t.Error("cleared timer ran")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCron(t *testing.T) {
+	var from = time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	for expr, expect := range map[string]string{
+		"*/5 * * * *":        "2024-01-01 10:10",
+		"0 9 * * *":          "2024-01-02 09:00",
+		"30 8 1 * *":         "2024-02-01 08:30",
+		"0 0 * * 7":          "2024-01-07 00:00",
+		"15 10-12/2 * * 1-5": "2024-01-01 10:15",
+		"0 0 29 2 *":         "2024-02-29 00:00",
+	} {
+		var schedule, err = ParseCron(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schedule.Next(from).Format("2006-01-02 15:04"); got != expect {
+			t.Errorf("%s: expect %s, got %s", expr, expect, got)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%s should be invalid", expr)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+type (
+	// Exporter 接收已结束的 span, 可能被并发调用
+	Exporter interface {
+		Export(span *Span) error
+	}
+
+	// MemoryExporter 保存在内存中, 用于测试
+	MemoryExporter struct {
+		safe  sync.Mutex
+		spans []*Span
+	}
+
+	// JSONLinesExporter 每个 span 写出一行 json
+	JSONLinesExporter struct {
+		safe   sync.Mutex
+		writer io.Writer
+		closer io.Closer
+	}
+)
+
+func NewMemoryExporter() *MemoryExporter {
+	return new(MemoryExporter)
+}
+
+func (exporter *MemoryExporter) Export(span *Span) error {
+	exporter.safe.Lock()
+	defer exporter.safe.Unlock()
+	exporter.spans = append(exporter.spans, span)
+	return nil
+}
+
+// Spans 已导出的 span, 按结束顺序排列
+func (exporter *MemoryExporter) Spans() []*Span {
+	exporter.safe.Lock()
+	defer exporter.safe.Unlock()
+	return append([]*Span(nil), exporter.spans...)
+}
+
+func (exporter *MemoryExporter) Reset() {
+	exporter.safe.Lock()
+	defer exporter.safe.Unlock()
+	exporter.spans = nil
+}
+
+func NewJSONLinesExporter(w io.Writer) *JSONLinesExporter {
+	return &JSONLinesExporter{writer: w}
+}
+
+// NewFileExporter 以追加方式写入文件
+func NewFileExporter(file string) (*JSONLinesExporter, error) {
+	var fd, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesExporter{writer: fd, closer: fd}, nil
+}
+
+func (exporter *JSONLinesExporter) Export(span *Span) error {
+	var data, err = json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	exporter.safe.Lock()
+	defer exporter.safe.Unlock()
+	_, err = exporter.writer.Write(append(data, '\n'))
+	return err
+}
+
+// Close 关闭 NewFileExporter 打开的文件
+func (exporter *JSONLinesExporter) Close() error {
+	exporter.safe.Lock()
+	defer exporter.safe.Unlock()
+	if exporter.closer == nil {
+		return nil
+	}
+	var err = exporter.closer.Close()
+	exporter.closer = nil
+	return err
+}
@@ -0,0 +1,15 @@
+package trace
+
+import "github.com/yuin/gopher-lua"
+
+const (
+	Name = "trace"
+)
+
+func NewLuaTraceTables() lua.LGFunction {
+	return func(state *lua.LState) int {
+		var mod = state.RegisterModule(Name, Funcs)
+		state.Push(mod)
+		return 1
+	}
+}
@@ -0,0 +1,43 @@
+package trace
+
+import (
+	"context"
+	nethttp "net/http"
+	"strings"
+)
+
+const (
+	// TraceParentHeader W3C trace context 请求头
+	TraceParentHeader = "traceparent"
+)
+
+// Inject 将 ctx 中的 span 写入 traceparent 请求头
+func Inject(ctx context.Context, header nethttp.Header) {
+	var span = FromContext(ctx)
+	if span == nil {
+		return
+	}
+	header.Set(TraceParentHeader, "00-"+span.TraceID+"-"+span.SpanID+"-01")
+}
+
+// Extract 读取 traceparent 请求头, 作为 ctx 中的远程父 span
+func Extract(ctx context.Context, header nethttp.Header) context.Context {
+	var parts = strings.Split(header.Get(TraceParentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || !isHex(parts[1]) || !isHex(parts[2]) {
+		return ctx
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var remote = &Span{TraceID: parts[1], SpanID: parts[2], remote: true}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return strings.Trim(s, "0") != ""
+}
@@ -0,0 +1,192 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/weblfe/plugin_lua/core"
+	"sync"
+	"time"
+)
+
+type (
+	// Tracer 创建 span 并在结束时交给 Exporter, 未设置 Exporter 时只传播 context
+	Tracer struct {
+		safe     sync.RWMutex
+		exporter Exporter
+		clock    core.Clock
+		// OnError 导出失败时的回调, 为空时忽略
+		OnError func(err error)
+	}
+
+	// Span 一次计时的操作, End 之后不再修改
+	Span struct {
+		TraceID    string                 `json:"trace_id"`
+		SpanID     string                 `json:"span_id"`
+		ParentID   string                 `json:"parent_id,omitempty"`
+		Name       string                 `json:"name"`
+		StartTime  time.Time              `json:"start"`
+		EndTime    time.Time              `json:"end"`
+		Attributes map[string]interface{} `json:"attributes,omitempty"`
+		Status     string                 `json:"status"`
+		Error      string                 `json:"error,omitempty"`
+		safe       sync.Mutex
+		tracer     *Tracer
+		ended      bool
+		remote     bool
+	}
+
+	spanKey struct{}
+)
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+var (
+	defaultTracer = NewTracer(nil)
+)
+
+// NewTracer 创建 Tracer, exporter 可为空
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter, clock: core.SystemClock}
+}
+
+// DefaultTracer 未通过 PluginOptions.ModuleOptions["trace"] 注入 *Tracer 时使用的全局 Tracer
+func DefaultTracer() *Tracer {
+	return defaultTracer
+}
+
+// Of 获取插件运行时配置的 Tracer
+func Of(rt *core.Runtime) *Tracer {
+	if rt != nil {
+		if tracer, ok := rt.Option(Name).(*Tracer); ok && tracer != nil {
+			return tracer
+		}
+	}
+	return DefaultTracer()
+}
+
+func (tracer *Tracer) SetExporter(exporter Exporter) *Tracer {
+	tracer.safe.Lock()
+	defer tracer.safe.Unlock()
+	tracer.exporter = exporter
+	return tracer
+}
+
+// SetClock 设置计时使用的时钟 (测试用)
+func (tracer *Tracer) SetClock(clock core.Clock) *Tracer {
+	tracer.safe.Lock()
+	defer tracer.safe.Unlock()
+	tracer.clock = clock
+	return tracer
+}
+
+func (tracer *Tracer) now() time.Time {
+	tracer.safe.RLock()
+	defer tracer.safe.RUnlock()
+	return tracer.clock.Now()
+}
+
+// Start 以 ctx 中的 span 为父 span 开始新的 span, 返回携带新 span 的 context
+func (tracer *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var span = &Span{
+		Name:      name,
+		SpanID:    newID(8),
+		StartTime: tracer.now(),
+		Status:    StatusOK,
+		tracer:    tracer,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		span.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext ctx 中当前的 span (可能是 Extract 得到的远程 span)
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	var span, _ = ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttribute 设置属性, 值应可被 json 编码
+func (span *Span) SetAttribute(key string, value interface{}) *Span {
+	span.safe.Lock()
+	defer span.safe.Unlock()
+	if span.ended {
+		return span
+	}
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]interface{})
+	}
+	span.Attributes[key] = value
+	return span
+}
+
+// SetError err 非空时标记 span 失败
+func (span *Span) SetError(err error) *Span {
+	if err == nil {
+		return span
+	}
+	span.safe.Lock()
+	defer span.safe.Unlock()
+	if !span.ended {
+		span.Status, span.Error = StatusError, err.Error()
+	}
+	return span
+}
+
+// Finish 记录 err 后结束 span
+func (span *Span) Finish(err error) {
+	span.SetError(err).End()
+}
+
+// End 结束 span 并导出, 重复调用无效
+func (span *Span) End() {
+	span.safe.Lock()
+	if span.ended || span.remote {
+		span.safe.Unlock()
+		return
+	}
+	span.ended = true
+	span.EndTime = span.tracer.now()
+	span.safe.Unlock()
+	span.tracer.export(span)
+}
+
+// Duration span 的耗时, 未结束时为 0
+func (span *Span) Duration() time.Duration {
+	span.safe.Lock()
+	defer span.safe.Unlock()
+	if !span.ended {
+		return 0
+	}
+	return span.EndTime.Sub(span.StartTime)
+}
+
+func (tracer *Tracer) export(span *Span) {
+	tracer.safe.RLock()
+	var exporter, onError = tracer.exporter, tracer.OnError
+	tracer.safe.RUnlock()
+	if exporter == nil {
+		return
+	}
+	if err := exporter.Export(span); err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+func newID(size int) string {
+	var id = make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	Funcs = map[string]lua.LGFunction{
+		"span":    luaSpan,
+		"current": luaCurrent,
+	}
+)
+
+// GetTracer 获取 L 所属插件的 Tracer
+func GetTracer(L *lua.LState) *Tracer {
+	return Of(core.GetRuntime(L))
+}
+
+// StartL 以 L 的 context 为父 context 开始 span, 供各模块包装 Go 调用
+func StartL(L *lua.LState, name string) (context.Context, *Span) {
+	var ctx = L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return GetTracer(L).Start(ctx, name)
+}
+
+// luaSpan trace.span(name, fn, ...) ...; fn(span, ...) 在新 span 中执行, 期间 L 的 context 携带该 span,
+// fn 抛出的错误记录到 span 后重新抛出
+func luaSpan(L *lua.LState) int {
+	var (
+		name      = L.CheckString(1)
+		fn        = L.CheckFunction(2)
+		ctx, span = StartL(L, name)
+		previous  = L.RemoveContext()
+		top       = L.GetTop()
+	)
+	L.SetContext(ctx)
+	var args = []lua.LValue{spanTable(L, span)}
+	for i := 3; i <= top; i++ {
+		args = append(args, L.Get(i))
+	}
+	var err = L.CallByParam(lua.P{Fn: fn, NRet: lua.MultRet, Protect: true}, args...)
+	L.RemoveContext()
+	if previous != nil {
+		L.SetContext(previous)
+	}
+	if err != nil {
+		span.Finish(err)
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && apiErr.Object != nil {
+			L.Error(apiErr.Object, 0)
+		}
+		L.RaiseError("%s", err.Error())
+	}
+	span.End()
+	return L.GetTop() - top
+}
+
+// luaCurrent trace.current() {trace_id, span_id} | nil
+func luaCurrent(L *lua.LState) int {
+	var span = FromContext(L.Context())
+	if span == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	var t = L.NewTable()
+	t.RawSetString("trace_id", lua.LString(span.TraceID))
+	t.RawSetString("span_id", lua.LString(span.SpanID))
+	L.Push(t)
+	return 1
+}
+
+// spanTable span:set(key, value), span:error(msg); 字段 trace_id, span_id
+func spanTable(L *lua.LState, span *Span) *lua.LTable {
+	var t = L.NewTable()
+	t.RawSetString("trace_id", lua.LString(span.TraceID))
+	t.RawSetString("span_id", lua.LString(span.SpanID))
+	t.RawSetString("set", L.NewFunction(func(L *lua.LState) int {
+		var v, err = core.ToGo(L.CheckAny(3))
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		span.SetAttribute(L.CheckString(2), v)
+		return 0
+	}))
+	t.RawSetString("error", L.NewFunction(func(L *lua.LState) int {
+		span.SetError(errors.New(L.CheckString(2)))
+		return 0
+	}))
+	return t
+}
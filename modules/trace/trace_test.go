@@ -0,0 +1,116 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	nethttp "net/http"
+	"strings"
+	"testing"
+)
+
+func TestLuaSpan(t *testing.T) {
+	var (
+		L        = lua.NewState()
+		rt       = core.NewRuntime()
+		exporter = NewMemoryExporter()
+		tracer   = NewTracer(exporter)
+	)
+	defer L.Close()
+	rt.Options = map[string]interface{}{Name: tracer}
+	core.SetRuntime(L, rt)
+	L.PreloadModule(Name, NewLuaTraceTables())
+	// 模拟模块内的 Go 调用
+	L.SetGlobal("query", L.NewFunction(func(L *lua.LState) int {
+		var _, span = StartL(L, "sql.query")
+		span.End()
+		return 0
+	}))
+	var parent, root = tracer.Start(context.Background(), "plugin.call")
+	L.SetContext(parent)
+	var err = L.DoString(`
+local trace = require("trace")
+local a, b = trace.span("outer", function(span, x)
+	span:set("order", {id = x})
+	assert(trace.current().span_id == span.span_id)
+	trace.span("inner", function() query() end)
+	return x, "done"
+end, 7)
+assert(a == 7 and b == "done")
+assert(trace.current() ~= nil)
+local ok, err = pcall(trace.span, "failing", function() error({code = 42}) end)
+assert(not ok and err.code == 42)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+	var spans = exporter.Spans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+		if span.TraceID != root.TraceID {
+			t.Errorf("span %s not in root trace", span.Name)
+		}
+	}
+	if strings.Join(names, ",") != "sql.query,inner,outer,failing,plugin.call" {
+		t.Fatalf("unexpected spans %v", names)
+	}
+	var (
+		query, inner, outer, failing = spans[0], spans[1], spans[2], spans[3]
+	)
+	if query.ParentID != inner.SpanID || inner.ParentID != outer.SpanID || outer.ParentID != root.SpanID {
+		t.Error("unexpected span hierarchy")
+	}
+	if id, _ := outer.Attributes["order"].(map[string]interface{})["id"]; id != int64(7) && id != float64(7) {
+		t.Errorf("unexpected attribute %v", outer.Attributes)
+	}
+	if failing.Status != StatusError || failing.Error == "" {
+		t.Errorf("expected failing span to be marked, got %q %q", failing.Status, failing.Error)
+	}
+}
+
+func TestJSONLinesExporter(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		tracer = NewTracer(NewJSONLinesExporter(&buf))
+	)
+	var _, span = tracer.Start(nil, "job")
+	span.SetAttribute("n", 1).Finish(errors.New("failed"))
+	span.End()
+	var lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line, got %q", buf.String())
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["name"] != "job" || decoded["status"] != StatusError || decoded["error"] != "failed" {
+		t.Errorf("unexpected span %v", decoded)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	var (
+		tracer    = NewTracer(nil)
+		ctx, span = tracer.Start(context.Background(), "client")
+		header    = nethttp.Header{}
+	)
+	Inject(ctx, header)
+	var remote = FromContext(Extract(context.Background(), header))
+	if remote == nil || remote.TraceID != span.TraceID || remote.SpanID != span.SpanID {
+		t.Fatalf("unexpected remote span %+v", remote)
+	}
+	var _, child = tracer.Start(Extract(context.Background(), header), "server")
+	if child.TraceID != span.TraceID || child.ParentID != span.SpanID {
+		t.Error("server span should continue the client trace")
+	}
+	header.Set(TraceParentHeader, "00-zz-1-01")
+	if FromContext(Extract(context.Background(), header)) != nil {
+		t.Error("invalid traceparent should be ignored")
+	}
+}
@@ -0,0 +1,133 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type (
+	// PluginPool 由同一插件 Clone 出的 vm 池, 用于并发执行同一份脚本
+	PluginPool struct {
+		safe   sync.Mutex
+		origin *luaPluginImpl
+		idle   chan *luaPluginImpl
+		// slots 已创建的 vm 名额
+		slots   chan struct{}
+		closed  bool
+		metrics *pluginMetrics
+	}
+)
+
+const (
+	DefaultPoolSize = 8
+)
+
+var (
+	ErrPoolClosed = errors.New("plugin pool closed")
+)
+
+// NewPluginPool 创建最多 size 个 vm 的池, vm 在首次需要时创建
+func NewPluginPool(plugin *luaPluginImpl, size int) *PluginPool {
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+	return &PluginPool{
+		origin:  plugin,
+		idle:    make(chan *luaPluginImpl, size),
+		slots:   make(chan struct{}, size),
+		metrics: newPluginMetrics(registryOf(plugin)),
+	}
+}
+
+// Get 取出空闲 vm, 全部占用且已达上限时等待归还或 ctx 结束
+func (pool *PluginPool) Get(ctx context.Context) (*luaPluginImpl, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case vm, ok := <-pool.idle:
+		return pool.take(vm, ok)
+	default:
+	}
+	select {
+	case vm, ok := <-pool.idle:
+		return pool.take(vm, ok)
+	case pool.slots <- struct{}{}:
+		if pool.isClosed() {
+			<-pool.slots
+			return nil, ErrPoolClosed
+		}
+		var vm, err = pool.origin.Clone()
+		if err != nil {
+			<-pool.slots
+			return nil, err
+		}
+		pool.resize(1)
+		return vm, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (pool *PluginPool) take(vm *luaPluginImpl, ok bool) (*luaPluginImpl, error) {
+	if !ok {
+		return nil, ErrPoolClosed
+	}
+	return vm, nil
+}
+
+func (pool *PluginPool) isClosed() bool {
+	pool.safe.Lock()
+	defer pool.safe.Unlock()
+	return pool.closed
+}
+
+// Put 归还 vm
+func (pool *PluginPool) Put(vm *luaPluginImpl) {
+	if vm == nil {
+		return
+	}
+	pool.safe.Lock()
+	defer pool.safe.Unlock()
+	if pool.closed {
+		vm.Close()
+		pool.resize(-1)
+		return
+	}
+	pool.idle <- vm
+}
+
+// Discard 关闭状态不可信的 vm (如执行中发生 panic), 空出的名额可重新创建
+func (pool *PluginPool) Discard(vm *luaPluginImpl) {
+	if vm != nil {
+		vm.Close()
+	}
+	pool.resize(-1)
+	<-pool.slots
+}
+
+// Size 已创建的 vm 数量
+func (pool *PluginPool) Size() int {
+	return len(pool.slots)
+}
+
+// Close 关闭空闲的 vm, 使用中的 vm 在归还时关闭
+func (pool *PluginPool) Close() {
+	pool.safe.Lock()
+	defer pool.safe.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	close(pool.idle)
+	for vm := range pool.idle {
+		vm.Close()
+		pool.resize(-1)
+	}
+}
+
+// resize 更新 vm 数量指标
+func (pool *PluginPool) resize(delta float64) {
+	pool.metrics.pool(pool.origin.Runtime().Name, delta)
+}
@@ -49,6 +49,14 @@ const (
 	RegexpSplitDelimCapture  = 1
 	RegexpSplitOffsetCapture = 2
 	RegexpQuoteChars         = `\.\\\+\*\?\[\^\]\$\(\)\{\}=\!<>\|:-`
+	RegexpCacheSize          = 512
+)
+
+var (
+	regexpCache = struct {
+		safe  sync.RWMutex
+		items map[string]*regexp.Regexp
+	}{items: make(map[string]*regexp.Regexp)}
 )
 
 func (arg *Args) NotNil(key string) bool {
@@ -120,7 +128,7 @@ func NewString(s string) String {
 
 // RegexpReplace 正则替换
 func RegexpReplace(pattern string, replacement string, subject string) string {
-	var reg, err = regexp.Compile(regexpPattern(pattern))
+	var reg, err = RegexpCompile(pattern)
 	if err != nil {
 		return subject
 	}
@@ -129,7 +137,7 @@ func RegexpReplace(pattern string, replacement string, subject string) string {
 
 // RegexpMatches 正则获取匹配子字符串
 func RegexpMatches(pattern string, subject string) Array {
-	var reg, err = regexp.Compile(regexpPattern(pattern))
+	var reg, err = RegexpCompile(pattern)
 	if err != nil {
 		return nil
 	}
@@ -148,8 +156,7 @@ func RegexpSplit(pattern, subject string, limit, flag int) Array {
 	if limit == 0 {
 		limit = -1
 	}
-	pattern = regexpPattern(pattern)
-	var reg, err = regexp.Compile(pattern)
+	var reg, err = RegexpCompile(pattern)
 	if err != nil {
 		return nil
 	}
@@ -183,7 +190,7 @@ func RegexpQuote(word string, delimiter ...string) string {
 		pattern = pattern + delimiter[0]
 	}
 	pattern = fmt.Sprintf(`[%s]`, pattern)
-	var reg, err = regexp.Compile(regexpPattern(pattern))
+	var reg, err = RegexpCompile(pattern)
 	if err != nil {
 		return word
 	}
@@ -203,8 +210,63 @@ func RegexpStrAllQuote(d string) string {
 	return strings.Join(list, "")
 }
 
-// 过滤PHP JS 正则开头(/) 与结尾(/)
+// RegexpCompile 编译并缓存正则, 支持 PHP 风格的 /pattern/flags (flags: i m s U)
+func RegexpCompile(pattern string) (*regexp.Regexp, error) {
+	regexpCache.safe.RLock()
+	var reg, ok = regexpCache.items[pattern]
+	regexpCache.safe.RUnlock()
+	if ok {
+		return reg, nil
+	}
+	var err error
+	if reg, err = regexp.Compile(regexpPattern(pattern)); err != nil {
+		return nil, fmt.Errorf("regexp %q: %w", pattern, err)
+	}
+	regexpCache.safe.Lock()
+	defer regexpCache.safe.Unlock()
+	// 超出容量时整体清空, 避免动态拼接的正则无限增长
+	if len(regexpCache.items) >= RegexpCacheSize {
+		regexpCache.items = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.items[pattern] = reg
+	return reg, nil
+}
+
+// RegexpReplaceFunc 正则替换, fn 接收完整匹配与各分组, limit < 0 替换全部
+func RegexpReplaceFunc(pattern string, subject string, limit int, fn func(matches []string) string) (string, error) {
+	var reg, err = RegexpCompile(pattern)
+	if err != nil {
+		return subject, err
+	}
+	var (
+		last   = 0
+		buffer = bytes.NewBuffer(nil)
+	)
+	for _, loc := range reg.FindAllStringSubmatchIndex(subject, limit) {
+		var matches = make([]string, len(loc)/2)
+		for i := range matches {
+			if loc[2*i] >= 0 {
+				matches[i] = subject[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		buffer.WriteString(subject[last:loc[0]])
+		buffer.WriteString(fn(matches))
+		last = loc[1]
+	}
+	buffer.WriteString(subject[last:])
+	return buffer.String(), nil
+}
+
+// 过滤PHP JS 正则开头(/) 与结尾(/), 结尾的修饰符转换为 (?flags)
 func regexpPattern(pattern string) string {
+	if strings.HasPrefix(pattern, `/`) {
+		if i := strings.LastIndex(pattern, `/`); i > 0 && i < len(pattern)-1 {
+			var flags = pattern[i+1:]
+			if strings.Trim(flags, "imsU") == "" {
+				return "(?" + flags + ")" + pattern[1:i]
+			}
+		}
+	}
 	return strings.TrimSuffix(strings.TrimPrefix(pattern, `/`), `/`)
 }
 
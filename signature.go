@@ -0,0 +1,192 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type (
+	// ScriptVerifier 加载前校验脚本的 openpgp 分离签名 (.sig 二进制 / .asc armor),
+	// 或校验已签名的 bundle 清单中记录的 sha256
+	ScriptVerifier struct {
+		safe    sync.RWMutex
+		keyring openpgp.EntityList
+		// digests 以相对清单目录 (即脚本根目录) 的 slash 路径为 key, dirs 为已登记清单所在的绝对目录
+		digests map[string]string
+		dirs    []string
+	}
+
+	// SignatureError 脚本签名校验失败
+	SignatureError struct {
+		File string
+		Err  error
+	}
+)
+
+const (
+	SignatureExt        = ".sig"
+	ArmoredSignatureExt = ".asc"
+)
+
+var (
+	ErrSignatureMissing = errors.New("signature not found")
+	ErrDigestMismatch   = errors.New("digest mismatch with signed manifest")
+)
+
+// NewScriptVerifier 读取公钥环 (armor 或二进制格式)
+func NewScriptVerifier(keyring io.Reader) (*ScriptVerifier, error) {
+	var data, err = ioutil.ReadAll(keyring)
+	if err != nil {
+		return nil, err
+	}
+	var entities openpgp.EntityList
+	if entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err != nil {
+		if entities, err = openpgp.ReadKeyRing(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("read keyring: %w", err)
+		}
+	}
+	if len(entities) <= 0 {
+		return nil, errors.New("read keyring: empty keyring")
+	}
+	var verifier = &ScriptVerifier{keyring: entities, digests: make(map[string]string)}
+	return verifier, nil
+}
+
+// LoadScriptVerifier 从文件读取公钥环
+func LoadScriptVerifier(keyringFile string) (*ScriptVerifier, error) {
+	var fd, err = os.Open(keyringFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	return NewScriptVerifier(fd)
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("verify script %s: %s", e.File, e.Err.Error())
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// LoadManifest 校验 bundle 清单的分离签名后登记其中的脚本摘要
+// 清单为 sha256sum 格式: "<hex sha256>  <相对清单目录的路径>"
+func (v *ScriptVerifier) LoadManifest(file string) error {
+	var data, err = ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err = v.Verify(file, data); err != nil {
+		return err
+	}
+	var dir = filepath.Dir(file)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	var (
+		digests = make(map[string]string)
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+	for scanner.Scan() {
+		var fields = strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return &SignatureError{File: file, Err: fmt.Errorf("invalid manifest line %q", scanner.Text())}
+		}
+		var script = filepath.FromSlash(strings.TrimPrefix(fields[1], "*"))
+		if filepath.IsAbs(script) {
+			if rel, err := filepath.Rel(dir, script); err == nil {
+				script = rel
+			}
+		}
+		digests[rootPath(script)] = strings.ToLower(fields[0])
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	v.safe.Lock()
+	defer v.safe.Unlock()
+	for k, sum := range digests {
+		v.digests[k] = sum
+	}
+	for _, known := range v.dirs {
+		if known == dir {
+			return nil
+		}
+	}
+	v.dirs = append(v.dirs, dir)
+	return nil
+}
+
+// Verify 校验脚本内容 data: 优先匹配已签名清单的摘要, 否则查找同目录的 .sig/.asc 签名
+func (v *ScriptVerifier) Verify(file string, data []byte) error {
+	var sum, ok = v.digest(file)
+	return v.verify(file, data, sum, ok, ioutil.ReadFile)
+}
+
+// VerifyFS 同 Verify, file 为相对 fsys 根目录的路径, 按相对路径匹配清单摘要, 签名文件从 fsys 中读取
+func (v *ScriptVerifier) VerifyFS(fsys fs.FS, file string, data []byte) error {
+	v.safe.RLock()
+	var sum, ok = v.digests[rootPath(file)]
+	v.safe.RUnlock()
+	return v.verify(file, data, sum, ok, func(name string) ([]byte, error) {
+		return fs.ReadFile(fsys, name)
+	})
+}
+
+func (v *ScriptVerifier) verify(file string, data []byte, sum string, signed bool, readFile func(string) ([]byte, error)) error {
+	if signed {
+		var actual = sha256.Sum256(data)
+		if hex.EncodeToString(actual[:]) != sum {
+			return &SignatureError{File: file, Err: ErrDigestMismatch}
+		}
+		return nil
+	}
+	if signature, err := readFile(file + SignatureExt); err == nil {
+		if _, err = openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(data), bytes.NewReader(signature)); err != nil {
+			return &SignatureError{File: file, Err: err}
+		}
+		return nil
+	}
+	if signature, err := readFile(file + ArmoredSignatureExt); err == nil {
+		if _, err = openpgp.CheckArmoredDetachedSignature(v.keyring, bytes.NewReader(data), bytes.NewReader(signature)); err != nil {
+			return &SignatureError{File: file, Err: err}
+		}
+		return nil
+	}
+	return &SignatureError{File: file, Err: ErrSignatureMissing}
+}
+
+// digest 磁盘上的脚本按相对已登记清单目录的路径匹配摘要
+func (v *ScriptVerifier) digest(file string) (string, bool) {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	v.safe.RLock()
+	defer v.safe.RUnlock()
+	for _, dir := range v.dirs {
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			if sum, ok := v.digests[rootPath(rel)]; ok {
+				return sum, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,160 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"golang.org/x/crypto/openpgp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScriptVerifier(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		entity, err = openpgp.NewEntity("release", "", "release@example.com", nil)
+		keyring     = bytes.NewBuffer(nil)
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.Serialize(keyring); err != nil {
+		t.Fatal(err)
+	}
+	var sign = func(file string, armored bool) {
+		var signature = bytes.NewBuffer(nil)
+		var data, _ = ioutil.ReadFile(file)
+		if armored {
+			err = openpgp.ArmoredDetachSign(signature, entity, bytes.NewReader(data), nil)
+			writeFile(t, file+ArmoredSignatureExt, signature.String())
+		} else {
+			err = openpgp.DetachSign(signature, entity, bytes.NewReader(data), nil)
+			writeFile(t, file+SignatureExt, signature.String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	verifier, err := NewScriptVerifier(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		main     = filepath.Join(dir, "main.lua")
+		lib      = filepath.Join(dir, "lib.lua")
+		unsigned = filepath.Join(dir, "unsigned.lua")
+		plugin   = NewLua(PluginOptions{Verifier: verifier})
+	)
+	writeFile(t, lib, `return {answer = 42}`)
+	writeFile(t, unsigned, `return {}`)
+	writeFile(t, main, fmt.Sprintf(`package.path = %q; lib = require("lib")`, filepath.Join(dir, "?.lua")))
+	sign(main, false)
+	sign(lib, true)
+
+	if err = plugin.DoFile(main); err != nil {
+		t.Fatal(err)
+	}
+	if err = plugin.EvalExpr(`assert(lib.answer == 42)`); err != nil {
+		t.Error(err)
+	}
+	if err = plugin.EvalExpr(`require("unsigned")`); err == nil {
+		t.Error("require of unsigned script should fail")
+	}
+	if err = plugin.DoFile(unsigned); !errors.Is(err, ErrSignatureMissing) {
+		t.Errorf("expect missing signature, got %v", err)
+	}
+	// 基础库的 dofile, loadfile 同样需要签名
+	plugin.GetLState().SetGlobal("unsigned", lua.LString(unsigned))
+	if err = plugin.EvalExpr(`dofile(unsigned)`); err == nil || !strings.Contains(err.Error(), ErrSignatureMissing.Error()) {
+		t.Errorf("dofile of unsigned script should fail, got %v", err)
+	}
+	if err = plugin.EvalExpr(`local fn, err = loadfile(unsigned); assert(fn == nil and err)`); err != nil {
+		t.Error(err)
+	}
+	if err = plugin.EvalExpr(fmt.Sprintf(`assert(dofile(%q).answer == 42)`, lib)); err != nil {
+		t.Error(err)
+	}
+	writeFile(t, lib, `return {answer = 0}`)
+	if _, err = plugin.LoadFile(lib); err == nil {
+		t.Error("tampered script should fail")
+	}
+
+	// 已签名的 bundle 清单
+	var sum = sha256.Sum256([]byte(`return {}`))
+	var manifest = filepath.Join(dir, "SHA256SUMS")
+	writeFile(t, manifest, hex.EncodeToString(sum[:])+"  unsigned.lua\n")
+	if err = verifier.LoadManifest(manifest); !errors.Is(err, ErrSignatureMissing) {
+		t.Errorf("unsigned manifest should fail, got %v", err)
+	}
+	sign(manifest, false)
+	if err = verifier.LoadManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err = plugin.DoFile(unsigned); err != nil {
+		t.Error(err)
+	}
+	// 以清单目录为 ScriptRoot 时按相对路径匹配摘要, 与进程的工作目录无关
+	var rooted = NewLua(PluginOptions{Verifier: verifier, ScriptRoot: os.DirFS(dir)})
+	if err = rooted.DoFile("unsigned.lua"); err != nil {
+		t.Error(err)
+	}
+	if err = rooted.DoFile("./unsigned.lua"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScriptVerifier_Task(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		entity, err = openpgp.NewEntity("release", "", "release@example.com", nil)
+		keyring     = bytes.NewBuffer(nil)
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.Serialize(keyring); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewScriptVerifier(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code = `return {answer = function() return 42 end}`
+	for _, name := range []string{"good", "bad"} {
+		var (
+			file      = filepath.Join(dir, name+".lua")
+			signature = bytes.NewBuffer(nil)
+		)
+		writeFile(t, file, code)
+		if err = openpgp.DetachSign(signature, entity, strings.NewReader(code), nil); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, file+SignatureExt, signature.String())
+	}
+	var plugin = NewLua(PluginOptions{Verifier: verifier}).SetLoader(CreateExtendsLoader)
+	defer plugin.Close()
+	plugin.Boot()
+	var setup = `
+package.path = %q
+good, bad = require("good"), require("bad")
+function spawn(lib)
+	return require("task").spawn(function() return lib.answer() end):await()
+end`
+	if err = plugin.EvalExpr(fmt.Sprintf(setup, filepath.Join(dir, "?.lua"))); err != nil {
+		t.Fatal(err)
+	}
+	// task 的 vm 重新加载模块时同样校验签名, 加载后被篡改的脚本不能通过 task 执行
+	writeFile(t, filepath.Join(dir, "bad.lua"), `return {answer = function() return 0 end}`)
+	if err = plugin.EvalExpr(`local v, err = spawn(good); assert(v == 42, tostring(err))`); err != nil {
+		t.Error(err)
+	}
+	if err = plugin.EvalExpr(`local v, err = spawn(bad); assert(v == nil and string.find(err, "verify script"), tostring(err))`); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,96 @@
+package plugins
+
+import (
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"sort"
+)
+
+// Snapshot 独占 vm 将全局变量 roots 序列化到 w (默认为所有非库的 table/string/number/bool 全局变量)
+// 共享引用与环引用会被保留, function/userdata 等不可序列化的值以路径形式报错, 此时不写入 w
+func (plugin *luaPluginImpl) Snapshot(w io.Writer, roots ...string) error {
+	if w == nil {
+		return errors.New("writer nil")
+	}
+	return plugin.exec("plugin.snapshot", func() error {
+		var (
+			state  = plugin.GetLState()
+			global = state.NewTable()
+		)
+		if len(roots) <= 0 {
+			roots = plugin.snapshotRoots()
+		}
+		for _, name := range roots {
+			global.RawSetString(name, state.GetGlobal(name))
+		}
+		var _, err = core.NewValueEncoder().Encode(global).WriteTo(w)
+		return err
+	})
+}
+
+// Restore 独占 vm 从 Snapshot 产出的数据还原全局变量
+func (plugin *luaPluginImpl) Restore(r io.Reader) error {
+	if r == nil {
+		return errors.New("reader nil")
+	}
+	return plugin.exec("plugin.restore", func() error {
+		var (
+			state      = plugin.GetLState()
+			value, err = core.NewValueDecoder(r).Decode(state)
+		)
+		if err != nil {
+			return err
+		}
+		var global, ok = value.(*lua.LTable)
+		if !ok {
+			return errors.New("invalid snapshot: root is not a table")
+		}
+		global.ForEach(func(key lua.LValue, v lua.LValue) {
+			if name, ok := key.(lua.LString); ok {
+				state.SetGlobal(string(name), v)
+			}
+		})
+		return nil
+	})
+}
+
+func (plugin *luaPluginImpl) snapshotRoots() []string {
+	var (
+		roots  []string
+		state  = plugin.GetLState()
+		loaded = plugin.loadedModules()
+	)
+	state.G.Global.ForEach(func(key lua.LValue, v lua.LValue) {
+		var name, ok = key.(lua.LString)
+		if !ok || name == "_G" || loaded[string(name)] {
+			return
+		}
+		switch v.Type() {
+		case lua.LTTable, lua.LTString, lua.LTNumber, lua.LTBool:
+			roots = append(roots, string(name))
+		}
+	})
+	sort.Strings(roots)
+	return roots
+}
+
+// 已加载的库 (string,table,logger ...) 不参与快照
+func (plugin *luaPluginImpl) loadedModules() map[string]bool {
+	var (
+		loaded = make(map[string]bool)
+		state  = plugin.GetLState()
+	)
+	var pkg, ok = state.GetGlobal(lua.LoadLibName).(*lua.LTable)
+	if !ok {
+		return loaded
+	}
+	if mods, ok := pkg.RawGetString("loaded").(*lua.LTable); ok {
+		mods.ForEach(func(key lua.LValue, _ lua.LValue) {
+			loaded[key.String()] = true
+		})
+	}
+	loaded[lua.LoadLibName] = true
+	return loaded
+}
@@ -0,0 +1,114 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/weblfe/plugin_lua/core"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLuaPluginImpl_Snapshot(t *testing.T) {
+	var (
+		buffer = bytes.NewBuffer(nil)
+		source = NewLua()
+		target = NewLua()
+	)
+	var code = `
+		config = {name = "billing", retry = 3, enabled = true}
+		config.self = config
+		shared = {1, 2, 3}
+		holder = {a = shared, b = shared}
+	`
+	if err := source.EvalExpr(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Snapshot(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Restore(buffer); err != nil {
+		t.Fatal(err)
+	}
+	var check = `
+		assert(config.name == "billing" and config.retry == 3 and config.enabled)
+		assert(config.self == config, "cycle")
+		assert(holder.a == holder.b and holder.a[3] == 3, "shared reference")
+	`
+	if err := target.EvalExpr(check); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLuaPluginImpl_SnapshotOwnerBusy(t *testing.T) {
+	var (
+		buffer = bytes.NewBuffer(nil)
+		plugin = NewLua()
+		rt     = plugin.Runtime()
+		done   = make(chan error, 1)
+	)
+	if err := plugin.EvalExpr(`config = {name = "billing"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		done <- plugin.Snapshot(buffer)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("snapshot ran while owner busy: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	rt.Release()
+	if err := <-done; err != nil || buffer.Len() == 0 {
+		t.Errorf("unexpected snapshot %d bytes, err %v", buffer.Len(), err)
+	}
+}
+
+func TestLuaPluginImpl_SnapshotUnsupported(t *testing.T) {
+	var (
+		buffer = bytes.NewBuffer(nil)
+		plugin = NewLua()
+	)
+	if err := plugin.EvalExpr(`handlers = {route = function() end, list = {print}}`); err != nil {
+		t.Fatal(err)
+	}
+	var err = plugin.Snapshot(buffer, "handlers")
+	var unsupported *core.UnsupportedValueError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expect UnsupportedValueError, got %v", err)
+	}
+	if len(unsupported.Paths) != 2 || !strings.HasPrefix(unsupported.Paths[0], "handlers.list[1]") {
+		t.Errorf("unexpected paths: %v", unsupported.Paths)
+	}
+	if buffer.Len() != 0 {
+		t.Error("snapshot should not write on error")
+	}
+}
+
+func TestUnmarshalValue_OversizedString(t *testing.T) {
+	var data, err = core.MarshalValue(lua.LString("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i = bytes.Index(data, []byte("\x03abc"))
+	if i < 0 {
+		t.Fatalf("string not found in %q", data)
+	}
+	var L = lua.NewState()
+	defer L.Close()
+	for size, want := range map[uint64]error{1 << 40: core.ErrValueTooLarge, 1 << 20: io.ErrUnexpectedEOF} {
+		var varint = make([]byte, binary.MaxVarintLen64)
+		var corrupt = append(append([]byte(nil), data[:i]...), varint[:binary.PutUvarint(varint, size)]...)
+		corrupt = append(corrupt, data[i+1:]...)
+		if _, err = core.UnmarshalValue(L, corrupt); !errors.Is(err, want) {
+			t.Errorf("size %d: expect %v, got %v", size, want, err)
+		}
+	}
+}